@@ -0,0 +1,252 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// HashChainConfig defines the config for NewHashChainSink.
+type HashChainConfig struct {
+	ChainID string // Optional, defaults to a random ID, so every process starts its own chains
+	Key     []byte // Optional, records are hashed with HMAC-SHA256 when set, with plain SHA-256 otherwise
+}
+
+// HashChainSink makes audit records tamper-evident. Every record gets a sequence number and a hash
+// of its content chained to the hash of the previous record written for the same tenant.
+// Records of a tenant are written one at a time, so the sequence has no holes caused by failed writes.
+type HashChainSink struct {
+	sink  AuditSink
+	chain string
+	key   []byte
+
+	mu    sync.Mutex
+	heads map[uuid.UUID]*chainHead
+}
+
+type chainHead struct {
+	mu   sync.Mutex
+	seq  uint64
+	hash string
+}
+
+// NewHashChainSink returns a sink chaining audit records before writing them to sink.
+// Without a Key anyone able to rewrite the whole chain can recompute the hashes, use a Key
+// kept away from the audit storage to detect that as well.
+func NewHashChainSink(sink AuditSink, cfg HashChainConfig) *HashChainSink {
+	if cfg.ChainID == "" {
+		cfg.ChainID = uuid.NewString()
+	}
+
+	return &HashChainSink{
+		sink:  sink,
+		chain: cfg.ChainID,
+		key:   cfg.Key,
+		heads: make(map[uuid.UUID]*chainHead),
+	}
+}
+
+func (s *HashChainSink) Write(ctx context.Context, record AuditRecord) error {
+	head := s.head(record.TenantID)
+
+	head.mu.Lock()
+	defer head.mu.Unlock()
+
+	record.Chain = s.chain
+	record.Seq = head.seq + 1
+	record.PrevHash = head.hash
+	h, err := chainHash(record, s.key)
+	if err != nil {
+		return err
+	}
+	record.Hash = h
+
+	if err := s.sink.Write(ctx, record); err != nil {
+		return err
+	}
+	head.seq, head.hash = record.Seq, record.Hash
+
+	return nil
+}
+
+func (s *HashChainSink) head(tenantID uuid.UUID) *chainHead {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, ok := s.heads[tenantID]
+	if !ok {
+		head = &chainHead{}
+		s.heads[tenantID] = head
+	}
+
+	return head
+}
+
+// chainHash hashes the JSON encoding of the record without its hash. Values which may change
+// in a storage round trip, like time zone and empty lists, are normalized first.
+func chainHash(record AuditRecord, key []byte) (string, error) {
+	record.Hash = ""
+	record.CreatedAt = record.CreatedAt.UTC()
+	for _, list := range []*[]string{&record.Roles, &record.MissingRoles, &record.MissingScopes} {
+		if len(*list) == 0 {
+			*list = nil
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Chain issue kinds reported by VerifyAuditChain.
+const (
+	ChainIssueModified   = "modified"    // record content does not match its hash
+	ChainIssueBrokenLink = "broken_link" // previous hash does not match the hash of the preceding record
+	ChainIssueGap        = "gap"         // records are missing before the record
+	ChainIssueDuplicate  = "duplicate"   // sequence number is used by more than one record
+)
+
+// ChainIssue is a single problem found by VerifyAuditChain.
+type ChainIssue struct {
+	Kind     string
+	Chain    string
+	Seq      uint64
+	RecordID uuid.UUID
+	Missing  uint64 // number of missing records, set for ChainIssueGap
+}
+
+func (i ChainIssue) String() string {
+	if i.Kind == ChainIssueGap {
+		return fmt.Sprintf("chain %s: %d records missing before seq %d (record %s)", i.Chain, i.Missing, i.Seq, i.RecordID)
+	}
+
+	return fmt.Sprintf("chain %s: %s at seq %d (record %s)", i.Chain, i.Kind, i.Seq, i.RecordID)
+}
+
+// ChainReport is the result of VerifyAuditChain.
+type ChainReport struct {
+	TenantID  uuid.UUID
+	Chains    int
+	Records   int // chained records verified
+	Unchained int // records without hash, e.g. written before chaining was enabled
+	Issues    []ChainIssue
+}
+
+// OK reports whether no issues were found.
+func (r *ChainReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// VerifyAuditChain walks chained records of the tenant and reports modified records, broken links,
+// gaps and duplicates. Records of other tenants are ignored and records may come in any order.
+// Key has to be the one used by HashChainSink. Removal of the newest records of a chain cannot be
+// detected from the records alone, compare the last sequence number with an external checkpoint for that.
+func VerifyAuditChain(tenantID uuid.UUID, records []AuditRecord, key []byte) *ChainReport {
+	report := &ChainReport{TenantID: tenantID}
+
+	chains := make(map[string][]AuditRecord)
+	var order []string
+	for _, r := range records {
+		if r.TenantID != tenantID {
+			continue
+		}
+		if r.Hash == "" {
+			report.Unchained++
+			continue
+		}
+		if _, ok := chains[r.Chain]; !ok {
+			order = append(order, r.Chain)
+		}
+		chains[r.Chain] = append(chains[r.Chain], r)
+		report.Records++
+	}
+	report.Chains = len(order)
+
+	for _, chain := range order {
+		report.Issues = append(report.Issues, verifyChain(chains[chain], key)...)
+	}
+
+	return report
+}
+
+func verifyChain(records []AuditRecord, key []byte) []ChainIssue {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+
+	var (
+		issues   []ChainIssue
+		prev     *AuditRecord
+		expected uint64 = 1
+	)
+	for i := range records {
+		r := &records[i]
+		issue := func(kind string) ChainIssue {
+			return ChainIssue{Kind: kind, Chain: r.Chain, Seq: r.Seq, RecordID: r.ID}
+		}
+
+		if h, err := chainHash(*r, key); err != nil || !hmac.Equal([]byte(h), []byte(r.Hash)) {
+			issues = append(issues, issue(ChainIssueModified))
+		}
+
+		switch {
+		case prev != nil && r.Seq == prev.Seq:
+			issues = append(issues, issue(ChainIssueDuplicate))
+			continue
+		case r.Seq > expected:
+			gap := issue(ChainIssueGap)
+			gap.Missing = r.Seq - expected
+			issues = append(issues, gap)
+		case r.Seq == expected:
+			prevHash := ""
+			if prev != nil {
+				prevHash = prev.Hash
+			}
+			if r.PrevHash != prevHash {
+				issues = append(issues, issue(ChainIssueBrokenLink))
+			}
+		}
+
+		prev = r
+		expected = r.Seq + 1
+	}
+
+	return issues
+}
+
+// ReadAuditRecords reads audit records written as JSON lines by JSONLinesSink or FileSink.
+func ReadAuditRecords(r io.Reader) ([]AuditRecord, error) {
+	var records []AuditRecord
+	dec := json.NewDecoder(r)
+	for {
+		var record AuditRecord
+		if err := dec.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, nil
+			}
+			return nil, fmt.Errorf("read audit records - record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
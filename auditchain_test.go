@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeChain writes n records of tenantID and one of another tenant through a HashChainSink.
+func writeChain(t *testing.T, n int, key []byte) []AuditRecord {
+	sink := &recordingSink{}
+	chain := NewHashChainSink(sink, HashChainConfig{ChainID: "foo_chain", Key: key})
+
+	for i := 0; i < n; i++ {
+		record := auditRecord
+		record.ID = uuid.New()
+		record.URL = fmt.Sprintf("/foo/%d", i)
+		if !assert.NoError(t, chain.Write(context.Background(), record)) {
+			t.FailNow()
+		}
+	}
+	other := auditRecord
+	other.TenantID = uuid.New()
+	assert.NoError(t, chain.Write(context.Background(), other))
+
+	var records []AuditRecord
+	for _, b := range sink.batches {
+		records = append(records, b...)
+	}
+
+	return records
+}
+
+func TestHashChainSink_Write(t *testing.T) {
+	records := writeChain(t, 3, nil)
+	if !assert.Len(t, records, 4) {
+		return
+	}
+
+	for i, r := range records[:3] {
+		assert.Equal(t, "foo_chain", r.Chain)
+		assert.Equal(t, uint64(i+1), r.Seq)
+		assert.NotEmpty(t, r.Hash)
+		if i > 0 {
+			assert.Equal(t, records[i-1].Hash, r.PrevHash)
+		} else {
+			assert.Empty(t, r.PrevHash)
+		}
+	}
+	// other tenants have their own chain
+	assert.Equal(t, uint64(1), records[3].Seq)
+	assert.Empty(t, records[3].PrevHash)
+}
+
+func TestHashChainSink_WriteFailure(t *testing.T) {
+	sink := &recordingSink{fails: 1}
+	chain := NewHashChainSink(sink, HashChainConfig{})
+
+	assert.EqualError(t, chain.Write(context.Background(), auditRecord), "foo sink")
+	assert.NoError(t, chain.Write(context.Background(), auditRecord))
+
+	if assert.Len(t, sink.batches, 1) {
+		got := sink.batches[0][0]
+		assert.Equal(t, uint64(1), got.Seq)
+		assert.NotEmpty(t, got.Chain)
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	key := []byte("foo_key")
+
+	tests := []struct {
+		name      string
+		records   func(records []AuditRecord) []AuditRecord
+		key       []byte
+		wantKinds []string
+		wantSeqs  []uint64
+	}{
+		{
+			name: "ShouldPassUntouchedChain",
+			records: func(records []AuditRecord) []AuditRecord {
+				return records
+			},
+			key: key,
+		},
+		{
+			name: "ShouldPassShuffledChain",
+			records: func(records []AuditRecord) []AuditRecord {
+				return []AuditRecord{records[2], records[0], records[3], records[1]}
+			},
+			key: key,
+		},
+		{
+			name: "ShouldReportModifiedRecord",
+			records: func(records []AuditRecord) []AuditRecord {
+				records[1].StatusCode = 500
+				return records
+			},
+			key:       key,
+			wantKinds: []string{ChainIssueModified},
+			wantSeqs:  []uint64{2},
+		},
+		{
+			name: "ShouldReportBrokenLinkWhenHashIsRecomputed",
+			records: func(records []AuditRecord) []AuditRecord {
+				records[1].StatusCode = 500
+				records[1].Hash, _ = chainHash(records[1], key)
+				return records
+			},
+			key:       key,
+			wantKinds: []string{ChainIssueBrokenLink},
+			wantSeqs:  []uint64{3},
+		},
+		{
+			name: "ShouldReportGap",
+			records: func(records []AuditRecord) []AuditRecord {
+				return append(records[:1], records[3:]...)
+			},
+			key:       key,
+			wantKinds: []string{ChainIssueGap},
+			wantSeqs:  []uint64{4},
+		},
+		{
+			name: "ShouldReportMissingFirstRecord",
+			records: func(records []AuditRecord) []AuditRecord {
+				return records[1:]
+			},
+			key:       key,
+			wantKinds: []string{ChainIssueGap},
+			wantSeqs:  []uint64{2},
+		},
+		{
+			name: "ShouldReportDuplicate",
+			records: func(records []AuditRecord) []AuditRecord {
+				return append(records, records[2])
+			},
+			key:       key,
+			wantKinds: []string{ChainIssueDuplicate},
+			wantSeqs:  []uint64{3},
+		},
+		{
+			name: "ShouldReportEveryRecordWithWrongKey",
+			records: func(records []AuditRecord) []AuditRecord {
+				return records
+			},
+			key:       []byte("bar_key"),
+			wantKinds: []string{ChainIssueModified, ChainIssueModified, ChainIssueModified, ChainIssueModified},
+			wantSeqs:  []uint64{1, 2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := writeChain(t, 4, key)
+
+			report := VerifyAuditChain(tenantID, tt.records(records), tt.key)
+
+			var kinds []string
+			var seqs []uint64
+			for _, issue := range report.Issues {
+				kinds = append(kinds, issue.Kind)
+				seqs = append(seqs, issue.Seq)
+			}
+			assert.Equal(t, tt.wantKinds, kinds)
+			assert.Equal(t, tt.wantSeqs, seqs)
+			assert.Equal(t, len(tt.wantKinds) == 0, report.OK())
+		})
+	}
+}
+
+func TestVerifyAuditChain_exportedFile(t *testing.T) {
+	var buf bytes.Buffer
+	chain := NewHashChainSink(NewJSONLinesSink(&buf), HashChainConfig{})
+
+	unchained := auditRecord
+	assert.NoError(t, NewJSONLinesSink(&buf).Write(context.Background(), unchained))
+	for i := 0; i < 3; i++ {
+		record := auditRecord
+		record.ID = uuid.New()
+		record.Roles = []string{}
+		record.Body = &CapturedBody{Request: `{"name":"foo"}`}
+		assert.NoError(t, chain.Write(context.Background(), record))
+	}
+
+	records, err := ReadAuditRecords(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	report := VerifyAuditChain(tenantID, records, nil)
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Records)
+	assert.Equal(t, 1, report.Chains)
+	assert.Equal(t, 1, report.Unchained)
+}
+
+func TestReadAuditRecords(t *testing.T) {
+	_, err := ReadAuditRecords(bytes.NewBufferString("{\"id\":\"" + requestID.String() + "\"}\n{foo"))
+	assert.EqualError(t, err, "read audit records - record 2: invalid character 'f' looking for beginning of object key string")
+}
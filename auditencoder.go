@@ -0,0 +1,513 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// AuditEncoder serializes audit records for sinks writing them as messages or lines,
+// i.e. JSONLinesSink, FileSink and SQSSink. The encoded record must not end with a new line.
+type AuditEncoder interface {
+	Encode(record AuditRecord) ([]byte, error)
+}
+
+// defaultAuditProduct is the product name reported by SIEM encoders when not configured.
+const defaultAuditProduct = "go-middleware"
+
+// auditVendor is the vendor name reported by SIEM encoders.
+const auditVendor = "grasp-labs"
+
+// JSONEncoder encodes audit records in the AuditRecord schema.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(record AuditRecord) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// OCSF API Activity class, see https://schema.ocsf.io/1.1.0/classes/api_activity.
+const (
+	ocsfVersion        = "1.1.0"
+	ocsfCategoryUID    = 6
+	ocsfAPIActivityUID = 6003
+	ocsfStatusSuccess  = 1
+	ocsfStatusFailure  = 2
+	ocsfSeverityInfo   = 1
+	ocsfSeverityMedium = 3
+)
+
+// OCSFEncoder encodes audit records as OCSF 1.1.0 API Activity events.
+type OCSFEncoder struct {
+	Product string // Optional, name of the service, defaults to go-middleware
+}
+
+type ocsfEvent struct {
+	ActivityID   int              `json:"activity_id"`
+	ActivityName string           `json:"activity_name"`
+	CategoryUID  int              `json:"category_uid"`
+	CategoryName string           `json:"category_name"`
+	ClassUID     int              `json:"class_uid"`
+	ClassName    string           `json:"class_name"`
+	TypeUID      int              `json:"type_uid"`
+	SeverityID   int              `json:"severity_id"`
+	Severity     string           `json:"severity"`
+	StatusID     int              `json:"status_id"`
+	Status       string           `json:"status"`
+	StatusCode   string           `json:"status_code"`
+	StatusDetail string           `json:"status_detail,omitempty"`
+	Message      string           `json:"message,omitempty"`
+	Time         int64            `json:"time"`
+	Duration     int64            `json:"duration"`
+	Metadata     ocsfMetadata     `json:"metadata"`
+	Actor        ocsfActor        `json:"actor"`
+	API          ocsfAPI          `json:"api"`
+	HTTPRequest  ocsfHTTPRequest  `json:"http_request"`
+	HTTPResponse ocsfHTTPResponse `json:"http_response"`
+	SrcEndpoint  ocsfEndpoint     `json:"src_endpoint"`
+	Unmapped     map[string]any   `json:"unmapped,omitempty"`
+}
+
+type ocsfMetadata struct {
+	Version        string      `json:"version"`
+	UID            string      `json:"uid"`
+	CorrelationUID string      `json:"correlation_uid,omitempty"`
+	Product        ocsfProduct `json:"product"`
+}
+
+type ocsfProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+type ocsfActor struct {
+	User ocsfUser `json:"user"`
+}
+
+type ocsfUser struct {
+	UID    string      `json:"uid,omitempty"`
+	Type   string      `json:"type,omitempty"`
+	Groups []ocsfGroup `json:"groups,omitempty"`
+	Org    ocsfOrg     `json:"org"`
+}
+
+type ocsfGroup struct {
+	Name string `json:"name"`
+}
+
+type ocsfOrg struct {
+	UID  string `json:"uid"`
+	Name string `json:"name,omitempty"`
+}
+
+type ocsfAPI struct {
+	Operation string          `json:"operation"`
+	Request   ocsfAPIRequest  `json:"request"`
+	Response  ocsfAPIResponse `json:"response"`
+}
+
+type ocsfAPIRequest struct {
+	UID string `json:"uid"`
+}
+
+type ocsfAPIResponse struct {
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+type ocsfHTTPRequest struct {
+	HTTPMethod string  `json:"http_method"`
+	URL        ocsfURL `json:"url"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Length     int64   `json:"length"`
+}
+
+type ocsfURL struct {
+	URLString string `json:"url_string"`
+	Path      string `json:"path"`
+	QueryStr  string `json:"query_string,omitempty"`
+}
+
+type ocsfHTTPResponse struct {
+	Code   int   `json:"code"`
+	Length int64 `json:"length"`
+}
+
+type ocsfEndpoint struct {
+	IP  string `json:"ip,omitempty"`
+	UID string `json:"uid,omitempty"` // pseudonymized client IP
+}
+
+func (e OCSFEncoder) Encode(record AuditRecord) ([]byte, error) {
+	activityID, activityName := ocsfActivity(record.Method)
+	path, query := splitURL(record.URL)
+
+	event := ocsfEvent{
+		ActivityID:   activityID,
+		ActivityName: activityName,
+		CategoryUID:  ocsfCategoryUID,
+		CategoryName: "Application Activity",
+		ClassUID:     ocsfAPIActivityUID,
+		ClassName:    "API Activity",
+		TypeUID:      ocsfAPIActivityUID*100 + activityID,
+		SeverityID:   ocsfSeverityInfo,
+		Severity:     "Informational",
+		StatusID:     ocsfStatusSuccess,
+		Status:       "Success",
+		StatusCode:   strconv.Itoa(record.StatusCode),
+		StatusDetail: record.Reason,
+		Message:      record.Error,
+		Time:         record.CreatedAt.UnixMilli(),
+		Duration:     record.ProcessTime.Milliseconds(),
+		Metadata: ocsfMetadata{
+			Version:        ocsfVersion,
+			UID:            record.ID.String(),
+			CorrelationUID: record.RequestID.String(),
+			Product:        ocsfProduct{Name: productOrDefault(e.Product), VendorName: auditVendor},
+		},
+		Actor: ocsfActor{User: ocsfUser{
+			UID:  record.UserID,
+			Type: record.PrincipalKind,
+			Org:  ocsfOrg{UID: record.TenantID.String(), Name: record.TenantName},
+		}},
+		API: ocsfAPI{
+			Operation: strings.TrimSpace(record.Method + " " + routeOrPath(record)),
+			Request:   ocsfAPIRequest{UID: record.RequestID.String()},
+			Response:  ocsfAPIResponse{Code: record.StatusCode, Error: record.Error},
+		},
+		HTTPRequest: ocsfHTTPRequest{
+			HTTPMethod: record.Method,
+			URL:        ocsfURL{URLString: record.URL, Path: path, QueryStr: query},
+			UserAgent:  record.UserAgent,
+			Length:     record.RequestBytes,
+		},
+		HTTPResponse: ocsfHTTPResponse{Code: record.StatusCode, Length: record.ResponseBytes},
+	}
+	event.SrcEndpoint.IP, event.SrcEndpoint.UID = clientAddress(record)
+	for _, role := range record.Roles {
+		event.Actor.User.Groups = append(event.Actor.User.Groups, ocsfGroup{Name: role})
+	}
+	if failed(record) {
+		event.StatusID, event.Status = ocsfStatusFailure, "Failure"
+	}
+	if isSecurityEvent(record) {
+		event.SeverityID, event.Severity = ocsfSeverityMedium, "Medium"
+	}
+
+	unmapped := map[string]any{"event_type": record.EventType}
+	if len(record.MissingRoles) > 0 {
+		unmapped["missing_roles"] = record.MissingRoles
+	}
+	if len(record.MissingScopes) > 0 {
+		unmapped["missing_scopes"] = record.MissingScopes
+	}
+	event.Unmapped = unmapped
+
+	return json.Marshal(event)
+}
+
+func ocsfActivity(method string) (int, string) {
+	switch method {
+	case http.MethodPost:
+		return 1, "Create"
+	case http.MethodGet, http.MethodHead:
+		return 2, "Read"
+	case http.MethodPut, http.MethodPatch:
+		return 3, "Update"
+	case http.MethodDelete:
+		return 4, "Delete"
+	}
+
+	return 99, "Other"
+}
+
+// splitURL returns path and query of the request URI, or the URI as path if it cannot be parsed.
+func splitURL(raw string) (string, string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw, ""
+	}
+
+	return u.Path, u.RawQuery
+}
+
+// CEFEncoder encodes audit records as ArcSight Common Event Format (CEF) version 0 lines.
+type CEFEncoder struct {
+	Product string // Optional, name of the service, defaults to go-middleware
+	Version string // Optional, version of the service, defaults to the AuditRecord schema version
+}
+
+func (e CEFEncoder) Encode(record AuditRecord) ([]byte, error) {
+	version := e.Version
+	if version == "" {
+		version = strconv.Itoa(AuditRecordVersion)
+	}
+	eventType := record.EventType
+	if eventType == "" {
+		eventType = AuditEventRequest
+	}
+
+	severity := 3
+	switch {
+	case isSecurityEvent(record):
+		severity = 7
+	case failed(record):
+		severity = 5
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeader(auditVendor), cefHeader(productOrDefault(e.Product)), cefHeader(version),
+		cefHeader(eventType), cefHeader(strings.TrimSpace(record.Method+" "+routeOrPath(record))), severity)
+
+	outcome := "success"
+	if failed(record) {
+		outcome = "failure"
+	}
+	ip, pseudonym := clientAddress(record)
+	ext := [][2]string{
+		{"rt", strconv.FormatInt(record.CreatedAt.UnixMilli(), 10)},
+		{"externalId", record.ID.String()},
+		{"requestMethod", record.Method},
+		{"request", record.URL},
+		{"requestClientApplication", record.UserAgent},
+		{"src", ip},
+		{"suser", record.UserID},
+		{"outcome", outcome},
+		{"reason", record.Reason},
+		{"msg", record.Error},
+		{"in", strconv.FormatInt(record.RequestBytes, 10)},
+		{"out", strconv.FormatInt(record.ResponseBytes, 10)},
+		{"cn1", strconv.Itoa(record.StatusCode)},
+		{"cn1Label", "statusCode"},
+		{"cs1", record.TenantID.String()},
+		{"cs1Label", "tenantId"},
+		{"cs2", record.TenantName},
+		{"cs2Label", "tenantName"},
+		{"cs3", record.RequestID.String()},
+		{"cs3Label", "requestId"},
+	}
+	if pseudonym != "" {
+		ext = append(ext, [2]string{"cs4", pseudonym}, [2]string{"cs4Label", "clientIpPseudonym"})
+	}
+	sep := ""
+	for _, kv := range ext {
+		if kv[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s%s=%s", sep, kv[0], cefExtension(kv[1]))
+		sep = " "
+	}
+
+	return []byte(b.String()), nil
+}
+
+var (
+	cefHeaderReplacer    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionReplacer = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func cefHeader(v string) string {
+	return cefHeaderReplacer.Replace(v)
+}
+
+func cefExtension(v string) string {
+	return cefExtensionReplacer.Replace(v)
+}
+
+// ecsVersion is the Elastic Common Schema version of ECSEncoder output.
+const ecsVersion = "8.11.0"
+
+// ECSEncoder encodes audit records as Elastic Common Schema (ECS) JSON documents.
+type ECSEncoder struct {
+	Product string // Optional, name of the service, defaults to go-middleware
+}
+
+type ecsDocument struct {
+	Timestamp    string          `json:"@timestamp"`
+	Message      string          `json:"message,omitempty"`
+	ECS          ecsVersionField `json:"ecs"`
+	Event        ecsEvent        `json:"event"`
+	Service      ecsName         `json:"service"`
+	Organization ecsOrganization `json:"organization"`
+	User         ecsUser         `json:"user"`
+	Source       ecsSource       `json:"source"`
+	HTTP         ecsHTTP         `json:"http"`
+	URL          ecsURL          `json:"url"`
+	UserAgent    *ecsUserAgent   `json:"user_agent,omitempty"`
+	Error        *ecsError       `json:"error,omitempty"`
+	Labels       map[string]any  `json:"labels,omitempty"`
+}
+
+type ecsVersionField struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Action   string   `json:"action"`
+	Outcome  string   `json:"outcome"`
+	ID       string   `json:"id"`
+	Duration int64    `json:"duration"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+type ecsName struct {
+	Name string `json:"name"`
+}
+
+type ecsOrganization struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+type ecsUser struct {
+	ID    string   `json:"id,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+type ecsSource struct {
+	IP      string `json:"ip,omitempty"`
+	Address string `json:"address,omitempty"` // pseudonymized client IP
+}
+
+type ecsHTTP struct {
+	Request  ecsHTTPRequest  `json:"request"`
+	Response ecsHTTPResponse `json:"response"`
+}
+
+type ecsHTTPRequest struct {
+	ID     string       `json:"id"`
+	Method string       `json:"method"`
+	Body   ecsHTTPBytes `json:"body"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode int          `json:"status_code"`
+	Body       ecsHTTPBytes `json:"body"`
+}
+
+type ecsHTTPBytes struct {
+	Bytes int64 `json:"bytes"`
+}
+
+type ecsURL struct {
+	Original string `json:"original"`
+	Path     string `json:"path"`
+	Query    string `json:"query,omitempty"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsError struct {
+	Message string `json:"message"`
+}
+
+func (e ECSEncoder) Encode(record AuditRecord) ([]byte, error) {
+	path, query := splitURL(record.URL)
+	eventType := record.EventType
+	if eventType == "" {
+		eventType = AuditEventRequest
+	}
+
+	doc := ecsDocument{
+		Timestamp: record.CreatedAt.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Message:   strings.TrimSpace(record.Method + " " + routeOrPath(record)),
+		ECS:       ecsVersionField{Version: ecsVersion},
+		Event: ecsEvent{
+			Kind:     "event",
+			Category: []string{"web"},
+			Type:     []string{"access"},
+			Action:   eventType,
+			Outcome:  "success",
+			ID:       record.ID.String(),
+			Duration: record.ProcessTime.Nanoseconds(),
+			Reason:   record.Reason,
+		},
+		Service:      ecsName{Name: productOrDefault(e.Product)},
+		Organization: ecsOrganization{ID: record.TenantID.String(), Name: record.TenantName},
+		User:         ecsUser{ID: record.UserID, Roles: record.Roles},
+		HTTP: ecsHTTP{
+			Request: ecsHTTPRequest{
+				ID:     record.RequestID.String(),
+				Method: record.Method,
+				Body:   ecsHTTPBytes{Bytes: record.RequestBytes},
+			},
+			Response: ecsHTTPResponse{
+				StatusCode: record.StatusCode,
+				Body:       ecsHTTPBytes{Bytes: record.ResponseBytes},
+			},
+		},
+		URL: ecsURL{Original: record.URL, Path: path, Query: query},
+	}
+	doc.Source.IP, doc.Source.Address = clientAddress(record)
+	if failed(record) {
+		doc.Event.Outcome = "failure"
+	}
+	switch record.EventType {
+	case SecurityEventAuthenticationFailed, SecurityEventTokenRevoked, SecurityEventMalformedClaims:
+		doc.Event.Category, doc.Event.Type = []string{"authentication"}, []string{"denied"}
+	case SecurityEventPermissionDenied:
+		doc.Event.Category, doc.Event.Type = []string{"iam"}, []string{"denied"}
+	}
+	if record.UserAgent != "" {
+		doc.UserAgent = &ecsUserAgent{Original: record.UserAgent}
+	}
+	if record.Error != "" {
+		doc.Error = &ecsError{Message: record.Error}
+	}
+	if len(record.MissingRoles) > 0 || len(record.MissingScopes) > 0 {
+		doc.Labels = map[string]any{}
+		if len(record.MissingRoles) > 0 {
+			doc.Labels["missing_roles"] = strings.Join(record.MissingRoles, " ")
+		}
+		if len(record.MissingScopes) > 0 {
+			doc.Labels["missing_scopes"] = strings.Join(record.MissingScopes, " ")
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+func productOrDefault(product string) string {
+	if product == "" {
+		return defaultAuditProduct
+	}
+
+	return product
+}
+
+func routeOrPath(record AuditRecord) string {
+	if record.Route != "" {
+		return record.Route
+	}
+
+	path, _ := splitURL(record.URL)
+
+	return path
+}
+
+// clientAddress returns the client IP of the record, or its pseudonym if it was pseudonymized,
+// as SIEMs reject values which are not IPs in IP fields.
+func clientAddress(record AuditRecord) (ip string, pseudonym string) {
+	if _, err := netip.ParseAddr(record.ClientIP); err != nil {
+		return "", record.ClientIP
+	}
+
+	return record.ClientIP, ""
+}
+
+func failed(record AuditRecord) bool {
+	return record.StatusCode >= http.StatusBadRequest || isSecurityEvent(record)
+}
+
+func isSecurityEvent(record AuditRecord) bool {
+	return record.EventType != "" && record.EventType != AuditEventRequest
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestAuditEncoders(t *testing.T) {
+	request := AuditRecord{
+		Version:       AuditRecordVersion,
+		EventType:     AuditEventRequest,
+		ID:            requestID,
+		RequestID:     requestID,
+		TenantID:      tenantID,
+		TenantName:    "foo_tenant",
+		UserID:        userID,
+		PrincipalKind: "user",
+		Roles:         []string{"service.workflow.user"},
+		URL:           "/workflows/42?foo=bar",
+		Route:         "/workflows/:id",
+		Method:        "PUT",
+		ClientIP:      "1.1.1.1",
+		UserAgent:     "foo-agent/1.0 (a|b=c)",
+		StatusCode:    200,
+		RequestBytes:  14,
+		ResponseBytes: 13,
+		CreatedAt:     time.Date(2024, 6, 18, 12, 0, 0, 123000000, time.UTC),
+		ProcessTime:   42 * time.Millisecond,
+	}
+	denied := AuditRecord{
+		Version:      AuditRecordVersion,
+		EventType:    SecurityEventPermissionDenied,
+		ID:           uuid.MustParse("6c9cbb47-0a25-4cd0-b1a4-3e0ba0d31f1d"),
+		RequestID:    requestID,
+		TenantID:     tenantID,
+		UserID:       userID,
+		URL:          "/workflows",
+		Method:       "DELETE",
+		ClientIP:     "2001:db8::1",
+		StatusCode:   403,
+		Reason:       "user has not enough entitlements",
+		MissingRoles: []string{"service.workflow.admin"},
+		CreatedAt:    time.Date(2024, 6, 18, 12, 0, 1, 0, time.UTC),
+		ProcessTime:  time.Millisecond,
+	}
+	pseudonymized := request
+	pseudonymized.UserID = "4f1c6d1e0a6e4ab7d7e8f1f0b7a1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9"
+	pseudonymized.ClientIP = "9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a"
+
+	tests := []struct {
+		name    string
+		encoder AuditEncoder
+		record  AuditRecord
+		golden  string
+	}{
+		{name: "ShouldEncodeJSON", encoder: JSONEncoder{}, record: request, golden: "json_request.golden"},
+		{name: "ShouldEncodeOCSFRequest", encoder: OCSFEncoder{}, record: request, golden: "ocsf_request.golden"},
+		{name: "ShouldEncodeOCSFSecurityEvent", encoder: OCSFEncoder{Product: "workflows"}, record: denied, golden: "ocsf_denied.golden"},
+		{name: "ShouldEncodeCEFRequest", encoder: CEFEncoder{}, record: request, golden: "cef_request.golden"},
+		{name: "ShouldEncodeCEFSecurityEvent", encoder: CEFEncoder{Product: "workflows", Version: "1.2.0"}, record: denied, golden: "cef_denied.golden"},
+		{name: "ShouldEncodeECSRequest", encoder: ECSEncoder{}, record: request, golden: "ecs_request.golden"},
+		{name: "ShouldEncodeECSSecurityEvent", encoder: ECSEncoder{Product: "workflows"}, record: denied, golden: "ecs_denied.golden"},
+		{name: "ShouldEncodeOCSFPseudonymized", encoder: OCSFEncoder{}, record: pseudonymized, golden: "ocsf_pseudonymized.golden"},
+		{name: "ShouldEncodeCEFPseudonymized", encoder: CEFEncoder{}, record: pseudonymized, golden: "cef_pseudonymized.golden"},
+		{name: "ShouldEncodeECSPseudonymized", encoder: ECSEncoder{}, record: pseudonymized, golden: "ecs_pseudonymized.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.encoder.Encode(tt.record)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.False(t, bytes.HasSuffix(got, []byte("\n")))
+
+			path := filepath.Join("testdata", "auditencoder", tt.golden)
+			if *update {
+				assert.NoError(t, os.WriteFile(path, append(got, '\n'), 0o644))
+			}
+			want, err := os.ReadFile(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, string(bytes.TrimSuffix(want, []byte("\n"))), string(got))
+		})
+	}
+}
+
+func TestJSONLinesSink_WithEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLinesSink(&buf).WithEncoder(CEFEncoder{})
+
+	assert.NoError(t, sink.Write(context.Background(), auditRecord))
+
+	want, err := CEFEncoder{}.Encode(auditRecord)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, string(want)+"\n", buf.String())
+}
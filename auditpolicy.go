@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// AuditMode defines which requests matching an AuditPolicy are audited.
+type AuditMode int
+
+const (
+	// AuditAlways audits every request.
+	AuditAlways AuditMode = iota
+	// AuditNever audits no request.
+	AuditNever
+	// AuditSample audits AuditPolicy.SamplePercent of requests.
+	AuditSample
+	// AuditErrorsOnly audits requests answered with a 4xx or 5xx status.
+	AuditErrorsOnly
+)
+
+// AuditPolicy defines how requests of a route are audited by Dispatch.
+type AuditPolicy struct {
+	Method        string    // Optional, matches every method when empty
+	Route         string    // Optional, echo route pattern, e.g. /workflows/:id, matches every route when empty
+	Mode          AuditMode // Optional, defaults to AuditAlways
+	SamplePercent float64   // Share of audited requests for AuditSample, between 0 and 100
+}
+
+func (p AuditPolicy) matches(method, route string) bool {
+	return (p.Method == "" || strings.EqualFold(p.Method, method)) && (p.Route == "" || p.Route == route)
+}
+
+func (p AuditPolicy) validate() error {
+	switch p.Mode {
+	case AuditAlways, AuditNever, AuditErrorsOnly:
+		return nil
+	case AuditSample:
+		if p.SamplePercent < 0 || p.SamplePercent > 100 {
+			return fmt.Errorf("dispatch middleware - sample percent of %s %s must be between 0 and 100", p.Method, p.Route)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("dispatch middleware - unknown audit mode %d", p.Mode)
+}
+
+// auditDecision is what the policy of a request decided before the handler ran.
+type auditDecision int
+
+const (
+	skipAudit auditDecision = iota
+	recordAudit
+	recordAuditOnError
+)
+
+// auditPolicies picks the policy of a request, tenant policies first.
+type auditPolicies struct {
+	policies []AuditPolicy
+	tenants  map[uuid.UUID][]AuditPolicy
+}
+
+func newAuditPolicies(policies []AuditPolicy, tenants map[uuid.UUID][]AuditPolicy) (auditPolicies, error) {
+	for _, p := range policies {
+		if err := p.validate(); err != nil {
+			return auditPolicies{}, err
+		}
+	}
+	for _, tp := range tenants {
+		for _, p := range tp {
+			if err := p.validate(); err != nil {
+				return auditPolicies{}, err
+			}
+		}
+	}
+
+	return auditPolicies{policies: policies, tenants: tenants}, nil
+}
+
+// policy returns the first policy matching the request, or AuditAlways if none matches.
+func (a auditPolicies) policy(cc *Context) AuditPolicy {
+	method, route := cc.Request().Method, cc.Path()
+	for _, p := range a.tenants[cc.TenantID] {
+		if p.matches(method, route) {
+			return p
+		}
+	}
+	for _, p := range a.policies {
+		if p.matches(method, route) {
+			return p
+		}
+	}
+
+	return AuditPolicy{Mode: AuditAlways}
+}
+
+func (a auditPolicies) decide(cc *Context) auditDecision {
+	p := a.policy(cc)
+	switch p.Mode {
+	case AuditNever:
+		return skipAudit
+	case AuditSample:
+		if !sampled(cc.RequestID, p.SamplePercent) {
+			return skipAudit
+		}
+	case AuditErrorsOnly:
+		return recordAuditOnError
+	}
+
+	return recordAudit
+}
+
+// record reports whether a request with the status is audited after the decision.
+func (d auditDecision) record(status int) bool {
+	return d == recordAudit || d == recordAuditOnError && status >= http.StatusBadRequest
+}
+
+// sampled reports whether the request falls within percent of requests. The decision is derived
+// from the request ID, so services sharing the request ID sample the same requests.
+func sampled(requestID uuid.UUID, percent float64) bool {
+	n := rand.Uint64()
+	if requestID != uuid.Nil {
+		n = binary.BigEndian.Uint64(requestID[8:])
+	}
+
+	return float64(n%10000) < percent*100
+}
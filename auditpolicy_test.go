@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchConfig_policies(t *testing.T) {
+	otherTenant := uuid.New()
+	policies := []AuditPolicy{
+		{Route: "/health", Mode: AuditNever},
+		{Method: http.MethodGet, Route: "/workflows/:id", Mode: AuditErrorsOnly},
+		{Method: http.MethodGet, Route: "/workflows", Mode: AuditSample, SamplePercent: 0},
+		{Route: "/workflows", Mode: AuditAlways},
+	}
+
+	tests := []struct {
+		name        string
+		cfg         DispatchConfig
+		tenantID    uuid.UUID
+		method      string
+		route       string
+		status      int
+		wantAudited bool
+	}{
+		{
+			name:        "ShouldAuditRouteWithoutPolicy",
+			cfg:         DispatchConfig{Policies: policies},
+			method:      http.MethodGet,
+			route:       "/foo",
+			status:      http.StatusOK,
+			wantAudited: true,
+		},
+		{
+			name:   "ShouldNotAuditNever",
+			cfg:    DispatchConfig{Policies: policies},
+			method: http.MethodGet,
+			route:  "/health",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "ShouldNotAuditSuccessWithErrorsOnly",
+			cfg:    DispatchConfig{Policies: policies},
+			method: http.MethodGet,
+			route:  "/workflows/:id",
+			status: http.StatusOK,
+		},
+		{
+			name:        "ShouldAuditErrorWithErrorsOnly",
+			cfg:         DispatchConfig{Policies: policies},
+			method:      http.MethodGet,
+			route:       "/workflows/:id",
+			status:      http.StatusNotFound,
+			wantAudited: true,
+		},
+		{
+			name:        "ShouldMatchMethod",
+			cfg:         DispatchConfig{Policies: policies},
+			method:      http.MethodDelete,
+			route:       "/workflows/:id",
+			status:      http.StatusOK,
+			wantAudited: true,
+		},
+		{
+			name:   "ShouldApplyFirstMatchingPolicy",
+			cfg:    DispatchConfig{Policies: policies},
+			method: http.MethodGet,
+			route:  "/workflows",
+			status: http.StatusOK,
+		},
+		{
+			name:        "ShouldAuditSampled",
+			cfg:         DispatchConfig{Policies: []AuditPolicy{{Mode: AuditSample, SamplePercent: 100}}},
+			method:      http.MethodGet,
+			route:       "/workflows",
+			status:      http.StatusOK,
+			wantAudited: true,
+		},
+		{
+			name: "ShouldApplyTenantPolicy",
+			cfg: DispatchConfig{
+				Policies:       policies,
+				TenantPolicies: map[uuid.UUID][]AuditPolicy{tenantID: {{Route: "/workflows/:id", Mode: AuditAlways}}},
+			},
+			method:      http.MethodGet,
+			route:       "/workflows/:id",
+			status:      http.StatusOK,
+			wantAudited: true,
+		},
+		{
+			name: "ShouldNotApplyPolicyOfOtherTenant",
+			cfg: DispatchConfig{
+				Policies:       policies,
+				TenantPolicies: map[uuid.UUID][]AuditPolicy{otherTenant: {{Route: "/workflows/:id", Mode: AuditAlways}}},
+			},
+			method: http.MethodGet,
+			route:  "/workflows/:id",
+			status: http.StatusOK,
+		},
+		{
+			name: "ShouldSkip",
+			cfg: DispatchConfig{Skipper: func(c echo.Context) bool {
+				return c.Path() == "/foo"
+			}},
+			method: http.MethodGet,
+			route:  "/foo",
+			status: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.cfg.Sink = NewJSONLinesSink(&buf)
+
+			h, err := tt.cfg.toMiddleware()
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			e := echo.New()
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.RemoteAddr = "1.1.1.1:1234"
+			rec := httptest.NewRecorder()
+
+			c := e.NewContext(req, rec)
+			c.SetPath(tt.route)
+			cc := &Context{
+				Context:   c,
+				RequestID: requestID,
+				TenantID:  tenantID,
+				Sub:       userID,
+			}
+			err = h(func(c echo.Context) error {
+				return c.NoContent(tt.status)
+			})(cc)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAudited, strings.Count(buf.String(), "\n") == 1)
+			assert.NotEmpty(t, rec.Header().Get("X-Process-Time"))
+		})
+	}
+}
+
+func TestNewAuditPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		policies   []AuditPolicy
+		tenants    map[uuid.UUID][]AuditPolicy
+		wantErrMsg string
+	}{
+		{
+			name:     "ShouldAcceptPolicies",
+			policies: []AuditPolicy{{Route: "/foo", Mode: AuditSample, SamplePercent: 12.5}, {Mode: AuditErrorsOnly}},
+		},
+		{
+			name:       "ShouldRejectSamplePercent",
+			policies:   []AuditPolicy{{Method: http.MethodGet, Route: "/foo", Mode: AuditSample, SamplePercent: 120}},
+			wantErrMsg: "dispatch middleware - sample percent of GET /foo must be between 0 and 100",
+		},
+		{
+			name:       "ShouldRejectUnknownModeOfTenant",
+			tenants:    map[uuid.UUID][]AuditPolicy{tenantID: {{Mode: 42}}},
+			wantErrMsg: "dispatch middleware - unknown audit mode 42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuditPolicies(tt.policies, tt.tenants)
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSampled(t *testing.T) {
+	sampledRequests := 0
+	for i := 0; i < 1000; i++ {
+		id := uuid.New()
+		assert.False(t, sampled(id, 0))
+		assert.True(t, sampled(id, 100))
+		assert.Equal(t, sampled(id, 30), sampled(id, 30))
+		if sampled(id, 30) {
+			sampledRequests++
+		}
+	}
+
+	assert.InDelta(t, 300, sampledRequests, 100)
+}
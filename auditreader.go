@@ -0,0 +1,289 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Default index names of the audit table, see AuditReader.
+const (
+	DefaultAuditTenantIndex  = "tenant_id-created_at-index"
+	DefaultAuditUserIndex    = "user_id-created_at-index"
+	DefaultAuditRequestIndex = "request_id-index"
+)
+
+// defaultAuditQueryLimit is the page size used when AuditQuery.Limit is not set.
+const defaultAuditQueryLimit = 100
+
+// DynamoDBQueryAPI is the part of the DynamoDB client used by AuditReader.
+type DynamoDBQueryAPI interface {
+	Query(ctx context.Context, params *awsdynamodb.QueryInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.QueryOutput, error)
+}
+
+// AuditReaderConfig defines the config for NewAuditReader.
+type AuditReaderConfig struct {
+	Table        string
+	TenantIndex  string // Optional, defaults to DefaultAuditTenantIndex
+	UserIndex    string // Optional, defaults to DefaultAuditUserIndex
+	RequestIndex string // Optional, defaults to DefaultAuditRequestIndex
+}
+
+// AuditReader reads audit records written by DynamoDBSink or DynamoDBBatchSink back from the table.
+//
+// The sinks have to write IDs as strings, see WithStringIDs. The audit table is expected to be laid out as follows:
+//
+//	table                       partition key  sort key    projection
+//	audit table                 id (S)         -           -
+//	tenant_id-created_at-index  tenant_id (S)  created_at  ALL
+//	user_id-created_at-index    user_id (S)    created_at  ALL
+//	request_id-index            request_id (S) -           ALL
+//
+// TTL has to be enabled on the `ttl` attribute, which is set from DispatchConfig.Retention.
+// created_at is written in UTC with nanoseconds padded to a fixed width, so it sorts chronologically.
+// Records written before, with trailing zeros of the fraction dropped, may be misordered within
+// a second and around the bounds of a time range. Records of version 1 lack
+// the request_id attribute and are found by request ID only through the tenant or user index.
+type AuditReader struct {
+	client DynamoDBQueryAPI
+	cfg    AuditReaderConfig
+}
+
+// NewAuditReader returns a reader querying the audit table.
+func NewAuditReader(client DynamoDBQueryAPI, cfg AuditReaderConfig) (*AuditReader, error) {
+	if cfg.Table == "" {
+		return nil, fmt.Errorf("audit reader - table is empty")
+	}
+	if cfg.TenantIndex == "" {
+		cfg.TenantIndex = DefaultAuditTenantIndex
+	}
+	if cfg.UserIndex == "" {
+		cfg.UserIndex = DefaultAuditUserIndex
+	}
+	if cfg.RequestIndex == "" {
+		cfg.RequestIndex = DefaultAuditRequestIndex
+	}
+
+	return &AuditReader{client: client, cfg: cfg}, nil
+}
+
+// AuditQuery selects audit records. Records are looked up by request ID if set, by user if set
+// and by tenant otherwise. TenantID, when set, also restricts results of user and request ID lookups.
+type AuditQuery struct {
+	TenantID  uuid.UUID
+	UserID    string    // Optional
+	RequestID uuid.UUID // Optional
+	From      time.Time // Optional, inclusive
+	To        time.Time // Optional, inclusive
+	MinStatus int       // Optional, inclusive
+	MaxStatus int       // Optional, inclusive
+	Limit     int32     // Optional, defaults to 100
+	Cursor    string    // Optional, AuditPage.Cursor of the previous page
+}
+
+// AuditPage is a page of audit records, newest first. Cursor is empty on the last page.
+// A page may hold less than Limit records, even none, while Cursor is not empty.
+type AuditPage struct {
+	Records []AuditRecord
+	Cursor  string
+}
+
+// Query returns a page of audit records matching q.
+func (r *AuditReader) Query(ctx context.Context, q AuditQuery) (*AuditPage, error) {
+	input, err := r.input(q)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := r.client.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []dynamoDBAuditRecord
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &items); err != nil {
+		return nil, fmt.Errorf("audit reader - %w", err)
+	}
+	page := &AuditPage{Records: make([]AuditRecord, 0, len(items))}
+	for _, item := range items {
+		record, err := item.record()
+		if err != nil {
+			return nil, fmt.Errorf("audit reader - %w", err)
+		}
+		page.Records = append(page.Records, record)
+	}
+	if page.Cursor, err = encodeCursor(out.LastEvaluatedKey); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (r *AuditReader) input(q AuditQuery) (*awsdynamodb.QueryInput, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditQueryLimit
+	}
+
+	startKey, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &awsdynamodb.QueryInput{
+		TableName:                 aws.String(r.cfg.Table),
+		Limit:                     aws.Int32(q.Limit),
+		ScanIndexForward:          aws.Bool(false),
+		ExclusiveStartKey:         startKey,
+		ExpressionAttributeNames:  map[string]string{},
+		ExpressionAttributeValues: map[string]types.AttributeValue{},
+	}
+
+	var (
+		keyCondition string
+		filters      []string
+	)
+	switch {
+	case q.RequestID != uuid.Nil:
+		input.IndexName = aws.String(r.cfg.RequestIndex)
+		keyCondition = condition(input, "request_id", "=", q.RequestID.String())
+		if !q.From.IsZero() {
+			filters = append(filters, condition(input, "created_at", ">=", formatAuditTime(q.From)))
+		}
+		if !q.To.IsZero() {
+			filters = append(filters, condition(input, "created_at", "<=", formatAuditTime(q.To)))
+		}
+		if q.TenantID != uuid.Nil {
+			filters = append(filters, condition(input, "tenant_id", "=", q.TenantID.String()))
+		}
+	case q.UserID != "":
+		input.IndexName = aws.String(r.cfg.UserIndex)
+		keyCondition = condition(input, "user_id", "=", q.UserID) + timeRange(input, q.From, q.To)
+		if q.TenantID != uuid.Nil {
+			filters = append(filters, condition(input, "tenant_id", "=", q.TenantID.String()))
+		}
+	case q.TenantID != uuid.Nil:
+		input.IndexName = aws.String(r.cfg.TenantIndex)
+		keyCondition = condition(input, "tenant_id", "=", q.TenantID.String()) + timeRange(input, q.From, q.To)
+	default:
+		return nil, fmt.Errorf("audit reader - tenant, user or request id is required")
+	}
+
+	if q.MinStatus > 0 {
+		filters = append(filters, fmt.Sprintf("%s >= %s", attributeName(input, "status_code"), numberValue(input, q.MinStatus)))
+	}
+	if q.MaxStatus > 0 {
+		filters = append(filters, fmt.Sprintf("%s <= %s", attributeName(input, "status_code"), numberValue(input, q.MaxStatus)))
+	}
+
+	input.KeyConditionExpression = aws.String(keyCondition)
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+
+	return input, nil
+}
+
+// condition adds the attribute name and value placeholders to input and returns the comparison.
+func condition(input *awsdynamodb.QueryInput, attr, op, value string) string {
+	return fmt.Sprintf("%s %s %s", attributeName(input, attr), op, attributeValue(input, value))
+}
+
+func attributeName(input *awsdynamodb.QueryInput, attr string) string {
+	name := "#" + attr
+	input.ExpressionAttributeNames[name] = attr
+
+	return name
+}
+
+func attributeValue(input *awsdynamodb.QueryInput, value string) string {
+	placeholder := fmt.Sprintf(":v%d", len(input.ExpressionAttributeValues))
+	input.ExpressionAttributeValues[placeholder] = &types.AttributeValueMemberS{Value: value}
+
+	return placeholder
+}
+
+func numberValue(input *awsdynamodb.QueryInput, value int) string {
+	placeholder := fmt.Sprintf(":v%d", len(input.ExpressionAttributeValues))
+	input.ExpressionAttributeValues[placeholder] = &types.AttributeValueMemberN{Value: strconv.Itoa(value)}
+
+	return placeholder
+}
+
+// timeRange returns the sort key condition on created_at, prefixed with AND, or nothing without bounds.
+func timeRange(input *awsdynamodb.QueryInput, from, to time.Time) string {
+	switch {
+	case !from.IsZero() && !to.IsZero():
+		return fmt.Sprintf(" AND %s BETWEEN %s AND %s", attributeName(input, "created_at"),
+			attributeValue(input, formatAuditTime(from)), attributeValue(input, formatAuditTime(to)))
+	case !from.IsZero():
+		return " AND " + condition(input, "created_at", ">=", formatAuditTime(from))
+	case !to.IsZero():
+		return " AND " + condition(input, "created_at", "<=", formatAuditTime(to))
+	}
+
+	return ""
+}
+
+// auditTimeLayout is the layout of created_at. Unlike time.RFC3339Nano it keeps trailing zeros,
+// so stored values sort chronologically as strings.
+const auditTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// formatAuditTime formats t the way created_at is stored.
+func formatAuditTime(t time.Time) string {
+	return t.UTC().Format(auditTimeLayout)
+}
+
+// encodeCursor encodes the last evaluated key as an opaque continuation token.
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	values := make(map[string]string, len(key))
+	for k, v := range key {
+		s, ok := v.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", fmt.Errorf("audit reader - unsupported key attribute %s", k)
+		}
+		values[k] = s.Value
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("audit reader - invalid cursor")
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("audit reader - invalid cursor")
+	}
+
+	key := make(map[string]types.AttributeValue, len(values))
+	for k, v := range values {
+		key[k] = &types.AttributeValueMemberS{Value: v}
+	}
+
+	return key, nil
+}
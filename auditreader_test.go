@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type dynamoQueryFunc func(ctx context.Context, params *awsdynamodb.QueryInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.QueryOutput, error)
+
+func (f dynamoQueryFunc) Query(ctx context.Context, params *awsdynamodb.QueryInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.QueryOutput, error) {
+	return f(ctx, params, optFns...)
+}
+
+func TestNewAuditReader(t *testing.T) {
+	_, err := NewAuditReader(nil, AuditReaderConfig{})
+	assert.EqualError(t, err, "audit reader - table is empty")
+}
+
+func TestAuditReader_Query(t *testing.T) {
+	from := time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 6, 19, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	tests := []struct {
+		name             string
+		query            AuditQuery
+		wantIndex        string
+		wantKeyCondition string
+		wantFilter       string
+		wantValues       map[string]string
+		wantErrMsg       string
+	}{
+		{
+			name:             "ShouldQueryTenantByTimeRange",
+			query:            AuditQuery{TenantID: tenantID, From: from, To: to},
+			wantIndex:        DefaultAuditTenantIndex,
+			wantKeyCondition: "#tenant_id = :v0 AND #created_at BETWEEN :v1 AND :v2",
+			wantValues: map[string]string{
+				":v0": tenantID.String(),
+				":v1": "2024-06-18T12:00:00.000000000Z",
+				":v2": "2024-06-19T12:00:00.000000000Z",
+			},
+		},
+		{
+			name:             "ShouldQueryUserWithinTenant",
+			query:            AuditQuery{TenantID: tenantID, UserID: userID, From: from},
+			wantIndex:        DefaultAuditUserIndex,
+			wantKeyCondition: "#user_id = :v0 AND #created_at >= :v1",
+			wantFilter:       "#tenant_id = :v2",
+			wantValues: map[string]string{
+				":v0": userID,
+				":v1": "2024-06-18T12:00:00.000000000Z",
+				":v2": tenantID.String(),
+			},
+		},
+		{
+			name:             "ShouldQueryRequest",
+			query:            AuditQuery{TenantID: tenantID, UserID: userID, RequestID: requestID, To: to},
+			wantIndex:        DefaultAuditRequestIndex,
+			wantKeyCondition: "#request_id = :v0",
+			wantFilter:       "#created_at <= :v1 AND #tenant_id = :v2",
+			wantValues: map[string]string{
+				":v0": requestID.String(),
+				":v1": "2024-06-19T12:00:00.000000000Z",
+				":v2": tenantID.String(),
+			},
+		},
+		{
+			name:             "ShouldFilterStatus",
+			query:            AuditQuery{TenantID: tenantID, MinStatus: 400, MaxStatus: 499},
+			wantIndex:        DefaultAuditTenantIndex,
+			wantKeyCondition: "#tenant_id = :v0",
+			wantFilter:       "#status_code >= :v1 AND #status_code <= :v2",
+			wantValues: map[string]string{
+				":v0": tenantID.String(),
+				":v1": "400",
+				":v2": "499",
+			},
+		},
+		{
+			name:       "ShouldFailWithoutKey",
+			query:      AuditQuery{UserID: ""},
+			wantErrMsg: "audit reader - tenant, user or request id is required",
+		},
+		{
+			name:       "ShouldFailOnInvalidCursor",
+			query:      AuditQuery{TenantID: tenantID, Cursor: "foo!"},
+			wantErrMsg: "audit reader - invalid cursor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *awsdynamodb.QueryInput
+			client := dynamoQueryFunc(func(ctx context.Context, params *awsdynamodb.QueryInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.QueryOutput, error) {
+				got = params
+				return &awsdynamodb.QueryOutput{}, nil
+			})
+
+			r, err := NewAuditReader(client, AuditReaderConfig{Table: "foo_table"})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			page, err := r.Query(context.Background(), tt.query)
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Empty(t, page.Records)
+			assert.Empty(t, page.Cursor)
+
+			assert.Equal(t, "foo_table", aws.ToString(got.TableName))
+			assert.Equal(t, tt.wantIndex, aws.ToString(got.IndexName))
+			assert.Equal(t, tt.wantKeyCondition, aws.ToString(got.KeyConditionExpression))
+			assert.Equal(t, tt.wantFilter, aws.ToString(got.FilterExpression))
+			assert.Equal(t, int32(100), aws.ToInt32(got.Limit))
+			assert.False(t, aws.ToBool(got.ScanIndexForward))
+
+			values := make(map[string]string)
+			for k, v := range got.ExpressionAttributeValues {
+				switch v := v.(type) {
+				case *dynamotypes.AttributeValueMemberS:
+					values[k] = v.Value
+				case *dynamotypes.AttributeValueMemberN:
+					values[k] = v.Value
+				}
+			}
+			assert.Equal(t, tt.wantValues, values)
+		})
+	}
+}
+
+// sinkItem returns the DynamoDB item DynamoDBBatchSink writes for the record with string IDs.
+func sinkItem(t *testing.T, record AuditRecord) map[string]dynamotypes.AttributeValue {
+	t.Helper()
+
+	var item map[string]dynamotypes.AttributeValue
+	client := dynamoBatchWriteFunc(func(_ context.Context, params *awsdynamodb.BatchWriteItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.BatchWriteItemOutput, error) {
+		item = params.RequestItems["foo_table"][0].PutRequest.Item
+		return &awsdynamodb.BatchWriteItemOutput{}, nil
+	})
+	if err := NewDynamoDBBatchSink(client, "foo_table").WithStringIDs().Write(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+
+	return item
+}
+
+func TestAuditReader_Query_roundTrip(t *testing.T) {
+	record := auditRecord
+	record.RequestID = uuid.MustParse("6d1c9a3e-2f4b-4e8a-b1c7-0a9e8d7c6b52")
+	legacy, err := attributevalue.MarshalMap(auditRecord)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var got *awsdynamodb.QueryInput
+	client := dynamoQueryFunc(func(_ context.Context, params *awsdynamodb.QueryInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.QueryOutput, error) {
+		got = params
+		return &awsdynamodb.QueryOutput{Items: []map[string]dynamotypes.AttributeValue{sinkItem(t, record), sinkItem(t, auditRecord), legacy}}, nil
+	})
+	r, err := NewAuditReader(client, AuditReaderConfig{Table: "foo_table"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	page, err := r.Query(context.Background(), AuditQuery{TenantID: tenantID, RequestID: record.RequestID})
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditRecord{record, auditRecord, auditRecord}, page.Records)
+
+	// keys of the query match the attributes written by the sink
+	item := sinkItem(t, record)
+	assert.Equal(t, item["request_id"], got.ExpressionAttributeValues[":v0"])
+	assert.Equal(t, item["tenant_id"], got.ExpressionAttributeValues[":v1"])
+}
+
+func TestFormatAuditTime(t *testing.T) {
+	second := time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		second,
+		second.Add(time.Nanosecond),
+		second.Add(500 * time.Millisecond),
+		second.Add(time.Second),
+	}
+
+	for i := 1; i < len(times); i++ {
+		assert.Less(t, formatAuditTime(times[i-1]), formatAuditTime(times[i]))
+	}
+	assert.Equal(t, "2024-06-18T12:00:00.500000000Z", formatAuditTime(times[2].In(time.FixedZone("CEST", 2*60*60))))
+}
+
+func TestAuditReader_Query_pagination(t *testing.T) {
+	item := sinkItem(t, auditRecord)
+	lastKey := map[string]dynamotypes.AttributeValue{
+		"id":         item["id"],
+		"tenant_id":  item["tenant_id"],
+		"created_at": item["created_at"],
+	}
+
+	var calls []*awsdynamodb.QueryInput
+	client := dynamoQueryFunc(func(ctx context.Context, params *awsdynamodb.QueryInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.QueryOutput, error) {
+		calls = append(calls, params)
+		switch len(calls) {
+		case 1:
+			return &awsdynamodb.QueryOutput{Items: []map[string]dynamotypes.AttributeValue{item}, LastEvaluatedKey: lastKey}, nil
+		case 2:
+			return &awsdynamodb.QueryOutput{Items: []map[string]dynamotypes.AttributeValue{item}}, nil
+		}
+		return nil, fmt.Errorf("foo_error")
+	})
+
+	r, err := NewAuditReader(client, AuditReaderConfig{Table: "foo_table"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	page, err := r.Query(context.Background(), AuditQuery{TenantID: tenantID, Limit: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []AuditRecord{auditRecord}, page.Records)
+	assert.NotEmpty(t, page.Cursor)
+	assert.Nil(t, calls[0].ExclusiveStartKey)
+	assert.Equal(t, int32(1), aws.ToInt32(calls[0].Limit))
+
+	page, err = r.Query(context.Background(), AuditQuery{TenantID: tenantID, Limit: 1, Cursor: page.Cursor})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []AuditRecord{auditRecord}, page.Records)
+	assert.Empty(t, page.Cursor)
+	assert.Equal(t, lastKey, calls[1].ExclusiveStartKey)
+
+	_, err = r.Query(context.Background(), AuditQuery{TenantID: tenantID})
+	assert.EqualError(t, err, "foo_error")
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditRecordVersion is the schema version of AuditRecord written by this package.
+// Version 1 records, written before the field was introduced, have no version attribute.
+const AuditRecordVersion = 2
+
+// AuditRecord is a single audit entry created by Dispatch.
+type AuditRecord struct {
+	Version       int           `json:"version" dynamodbav:"version"`
+	EventType     string        `json:"event_type" dynamodbav:"event_type"` // AuditEventRequest or one of security event types
+	ID            uuid.UUID     `json:"id" dynamodbav:"id"`
+	RequestID     uuid.UUID     `json:"request_id" dynamodbav:"request_id"`
+	TenantID      uuid.UUID     `json:"tenant_id" dynamodbav:"tenant_id"`
+	TenantName    string        `json:"tenant_name,omitempty" dynamodbav:"tenant_name,omitempty"`
+	UserID        string        `json:"user_id" dynamodbav:"user_id"`
+	PrincipalKind string        `json:"principal_kind,omitempty" dynamodbav:"principal_kind,omitempty"` // `cls` claim of the token
+	Roles         []string      `json:"roles,omitempty" dynamodbav:"roles,omitempty"`
+	URL           string        `json:"url" dynamodbav:"url"`
+	Route         string        `json:"route,omitempty" dynamodbav:"route,omitempty"` // echo route pattern, e.g. /workflows/:id
+	Method        string        `json:"method" dynamodbav:"method"`
+	ClientIP      string        `json:"client_ip" dynamodbav:"client_id"` // stored as client_id to stay compatible with version 1 records
+	UserAgent     string        `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	StatusCode    int           `json:"status_code" dynamodbav:"status_code"`
+	RequestBytes  int64         `json:"request_bytes" dynamodbav:"request_bytes"`
+	ResponseBytes int64         `json:"response_bytes" dynamodbav:"response_bytes"`
+	Error         string        `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	Reason        string        `json:"reason,omitempty" dynamodbav:"reason,omitempty"` // why a security event happened
+	MissingRoles  []string      `json:"missing_roles,omitempty" dynamodbav:"missing_roles,omitempty"`
+	MissingScopes []string      `json:"missing_scopes,omitempty" dynamodbav:"missing_scopes,omitempty"`
+	Body          *CapturedBody `json:"body,omitempty" dynamodbav:"body,omitempty"`
+	BodyRef       string        `json:"body_ref,omitempty" dynamodbav:"body_ref,omitempty"` // reference to a body kept in BodyStore
+	CreatedAt     time.Time     `json:"created_at" dynamodbav:"created_at"`
+	ProcessTime   time.Duration `json:"process_time" dynamodbav:"process_time"`
+	TTL           int64         `json:"ttl,omitempty" dynamodbav:"ttl,omitempty"`     // unix time in seconds when DynamoDB may remove the record
+	Chain         string        `json:"chain,omitempty" dynamodbav:"chain,omitempty"` // set by HashChainSink
+	Seq           uint64        `json:"seq,omitempty" dynamodbav:"seq,omitempty"`
+	PrevHash      string        `json:"prev_hash,omitempty" dynamodbav:"prev_hash,omitempty"`
+	Hash          string        `json:"hash,omitempty" dynamodbav:"hash,omitempty"`
+}
+
+// expiresAt returns the TTL of a record created at createdAt, or zero without retention.
+func expiresAt(createdAt time.Time, retention time.Duration) int64 {
+	if retention <= 0 {
+		return 0
+	}
+
+	return createdAt.Add(retention).Unix()
+}
+
+// countingReadCloser counts bytes read from the request body by the handler,
+// optionally copying them to capture.
+type countingReadCloser struct {
+	io.ReadCloser
+	n       int64
+	capture io.Writer
+}
+
+func newCountingReadCloser(body io.ReadCloser) *countingReadCloser {
+	if body == nil {
+		body = http.NoBody
+	}
+
+	return &countingReadCloser{ReadCloser: body}
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	if c.capture != nil {
+		c.capture.Write(p[:n])
+	}
+
+	return n, err
+}
@@ -0,0 +1,359 @@
+package middleware
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// AuditQuerier queries audit records, it is implemented by AuditReader.
+type AuditQuerier interface {
+	Query(ctx context.Context, q AuditQuery) (*AuditPage, error)
+}
+
+// AuditRoutesConfig defines the config for RegisterAuditRoutes.
+type AuditRoutesConfig struct {
+	AdminRole  string // Role of the token required to read audit events
+	MaxLimit   int32  // Optional, maximum page size, defaults to 1000
+	MaxExport  int    // Optional, maximum number of exported records, defaults to 10000
+	ExportName string // Optional, file name of exports without extension, defaults to audit-events
+	// Pseudonymizer pseudonymizes the user filter, for records written through a PseudonymizingSink. Optional.
+	Pseudonymizer *Pseudonymizer
+}
+
+// AuditEventsResponse is the response body of the audit events endpoint.
+type AuditEventsResponse struct {
+	Records []AuditRecord `json:"records"`
+	Cursor  string        `json:"cursor,omitempty"`
+}
+
+// RegisterAuditRoutes registers tenant facing audit log endpoints on g. The group has to use
+// NewCustomContextMiddleware, results are always restricted to Context.TenantID.
+//
+//	GET /events         a page of audit records as AuditEventsResponse
+//	GET /events/export  all matching records as CSV or NDJSON, selected by the format query param
+//
+// Both accept user, request_id, status (e.g. 404 or 4xx), from and to (RFC 3339) filters,
+// and the events endpoint limit and cursor params for pagination.
+func RegisterAuditRoutes(g *echo.Group, reader AuditQuerier, cfg AuditRoutesConfig) {
+	if err := cfg.init(); err != nil {
+		panic(err)
+	}
+
+	h := &auditRoutes{reader: reader, cfg: cfg}
+	g.GET("/events", h.events, h.requireAdmin)
+	g.GET("/events/export", h.export, h.requireAdmin)
+}
+
+func (a *AuditRoutesConfig) init() error {
+	if a.AdminRole == "" {
+		return fmt.Errorf("audit routes - admin role is empty")
+	}
+	if a.MaxLimit <= 0 {
+		a.MaxLimit = 1000
+	}
+	if a.MaxExport <= 0 {
+		a.MaxExport = 10000
+	}
+	if a.ExportName == "" {
+		a.ExportName = "audit-events"
+	}
+
+	return nil
+}
+
+type auditRoutes struct {
+	reader AuditQuerier
+	cfg    AuditRoutesConfig
+}
+
+func (a *auditRoutes) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cc, ok := c.(*Context)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("cannot cast context to custom context"))
+		}
+
+		if !cc.UserAndTenantIsPresent() {
+			return echo.NewHTTPError(http.StatusUnauthorized, fmt.Errorf("user or tenant is missing"))
+		}
+		for _, role := range cc.Rol {
+			if role == a.cfg.AdminRole {
+				return next(cc)
+			}
+		}
+
+		MarkSecurityEvent(cc, SecurityEvent{
+			Type:         SecurityEventPermissionDenied,
+			Reason:       "user is not an audit admin",
+			MissingRoles: []string{a.cfg.AdminRole},
+		})
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Errorf("user is not an audit admin"))
+	}
+}
+
+func (a *auditRoutes) events(c echo.Context) error {
+	cc := c.(*Context)
+
+	q, err := a.query(cc)
+	if err != nil {
+		return err
+	}
+
+	page, err := a.reader.Query(cc.Request().Context(), q)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return cc.JSON(http.StatusOK, AuditEventsResponse{
+		Records: tenantRecords(cc, page.Records),
+		Cursor:  page.Cursor,
+	})
+}
+
+func (a *auditRoutes) export(c echo.Context) error {
+	cc := c.(*Context)
+
+	q, err := a.query(cc)
+	if err != nil {
+		return err
+	}
+	q.Limit = a.cfg.MaxLimit
+
+	var w auditExportWriter
+	switch format := cc.QueryParam("format"); format {
+	case "csv":
+		w = &csvExportWriter{w: csv.NewWriter(cc.Response())}
+	case "", "ndjson":
+		w = &ndjsonExportWriter{enc: json.NewEncoder(cc.Response())}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unknown export format %q", format))
+	}
+
+	// the first page is read before the response is committed, so query errors get a proper status
+	page, err := a.reader.Query(cc.Request().Context(), q)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	cc.Response().Header().Set(echo.HeaderContentType, w.contentType())
+	cc.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", a.cfg.ExportName+w.extension()))
+	cc.Response().WriteHeader(http.StatusOK)
+	if err := w.begin(); err != nil {
+		return err
+	}
+
+	exported := 0
+	for {
+		for _, r := range tenantRecords(cc, page.Records) {
+			if exported == a.cfg.MaxExport {
+				return w.flush()
+			}
+			if err := w.write(r); err != nil {
+				return err
+			}
+			exported++
+		}
+		if page.Cursor == "" {
+			return w.flush()
+		}
+
+		q.Cursor = page.Cursor
+		if page, err = a.reader.Query(cc.Request().Context(), q); err != nil {
+			return err
+		}
+	}
+}
+
+// query builds the audit query of the request, scoped to the tenant of the token.
+func (a *auditRoutes) query(cc *Context) (AuditQuery, error) {
+	q := AuditQuery{
+		TenantID: cc.TenantID,
+		UserID:   cc.QueryParam("user"),
+		Cursor:   cc.QueryParam("cursor"),
+	}
+
+	var err error
+	if a.cfg.Pseudonymizer != nil && q.UserID != "" {
+		if q.UserID, err = a.cfg.Pseudonymizer.UserID(cc.Request().Context(), cc.TenantID, q.UserID); err != nil {
+			return q, echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+	if v := cc.QueryParam("request_id"); v != "" {
+		if q.RequestID, err = parseUUIDParam("request_id", v); err != nil {
+			return q, err
+		}
+	}
+	if q.From, err = parseTimeParam("from", cc.QueryParam("from")); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTimeParam("to", cc.QueryParam("to")); err != nil {
+		return q, err
+	}
+	if q.MinStatus, q.MaxStatus, err = parseStatusParam(cc.QueryParam("status")); err != nil {
+		return q, err
+	}
+	if v := cc.QueryParam("limit"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || limit <= 0 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+		}
+		q.Limit = min(int32(limit), a.cfg.MaxLimit)
+	}
+
+	return q, nil
+}
+
+func parseUUIDParam(name, value string) (uuid.UUID, error) {
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return id, echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid %s %q", name, value))
+	}
+
+	return id, nil
+}
+
+func parseTimeParam(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid %s %q", name, value))
+	}
+
+	return t.UTC(), nil
+}
+
+// parseStatusParam parses a status code, e.g. 404, or a status class, e.g. 4xx, into a range.
+func parseStatusParam(value string) (int, int, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+
+	if class, ok := strings.CutSuffix(strings.ToLower(value), "xx"); ok {
+		if n, err := strconv.Atoi(class); err == nil && n >= 1 && n <= 5 {
+			return n * 100, n*100 + 99, nil
+		}
+	} else if n, err := strconv.Atoi(value); err == nil && n >= 100 && n <= 599 {
+		return n, n, nil
+	}
+
+	return 0, 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid status %q", value))
+}
+
+// tenantRecords drops records of other tenants, which the query should never return.
+func tenantRecords(cc *Context, records []AuditRecord) []AuditRecord {
+	filtered := make([]AuditRecord, 0, len(records))
+	for _, r := range records {
+		if r.TenantID == cc.TenantID {
+			filtered = append(filtered, r)
+		}
+	}
+
+	return filtered
+}
+
+// auditExportWriter writes exported records in one of the export formats.
+type auditExportWriter interface {
+	contentType() string
+	extension() string
+	begin() error
+	write(r AuditRecord) error
+	flush() error
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (w *ndjsonExportWriter) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (w *ndjsonExportWriter) extension() string {
+	return ".ndjson"
+}
+
+func (w *ndjsonExportWriter) begin() error {
+	return nil
+}
+
+func (w *ndjsonExportWriter) write(r AuditRecord) error {
+	return w.enc.Encode(r)
+}
+
+func (w *ndjsonExportWriter) flush() error {
+	return nil
+}
+
+// auditCSVHeader lists the columns of CSV exports.
+var auditCSVHeader = []string{
+	"created_at", "id", "request_id", "event_type", "user_id", "principal_kind", "method", "route", "url",
+	"status_code", "client_ip", "user_agent", "process_time_ms", "error", "reason",
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvExportWriter) contentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (w *csvExportWriter) extension() string {
+	return ".csv"
+}
+
+func (w *csvExportWriter) begin() error {
+	return w.w.Write(auditCSVHeader)
+}
+
+func (w *csvExportWriter) write(r AuditRecord) error {
+	row := []string{
+		r.CreatedAt.UTC().Format(time.RFC3339Nano),
+		r.ID.String(),
+		r.RequestID.String(),
+		r.EventType,
+		r.UserID,
+		r.PrincipalKind,
+		r.Method,
+		r.Route,
+		r.URL,
+		strconv.Itoa(r.StatusCode),
+		r.ClientIP,
+		r.UserAgent,
+		strconv.FormatInt(r.ProcessTime.Milliseconds(), 10),
+		r.Error,
+		r.Reason,
+	}
+	for i, v := range row {
+		row[i] = csvSafe(v)
+	}
+
+	return w.w.Write(row)
+}
+
+func (w *csvExportWriter) flush() error {
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+// csvSafe prefixes values spreadsheets would evaluate as formulas, e.g. a crafted user agent.
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+
+	return v
+}
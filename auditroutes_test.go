@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type auditQuerierFunc func(ctx context.Context, q AuditQuery) (*AuditPage, error)
+
+func (f auditQuerierFunc) Query(ctx context.Context, q AuditQuery) (*AuditPage, error) {
+	return f(ctx, q)
+}
+
+// setupAuditRoutes returns a server with audit routes under /audit, authenticated as a user with roles.
+func setupAuditRoutes(reader AuditQuerier, roles ...string) *echo.Echo {
+	e := echo.New()
+	g := e.Group("/audit", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return next(&Context{Context: c, TenantID: tenantID, Sub: userID, Rol: roles})
+		}
+	})
+	RegisterAuditRoutes(g, reader, AuditRoutesConfig{AdminRole: "tenant.audit.admin", MaxLimit: 50})
+
+	return e
+}
+
+func TestRegisterAuditRoutes(t *testing.T) {
+	assert.PanicsWithError(t, "audit routes - admin role is empty", func() {
+		RegisterAuditRoutes(echo.New().Group("/audit"), nil, AuditRoutesConfig{})
+	})
+}
+
+func TestAuditRoutes_events(t *testing.T) {
+	otherTenant := auditRecord
+	otherTenant.TenantID = uuid.New()
+
+	tests := []struct {
+		name       string
+		target     string
+		roles      []string
+		wantQuery  AuditQuery
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "ShouldRejectNonAdmin",
+			target:     "/audit/events",
+			roles:      []string{"tenant.user"},
+			wantStatus: http.StatusForbidden,
+			wantBody:   `{"message":"user is not an audit admin"}`,
+		},
+		{
+			name:   "ShouldListTenantEvents",
+			target: "/audit/events?tenant_id=" + uuid.NewString(),
+			roles:  []string{"tenant.user", "tenant.audit.admin"},
+			wantQuery: AuditQuery{
+				TenantID: tenantID,
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   fmt.Sprintf(`{"records":[%s],"cursor":"foo_cursor"}`, mustJSON(auditRecord)),
+		},
+		{
+			name:   "ShouldPassFilters",
+			target: "/audit/events?user=bar@foo.com&status=4xx&from=2024-06-18T00:00:00Z&to=2024-06-19T00:00:00%2B02:00&limit=500&cursor=foo_cursor",
+			roles:  []string{"tenant.audit.admin"},
+			wantQuery: AuditQuery{
+				TenantID:  tenantID,
+				UserID:    "bar@foo.com",
+				From:      time.Date(2024, 6, 18, 0, 0, 0, 0, time.UTC),
+				To:        time.Date(2024, 6, 18, 22, 0, 0, 0, time.UTC),
+				MinStatus: 400,
+				MaxStatus: 499,
+				Limit:     50,
+				Cursor:    "foo_cursor",
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   fmt.Sprintf(`{"records":[%s],"cursor":"foo_cursor"}`, mustJSON(auditRecord)),
+		},
+		{
+			name:   "ShouldPassRequestID",
+			target: "/audit/events?request_id=" + requestID.String() + "&status=404",
+			roles:  []string{"tenant.audit.admin"},
+			wantQuery: AuditQuery{
+				TenantID:  tenantID,
+				RequestID: requestID,
+				MinStatus: 404,
+				MaxStatus: 404,
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   fmt.Sprintf(`{"records":[%s],"cursor":"foo_cursor"}`, mustJSON(auditRecord)),
+		},
+		{
+			name:       "ShouldRejectInvalidStatus",
+			target:     "/audit/events?status=9xx",
+			roles:      []string{"tenant.audit.admin"},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"message":"invalid status \"9xx\""}`,
+		},
+		{
+			name:       "ShouldRejectInvalidTime",
+			target:     "/audit/events?from=yesterday",
+			roles:      []string{"tenant.audit.admin"},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"message":"invalid from \"yesterday\""}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got AuditQuery
+			e := setupAuditRoutes(auditQuerierFunc(func(ctx context.Context, q AuditQuery) (*AuditPage, error) {
+				got = q
+				return &AuditPage{Records: []AuditRecord{auditRecord, otherTenant}, Cursor: "foo_cursor"}, nil
+			}), tt.roles...)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.JSONEq(t, tt.wantBody, rec.Body.String())
+			assert.Equal(t, tt.wantQuery, got)
+		})
+	}
+}
+
+func TestAuditRoutes_pseudonymizedUser(t *testing.T) {
+	p := newTestPseudonymizer(t)
+	want, _ := p.UserID(context.Background(), tenantID, "bar@foo.com")
+
+	var got AuditQuery
+	e := echo.New()
+	g := e.Group("/audit", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return next(&Context{Context: c, TenantID: tenantID, Sub: userID, Rol: []string{"tenant.audit.admin"}})
+		}
+	})
+	RegisterAuditRoutes(g, auditQuerierFunc(func(ctx context.Context, q AuditQuery) (*AuditPage, error) {
+		got = q
+		return &AuditPage{}, nil
+	}), AuditRoutesConfig{AdminRole: "tenant.audit.admin", Pseudonymizer: p})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/audit/events?user=bar@foo.com", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, want, got.UserID)
+}
+
+func TestAuditRoutes_export(t *testing.T) {
+	second := auditRecord
+	second.ID = uuid.MustParse("6c9cbb47-0a25-4cd0-b1a4-3e0ba0d31f1d")
+	second.UserAgent = "=HYPERLINK(\"http://foo\")"
+	second.StatusCode = 403
+	second.Error = "code=403, message=foo, bar"
+
+	tests := []struct {
+		name            string
+		target          string
+		wantStatus      int
+		wantContentType string
+		wantFilename    string
+		wantBody        string
+	}{
+		{
+			name:            "ShouldExportCSV",
+			target:          "/audit/events/export?format=csv",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/csv; charset=utf-8",
+			wantFilename:    `attachment; filename="audit-events.csv"`,
+			wantBody: "created_at,id,request_id,event_type,user_id,principal_kind,method,route,url,status_code,client_ip,user_agent,process_time_ms,error,reason\n" +
+				"2024-06-18T12:00:00Z," + requestID.String() + ",00000000-0000-0000-0000-000000000000,,foo@bar.com,,GET,,/foo,200,1.1.1.1,,1,,\n" +
+				"2024-06-18T12:00:00Z,6c9cbb47-0a25-4cd0-b1a4-3e0ba0d31f1d,00000000-0000-0000-0000-000000000000,,foo@bar.com,,GET,,/foo,403,1.1.1.1,\"'=HYPERLINK(\"\"http://foo\"\")\",1,\"code=403, message=foo, bar\",\n",
+		},
+		{
+			name:            "ShouldExportNDJSON",
+			target:          "/audit/events/export",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/x-ndjson",
+			wantFilename:    `attachment; filename="audit-events.ndjson"`,
+			wantBody:        mustJSON(auditRecord) + "\n" + mustJSON(second) + "\n",
+		},
+		{
+			name:            "ShouldRejectUnknownFormat",
+			target:          "/audit/events/export?format=xml",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: echo.MIMEApplicationJSON,
+			wantBody:        `{"message":"unknown export format \"xml\""}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cursors []string
+			e := setupAuditRoutes(auditQuerierFunc(func(ctx context.Context, q AuditQuery) (*AuditPage, error) {
+				cursors = append(cursors, q.Cursor)
+				if q.TenantID != tenantID || q.Limit != 50 {
+					return nil, fmt.Errorf("unexpected query %+v", q)
+				}
+				if q.Cursor == "" {
+					return &AuditPage{Records: []AuditRecord{auditRecord}, Cursor: "foo_cursor"}, nil
+				}
+				return &AuditPage{Records: []AuditRecord{second}}, nil
+			}), "tenant.audit.admin")
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantContentType, rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, tt.wantFilename, rec.Header().Get(echo.HeaderContentDisposition))
+			assert.Equal(t, tt.wantBody, rec.Body.String())
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, []string{"", "foo_cursor"}, cursors)
+			}
+		})
+	}
+}
+
+func mustJSON(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(data)
+}
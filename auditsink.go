@@ -0,0 +1,465 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+	"github.com/grasp-labs/go-libs/aws/dynamodb"
+)
+
+// AuditSink is a destination for audit records created by Dispatch.
+type AuditSink interface {
+	Write(ctx context.Context, record AuditRecord) error
+}
+
+// DynamoDBSink writes audit records as items of a DynamoDB table. Items always hold the native
+// AuditRecord schema, SIEM encoders are not supported. IDs are stored as binary, as Dispatch always
+// did, unless WithStringIDs is set.
+type DynamoDBSink struct {
+	client    dynamodb.ClientDynamoDB
+	table     string
+	stringIDs bool
+}
+
+// NewDynamoDBSink returns a sink writing audit records to the DynamoDB table.
+func NewDynamoDBSink(client dynamodb.ClientDynamoDB, table string) *DynamoDBSink {
+	return &DynamoDBSink{client: client, table: table}
+}
+
+// WithStringIDs stores IDs as strings and omits nil IDs, as expected by AuditReader.
+// Tables keyed by binary IDs reject such items, see the CHANGELOG on migrating them.
+func (s *DynamoDBSink) WithStringIDs() *DynamoDBSink {
+	s.stringIDs = true
+
+	return s
+}
+
+func (s *DynamoDBSink) Write(ctx context.Context, record AuditRecord) error {
+	return s.client.PutItem(ctx, s.table, dynamoDBItem(record, s.stringIDs))
+}
+
+// dynamoDBItem returns the item written for the record, with string IDs or the binary IDs of AuditRecord.
+func dynamoDBItem(record AuditRecord, stringIDs bool) any {
+	if stringIDs {
+		return newDynamoDBAuditRecord(record)
+	}
+
+	return dynamoDBBinaryAuditRecord{AuditRecord: record, CreatedAt: auditTime(record.CreatedAt)}
+}
+
+// dynamoDBBinaryAuditRecord is the DynamoDB item of an audit record with the binary IDs of AuditRecord.
+type dynamoDBBinaryAuditRecord struct {
+	AuditRecord
+	CreatedAt auditTime `dynamodbav:"created_at"`
+}
+
+// dynamoDBAuditRecord is the DynamoDB item of an audit record with string IDs, matching the string
+// keys of the audit table and its indexes, and nil IDs are omitted, keeping them out of indexes.
+type dynamoDBAuditRecord struct {
+	AuditRecord
+	ID        auditID   `dynamodbav:"id"`
+	RequestID auditID   `dynamodbav:"request_id,omitempty"`
+	TenantID  auditID   `dynamodbav:"tenant_id,omitempty"`
+	CreatedAt auditTime `dynamodbav:"created_at"`
+}
+
+func newDynamoDBAuditRecord(record AuditRecord) dynamoDBAuditRecord {
+	return dynamoDBAuditRecord{
+		AuditRecord: record,
+		ID:          newAuditID(record.ID),
+		RequestID:   newAuditID(record.RequestID),
+		TenantID:    newAuditID(record.TenantID),
+		CreatedAt:   auditTime(record.CreatedAt),
+	}
+}
+
+// record returns the audit record of the item.
+func (r dynamoDBAuditRecord) record() (AuditRecord, error) {
+	record := r.AuditRecord
+	record.CreatedAt = time.Time(r.CreatedAt)
+	var err error
+	if record.ID, err = r.ID.uuid(); err != nil {
+		return AuditRecord{}, fmt.Errorf("malformed id: %w", err)
+	}
+	if record.RequestID, err = r.RequestID.uuid(); err != nil {
+		return AuditRecord{}, fmt.Errorf("malformed request_id: %w", err)
+	}
+	if record.TenantID, err = r.TenantID.uuid(); err != nil {
+		return AuditRecord{}, fmt.Errorf("malformed tenant_id: %w", err)
+	}
+
+	return record, nil
+}
+
+// auditID is a UUID stored as string, empty for uuid.Nil.
+type auditID string
+
+func newAuditID(id uuid.UUID) auditID {
+	if id == uuid.Nil {
+		return ""
+	}
+
+	return auditID(id.String())
+}
+
+func (id auditID) uuid() (uuid.UUID, error) {
+	if id == "" {
+		return uuid.Nil, nil
+	}
+
+	return uuid.Parse(string(id))
+}
+
+// UnmarshalDynamoDBAttributeValue reads IDs stored as strings, or as binary by the audit middleware of version 1.
+func (id *auditID) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberS:
+		*id = auditID(v.Value)
+	case *types.AttributeValueMemberB:
+		parsed, err := uuid.FromBytes(v.Value)
+		if err != nil {
+			return err
+		}
+		*id = newAuditID(parsed)
+	case *types.AttributeValueMemberNULL:
+		*id = ""
+	default:
+		return fmt.Errorf("unsupported id attribute %T", av)
+	}
+
+	return nil
+}
+
+// auditTime is the creation time of an audit record, stored in the fixed-width layout of formatAuditTime.
+type auditTime time.Time
+
+func (t auditTime) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberS{Value: formatAuditTime(time.Time(t))}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads times in the fixed-width layout, or without trailing zeros as written before.
+func (t *auditTime) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	s, ok := av.(*types.AttributeValueMemberS)
+	if !ok {
+		return fmt.Errorf("unsupported time attribute %T", av)
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, s.Value)
+	if err != nil {
+		return err
+	}
+	*t = auditTime(parsed)
+
+	return nil
+}
+
+// maxBatchWriteItems is the number of items DynamoDB accepts in a single BatchWriteItem call.
+const maxBatchWriteItems = 25
+
+// DynamoDBBatchWriteAPI is the part of the DynamoDB client used by DynamoDBBatchSink.
+type DynamoDBBatchWriteAPI interface {
+	BatchWriteItem(ctx context.Context, params *awsdynamodb.BatchWriteItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.BatchWriteItemOutput, error)
+}
+
+// DynamoDBBatchSink writes audit records to a DynamoDB table with BatchWriteItem,
+// up to 25 records per call. Unprocessed items are resent a few times before giving up.
+// Like DynamoDBSink, it always stores the native AuditRecord schema with binary IDs unless WithStringIDs is set.
+type DynamoDBBatchSink struct {
+	client    DynamoDBBatchWriteAPI
+	table     string
+	stringIDs bool
+}
+
+// NewDynamoDBBatchSink returns a sink writing audit records to the DynamoDB table in batches.
+func NewDynamoDBBatchSink(client DynamoDBBatchWriteAPI, table string) *DynamoDBBatchSink {
+	return &DynamoDBBatchSink{client: client, table: table}
+}
+
+// WithStringIDs stores IDs as strings and omits nil IDs, as expected by AuditReader.
+// Tables keyed by binary IDs reject such items, see the CHANGELOG on migrating them.
+func (s *DynamoDBBatchSink) WithStringIDs() *DynamoDBBatchSink {
+	s.stringIDs = true
+
+	return s
+}
+
+func (s *DynamoDBBatchSink) Write(ctx context.Context, record AuditRecord) error {
+	return s.WriteBatch(ctx, []AuditRecord{record})
+}
+
+func (s *DynamoDBBatchSink) WriteBatch(ctx context.Context, records []AuditRecord) error {
+	for start := 0; start < len(records); start += maxBatchWriteItems {
+		end := min(start+maxBatchWriteItems, len(records))
+
+		requests := make([]types.WriteRequest, 0, end-start)
+		for _, r := range records[start:end] {
+			av, err := attributevalue.MarshalMap(dynamoDBItem(r, s.stringIDs))
+			if err != nil {
+				return err
+			}
+			requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: av}})
+		}
+
+		if err := s.batchWrite(ctx, requests); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DynamoDBBatchSink) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	backoff := 50 * time.Millisecond
+	pending := map[string][]types.WriteRequest{s.table: requests}
+
+	for attempt := 0; ; attempt++ {
+		out, err := s.client.BatchWriteItem(ctx, &awsdynamodb.BatchWriteItemInput{RequestItems: pending})
+		if err != nil {
+			return err
+		}
+
+		pending = out.UnprocessedItems
+		if len(pending[s.table]) == 0 {
+			return nil
+		}
+		if attempt == 3 {
+			return fmt.Errorf("dynamodb batch sink - %d items unprocessed", len(pending[s.table]))
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SQSSendMessageAPI is the part of the SQS client used by SQSSink.
+type SQSSendMessageAPI interface {
+	SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error)
+}
+
+// SQSSink sends audit records as JSON message bodies to an SQS queue.
+type SQSSink struct {
+	client   SQSSendMessageAPI
+	queueURL string
+	encoder  AuditEncoder
+}
+
+// NewSQSSink returns a sink sending audit records to the SQS queue.
+func NewSQSSink(client SQSSendMessageAPI, queueURL string) *SQSSink {
+	return &SQSSink{client: client, queueURL: queueURL, encoder: JSONEncoder{}}
+}
+
+// WithEncoder sets the encoder of message bodies, JSONEncoder by default.
+func (s *SQSSink) WithEncoder(encoder AuditEncoder) *SQSSink {
+	s.encoder = encoder
+
+	return s
+}
+
+func (s *SQSSink) Write(ctx context.Context, record AuditRecord) error {
+	body, err := s.encoder.Encode(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.SendMessage(ctx, &awssqs.SendMessageInput{
+		QueueUrl:    aws.String(s.queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+
+	return err
+}
+
+// JSONLinesSink writes every audit record as a single JSON line, or a line in the format of its encoder.
+type JSONLinesSink struct {
+	mu      sync.Mutex
+	w       io.Writer
+	encoder AuditEncoder
+}
+
+// NewJSONLinesSink returns a sink writing JSON lines to w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w, encoder: JSONEncoder{}}
+}
+
+// WithEncoder sets the encoder of lines, JSONEncoder by default.
+func (s *JSONLinesSink) WithEncoder(encoder AuditEncoder) *JSONLinesSink {
+	s.encoder = encoder
+
+	return s
+}
+
+// NewStdoutSink returns a sink writing JSON lines to standard output.
+func NewStdoutSink() *JSONLinesSink {
+	return NewJSONLinesSink(os.Stdout)
+}
+
+func (s *JSONLinesSink) Write(_ context.Context, record AuditRecord) error {
+	line, err := s.encoder.Encode(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+
+	return err
+}
+
+// FileSinkConfig defines the config for NewFileSink.
+type FileSinkConfig struct {
+	Path       string
+	MaxBytes   int64        // Optional, defaults to 100 MB
+	MaxBackups int          // Optional, defaults to 5
+	Encoder    AuditEncoder // Optional, defaults to JSONEncoder
+}
+
+// FileSink writes audit records as lines, JSON by default, to a local file. When the file grows over MaxBytes
+// it is rotated to Path.1, previous backups are shifted and the oldest one is removed.
+// A file left closed by a failed rotation is reopened by the next Write.
+type FileSink struct {
+	mu     sync.Mutex
+	cfg    FileSinkConfig
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// NewFileSink opens, or creates, the file under cfg.Path for appending audit records.
+func NewFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file sink - path is empty")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 100 << 20
+	}
+	if cfg.MaxBackups <= 0 {
+		cfg.MaxBackups = 5
+	}
+	if cfg.Encoder == nil {
+		cfg.Encoder = JSONEncoder{}
+	}
+
+	s := &FileSink{cfg: cfg}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileSink) Write(_ context.Context, record AuditRecord) error {
+	line, err := s.cfg.Encoder.Encode(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("file sink - closed")
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.size > 0 && s.size+int64(len(line)) > s.cfg.MaxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file, s.size = f, info.Size()
+
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	for i := s.cfg.MaxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.cfg.Path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", s.cfg.Path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(s.cfg.Path, s.cfg.Path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+type multiSink []AuditSink
+
+// MultiSink returns a sink writing every audit record to all given sinks.
+// A failure of one sink does not stop writing to the others, errors are joined.
+func MultiSink(sinks ...AuditSink) AuditSink {
+	return multiSink(sinks)
+}
+
+func (m multiSink) Write(ctx context.Context, record AuditRecord) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(ctx, record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
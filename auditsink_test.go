@@ -0,0 +1,316 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+	"github.com/grasp-labs/go-libs/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	auditRecord = AuditRecord{
+		ID:          requestID,
+		TenantID:    tenantID,
+		UserID:      userID,
+		URL:         "/foo",
+		Method:      "GET",
+		ClientIP:    "1.1.1.1",
+		StatusCode:  200,
+		CreatedAt:   time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC),
+		ProcessTime: time.Millisecond,
+	}
+)
+
+type sqsSendMessageFunc func(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error)
+
+func (f sqsSendMessageFunc) SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error) {
+	return f(ctx, params, optFns...)
+}
+
+type auditSinkFunc func(ctx context.Context, record AuditRecord) error
+
+func (f auditSinkFunc) Write(ctx context.Context, record AuditRecord) error {
+	return f(ctx, record)
+}
+
+func TestDynamoDBSink_Write(t *testing.T) {
+	t.Run("ShouldWriteRecord", func(t *testing.T) {
+		dbMock := mocks.NewClientDynamoDB(t)
+		dbMock.EXPECT().
+			PutItem(context.Background(), "dynamo-table", dynamoDBBinaryAuditRecord{AuditRecord: auditRecord, CreatedAt: auditTime(auditRecord.CreatedAt)}).
+			Return(nil).
+			Once()
+
+		assert.NoError(t, NewDynamoDBSink(dbMock, "dynamo-table").Write(context.Background(), auditRecord))
+	})
+	t.Run("ShouldWriteStringIDs", func(t *testing.T) {
+		dbMock := mocks.NewClientDynamoDB(t)
+		dbMock.EXPECT().
+			PutItem(context.Background(), "dynamo-table", newDynamoDBAuditRecord(auditRecord)).
+			Return(nil).
+			Once()
+
+		assert.NoError(t, NewDynamoDBSink(dbMock, "dynamo-table").WithStringIDs().Write(context.Background(), auditRecord))
+	})
+}
+
+func TestSQSSink_Write(t *testing.T) {
+	tests := []struct {
+		name       string
+		sendErr    error
+		wantErrMsg string
+	}{
+		{
+			name:       "ShouldErrorOnSQS",
+			sendErr:    fmt.Errorf("foo sqs"),
+			wantErrMsg: "foo sqs",
+		},
+		{
+			name: "ShouldSendRecordAsBody",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *awssqs.SendMessageInput
+			client := sqsSendMessageFunc(func(_ context.Context, params *awssqs.SendMessageInput, _ ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error) {
+				got = params
+				return &awssqs.SendMessageOutput{}, tt.sendErr
+			})
+
+			if err := NewSQSSink(client, "https://sqs/audit").Write(context.Background(), auditRecord); err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+
+			var record AuditRecord
+			assert.NoError(t, json.Unmarshal([]byte(*got.MessageBody), &record))
+			assert.Equal(t, auditRecord, record)
+			assert.Equal(t, "https://sqs/audit", *got.QueueUrl)
+		})
+	}
+}
+
+func TestJSONLinesSink_Write(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewJSONLinesSink(&buf)
+
+	assert.NoError(t, s.Write(context.Background(), auditRecord))
+	assert.NoError(t, s.Write(context.Background(), auditRecord))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if assert.Len(t, lines, 2) {
+		var record AuditRecord
+		assert.NoError(t, json.Unmarshal(lines[1], &record))
+		assert.Equal(t, auditRecord, record)
+	}
+}
+
+func TestFileSink_Write(t *testing.T) {
+	line, err := json.Marshal(auditRecord)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name        string
+		writes      int
+		maxBackups  int
+		wantFiles   map[string]int
+		wantErrMsg  string
+		emptyConfig bool
+	}{
+		{
+			name:        "ShouldErrorOnEmptyPath",
+			emptyConfig: true,
+			wantErrMsg:  "file sink - path is empty",
+		},
+		{
+			name:      "ShouldAppendWithoutRotation",
+			writes:    2,
+			wantFiles: map[string]int{"audit.log": 2},
+		},
+		{
+			name:       "ShouldRotateAndDropOldestBackup",
+			writes:     5,
+			maxBackups: 2,
+			wantFiles:  map[string]int{"audit.log": 1, "audit.log.1": 2, "audit.log.2": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := FileSinkConfig{
+				Path:       filepath.Join(dir, "audit.log"),
+				MaxBytes:   int64(2 * (len(line) + 1)),
+				MaxBackups: tt.maxBackups,
+			}
+			if tt.emptyConfig {
+				cfg = FileSinkConfig{}
+			}
+
+			s, err := NewFileSink(cfg)
+			if err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			defer s.Close()
+
+			for i := 0; i < tt.writes; i++ {
+				assert.NoError(t, s.Write(context.Background(), auditRecord))
+			}
+
+			entries, err := os.ReadDir(dir)
+			if !assert.NoError(t, err) {
+				return
+			}
+			got := make(map[string]int)
+			for _, e := range entries {
+				b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+				if !assert.NoError(t, err) {
+					return
+				}
+				got[e.Name()] = bytes.Count(b, []byte("\n"))
+			}
+			assert.Equal(t, tt.wantFiles, got)
+		})
+	}
+}
+
+func TestFileSink_Write_recover(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	s, err := NewFileSink(FileSinkConfig{Path: path, MaxBytes: 1, MaxBackups: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, s.Write(context.Background(), auditRecord))
+
+	// a directory in place of the backup makes the rotation fail after the file is closed
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "foo"), 0o700))
+	assert.Error(t, s.Write(context.Background(), auditRecord))
+	assert.Error(t, s.Write(context.Background(), auditRecord))
+
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, s.Write(context.Background(), auditRecord))
+	for _, name := range []string{"audit.log", "audit.log.1"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, bytes.Count(b, []byte("\n")), name)
+	}
+
+	assert.NoError(t, s.Close())
+	assert.EqualError(t, s.Write(context.Background(), auditRecord), "file sink - closed")
+}
+
+func TestMultiSink_Write(t *testing.T) {
+	var buf bytes.Buffer
+	failing := auditSinkFunc(func(context.Context, AuditRecord) error {
+		return fmt.Errorf("foo sink")
+	})
+
+	err := MultiSink(failing, NewJSONLinesSink(&buf)).Write(context.Background(), auditRecord)
+
+	assert.EqualError(t, err, "foo sink")
+	assert.NotEmpty(t, buf.String())
+}
+
+type dynamoBatchWriteFunc func(ctx context.Context, params *awsdynamodb.BatchWriteItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.BatchWriteItemOutput, error)
+
+func (f dynamoBatchWriteFunc) BatchWriteItem(ctx context.Context, params *awsdynamodb.BatchWriteItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.BatchWriteItemOutput, error) {
+	return f(ctx, params, optFns...)
+}
+
+func TestDynamoDBBatchSink_WriteBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		records     int
+		unprocessed int
+		batchErr    error
+		wantCalls   []int
+		wantErrMsg  string
+	}{
+		{
+			name:       "ShouldErrorOnDynamo",
+			records:    1,
+			batchErr:   fmt.Errorf("foo dynamo"),
+			wantCalls:  []int{1},
+			wantErrMsg: "foo dynamo",
+		},
+		{
+			name:      "ShouldSplitIntoBatchesOf25",
+			records:   30,
+			wantCalls: []int{25, 5},
+		},
+		{
+			name:        "ShouldResendUnprocessedItems",
+			records:     3,
+			unprocessed: 2,
+			wantCalls:   []int{3, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []int
+			unprocessed := tt.unprocessed
+			client := dynamoBatchWriteFunc(func(_ context.Context, params *awsdynamodb.BatchWriteItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["dynamo-table"]
+				calls = append(calls, len(requests))
+
+				out := &awsdynamodb.BatchWriteItemOutput{}
+				if unprocessed > 0 {
+					out.UnprocessedItems = map[string][]dynamotypes.WriteRequest{"dynamo-table": requests[:unprocessed]}
+					unprocessed = 0
+				}
+
+				return out, tt.batchErr
+			})
+
+			records := make([]AuditRecord, tt.records)
+			for i := range records {
+				records[i] = auditRecord
+			}
+
+			err := NewDynamoDBBatchSink(client, "dynamo-table").WriteBatch(context.Background(), records)
+			assert.Equal(t, tt.wantCalls, calls)
+			if err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+		})
+	}
+}
+
+func TestDynamoDBBatchSink_WriteBatch_item(t *testing.T) {
+	var got map[string]dynamotypes.AttributeValue
+	client := dynamoBatchWriteFunc(func(_ context.Context, params *awsdynamodb.BatchWriteItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.BatchWriteItemOutput, error) {
+		got = params.RequestItems["dynamo-table"][0].PutRequest.Item
+		return &awsdynamodb.BatchWriteItemOutput{}, nil
+	})
+
+	t.Run("ShouldWriteBinaryIDs", func(t *testing.T) {
+		assert.NoError(t, NewDynamoDBBatchSink(client, "dynamo-table").Write(context.Background(), auditRecord))
+		assert.Equal(t, &dynamotypes.AttributeValueMemberB{Value: requestID[:]}, got["id"])
+		assert.Equal(t, &dynamotypes.AttributeValueMemberB{Value: tenantID[:]}, got["tenant_id"])
+		assert.Equal(t, &dynamotypes.AttributeValueMemberB{Value: uuid.Nil[:]}, got["request_id"])
+		assert.Equal(t, &dynamotypes.AttributeValueMemberS{Value: "2024-06-18T12:00:00.000000000Z"}, got["created_at"])
+	})
+	t.Run("ShouldWriteStringIDs", func(t *testing.T) {
+		assert.NoError(t, NewDynamoDBBatchSink(client, "dynamo-table").WithStringIDs().Write(context.Background(), auditRecord))
+		assert.Equal(t, &dynamotypes.AttributeValueMemberS{Value: requestID.String()}, got["id"])
+		assert.Equal(t, &dynamotypes.AttributeValueMemberS{Value: tenantID.String()}, got["tenant_id"])
+		assert.Equal(t, &dynamotypes.AttributeValueMemberS{Value: userID}, got["user_id"])
+		assert.NotContains(t, got, "request_id")
+		assert.Equal(t, &dynamotypes.AttributeValueMemberS{Value: "2024-06-18T12:00:00.000000000Z"}, got["created_at"])
+	})
+}
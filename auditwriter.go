@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// ErrAuditQueueFull is returned by AsyncAuditWriter.Write when the queue is full and OverflowDrop is used.
+var ErrAuditQueueFull = errors.New("audit queue is full")
+
+// ErrAuditWriterClosed is returned by AsyncAuditWriter.Write after the writer has been closed.
+var ErrAuditWriterClosed = errors.New("audit writer is closed")
+
+// BatchAuditSink is an AuditSink able to write several records in one call.
+type BatchAuditSink interface {
+	AuditSink
+	WriteBatch(ctx context.Context, records []AuditRecord) error
+}
+
+// OverflowPolicy defines what happens to a record written to a full queue.
+type OverflowPolicy int
+
+const (
+	// OverflowDrop drops the record and returns ErrAuditQueueFull.
+	OverflowDrop OverflowPolicy = iota
+	// OverflowBlock waits until there is room in the queue or the request context is done.
+	OverflowBlock
+)
+
+// AsyncAuditWriterConfig defines the config for NewAsyncAuditWriter.
+type AsyncAuditWriterConfig struct {
+	QueueSize     int                                    // Optional, defaults to 1000
+	BatchSize     int                                    // Optional, defaults to 25, the BatchWriteItem limit
+	FlushInterval time.Duration                          // Optional, defaults to 1s
+	Overflow      OverflowPolicy                         // Optional, defaults to OverflowDrop
+	MaxRetries    int                                    // Optional, defaults to 3, negative disables retries
+	RetryBackoff  time.Duration                          // Optional, defaults to 100ms, doubled after every retry
+	OnError       func(err error, records []AuditRecord) // Optional, defaults to logging the error
+}
+
+// AsyncAuditWriter is an AuditSink writing records to the wrapped sink in the background.
+// Records are queued, grouped into batches and written on batch size or flush interval,
+// so audit writes neither add latency to requests nor surface sink failures to callers.
+// Flush or Close must be called on shutdown to not lose queued records.
+type AsyncAuditWriter struct {
+	sink  AuditSink
+	cfg   AsyncAuditWriterConfig
+	queue chan AuditRecord
+	flush chan chan struct{}
+	done  chan struct{}
+
+	mu      sync.RWMutex
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// NewAsyncAuditWriter starts a background writer for the sink.
+func NewAsyncAuditWriter(sink AuditSink, cfg AsyncAuditWriterConfig) *AsyncAuditWriter {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 25
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(err error, records []AuditRecord) {
+			log.Errorf("audit writer - failed to write %d records: %v", len(records), err)
+		}
+	}
+
+	w := &AsyncAuditWriter{
+		sink:  sink,
+		cfg:   cfg,
+		queue: make(chan AuditRecord, cfg.QueueSize),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+
+	return w
+}
+
+// Write queues the record. It does not wait for the record to be written to the sink.
+func (w *AsyncAuditWriter) Write(ctx context.Context, record AuditRecord) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrAuditWriterClosed
+	}
+
+	if w.cfg.Overflow == OverflowBlock {
+		select {
+		case w.queue <- record:
+			return nil
+		case <-ctx.Done():
+			w.dropped.Add(1)
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case w.queue <- record:
+		return nil
+	default:
+		w.dropped.Add(1)
+		return ErrAuditQueueFull
+	}
+}
+
+// Dropped returns the number of records dropped because of a full queue.
+func (w *AsyncAuditWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Flush writes all records queued so far and waits until they are written or ctx is done.
+func (w *AsyncAuditWriter) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case w.flush <- ack:
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting records, writes the queued ones and waits until they are written or ctx is done.
+func (w *AsyncAuditWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *AsyncAuditWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AuditRecord, 0, w.cfg.BatchSize)
+	add := func(r AuditRecord) {
+		batch = append(batch, r)
+		if len(batch) >= w.cfg.BatchSize {
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case r, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			add(r)
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		case ack := <-w.flush:
+		drain:
+			for {
+				select {
+				case r, ok := <-w.queue:
+					if !ok {
+						break drain
+					}
+					add(r)
+				default:
+					break drain
+				}
+			}
+			w.write(batch)
+			batch = batch[:0]
+			close(ack)
+		}
+	}
+}
+
+func (w *AsyncAuditWriter) write(batch []AuditRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// records are written detached from any request, the request context is long gone by now
+	ctx := context.Background()
+
+	if bs, ok := w.sink.(BatchAuditSink); ok {
+		if err := w.retry(func() error { return bs.WriteBatch(ctx, batch) }); err != nil {
+			w.cfg.OnError(err, append([]AuditRecord(nil), batch...))
+		}
+		return
+	}
+
+	for _, r := range batch {
+		if err := w.retry(func() error { return w.sink.Write(ctx, r) }); err != nil {
+			w.cfg.OnError(err, []AuditRecord{r})
+		}
+	}
+}
+
+func (w *AsyncAuditWriter) retry(fn func() error) error {
+	backoff := w.cfg.RetryBackoff
+
+	err := fn()
+	for i := 0; err != nil && i < w.cfg.MaxRetries; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+
+	return err
+}
@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	mu      sync.Mutex
+	batches [][]AuditRecord
+	fails   int
+	block   chan struct{}
+	entered chan struct{}
+}
+
+func (s *recordingSink) Write(ctx context.Context, record AuditRecord) error {
+	if s.block != nil {
+		s.entered <- struct{}{}
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fails != 0 {
+		s.fails--
+		return fmt.Errorf("foo sink")
+	}
+	s.batches = append(s.batches, []AuditRecord{record})
+
+	return nil
+}
+
+func (s *recordingSink) sizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sizes []int
+	for _, b := range s.batches {
+		sizes = append(sizes, len(b))
+	}
+
+	return sizes
+}
+
+type recordingBatchSink struct {
+	recordingSink
+}
+
+func (s *recordingBatchSink) WriteBatch(_ context.Context, records []AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fails != 0 {
+		s.fails--
+		return fmt.Errorf("foo sink")
+	}
+	s.batches = append(s.batches, append([]AuditRecord(nil), records...))
+
+	return nil
+}
+
+func TestAsyncAuditWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		sink        interface{ sizes() []int }
+		cfg         AsyncAuditWriterConfig
+		writes      int
+		flush       bool
+		wantSizes   []int
+		wantFailed  int
+		wantErrorCb bool
+	}{
+		{
+			name:      "ShouldWriteInBatchesOnClose",
+			sink:      &recordingBatchSink{},
+			cfg:       AsyncAuditWriterConfig{FlushInterval: time.Hour},
+			writes:    30,
+			wantSizes: []int{25, 5},
+		},
+		{
+			name:      "ShouldWriteOneByOneToPlainSink",
+			sink:      &recordingSink{},
+			cfg:       AsyncAuditWriterConfig{FlushInterval: time.Hour},
+			writes:    3,
+			wantSizes: []int{1, 1, 1},
+		},
+		{
+			name:      "ShouldWriteOnFlush",
+			sink:      &recordingBatchSink{},
+			cfg:       AsyncAuditWriterConfig{FlushInterval: time.Hour},
+			writes:    3,
+			flush:     true,
+			wantSizes: []int{3},
+		},
+		{
+			name:      "ShouldRetryFailedBatch",
+			sink:      &recordingBatchSink{recordingSink{fails: 2}},
+			cfg:       AsyncAuditWriterConfig{FlushInterval: time.Hour, RetryBackoff: time.Millisecond},
+			writes:    2,
+			wantSizes: []int{2},
+		},
+		{
+			name:       "ShouldReportErrorAfterRetries",
+			sink:       &recordingBatchSink{recordingSink{fails: 3}},
+			cfg:        AsyncAuditWriterConfig{FlushInterval: time.Hour, RetryBackoff: time.Millisecond, MaxRetries: 2},
+			writes:     2,
+			wantFailed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failed := 0
+			tt.cfg.OnError = func(err error, records []AuditRecord) {
+				assert.EqualError(t, err, "foo sink")
+				failed += len(records)
+			}
+
+			w := NewAsyncAuditWriter(tt.sink.(AuditSink), tt.cfg)
+			for i := 0; i < tt.writes; i++ {
+				assert.NoError(t, w.Write(context.Background(), auditRecord))
+			}
+
+			if tt.flush {
+				assert.NoError(t, w.Flush(context.Background()))
+				assert.Equal(t, tt.wantSizes, tt.sink.sizes())
+			}
+
+			assert.NoError(t, w.Close(context.Background()))
+			assert.Equal(t, tt.wantSizes, tt.sink.sizes())
+			assert.Equal(t, tt.wantFailed, failed)
+			assert.ErrorIs(t, w.Write(context.Background(), auditRecord), ErrAuditWriterClosed)
+		})
+	}
+}
+
+func TestAsyncAuditWriter_Overflow(t *testing.T) {
+	tests := []struct {
+		name        string
+		overflow    OverflowPolicy
+		wantErr     error
+		wantDropped uint64
+	}{
+		{
+			name:        "ShouldDropOnFullQueue",
+			overflow:    OverflowDrop,
+			wantErr:     ErrAuditQueueFull,
+			wantDropped: 1,
+		},
+		{
+			name:        "ShouldBlockUntilContextDone",
+			overflow:    OverflowBlock,
+			wantErr:     context.DeadlineExceeded,
+			wantDropped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{block: make(chan struct{}), entered: make(chan struct{}, 3)}
+			w := NewAsyncAuditWriter(sink, AsyncAuditWriterConfig{QueueSize: 1, BatchSize: 1, Overflow: tt.overflow})
+
+			// first record is picked up and blocks the sink, second one waits in the queue
+			assert.NoError(t, w.Write(context.Background(), auditRecord))
+			<-sink.entered
+			assert.NoError(t, w.Write(context.Background(), auditRecord))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			assert.ErrorIs(t, w.Write(ctx, auditRecord), tt.wantErr)
+			assert.Equal(t, tt.wantDropped, w.Dropped())
+
+			close(sink.block)
+			assert.NoError(t, w.Close(context.Background()))
+			assert.Equal(t, []int{1, 1}, sink.sizes())
+		})
+	}
+}
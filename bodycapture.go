@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// CapturedBody holds the redacted request and response bodies of an audited request.
+type CapturedBody struct {
+	Request           string `json:"request,omitempty" dynamodbav:"request,omitempty"`
+	Response          string `json:"response,omitempty" dynamodbav:"response,omitempty"`
+	RequestTruncated  bool   `json:"request_truncated,omitempty" dynamodbav:"request_truncated,omitempty"`
+	ResponseTruncated bool   `json:"response_truncated,omitempty" dynamodbav:"response_truncated,omitempty"`
+}
+
+// BodyStore stores captured bodies apart from the audit record.
+// The returned reference is attached to the record as AuditRecord.BodyRef.
+type BodyStore interface {
+	Put(ctx context.Context, record AuditRecord, body CapturedBody) (string, error)
+}
+
+// BodyCaptureConfig defines which bodies Dispatch captures for audit and how they are redacted.
+// The request body is captured as far as the handler reads it. JSON and url encoded form bodies
+// are redacted, bodies of other captured content types are recorded as they are.
+type BodyCaptureConfig struct {
+	Routes       []string        // Optional, echo route patterns, e.g. /workflows/:id, captures all routes when empty
+	ContentTypes []string        // Optional, media types, e.g. application/json or text/*, defaults to application/json
+	MaxBytes     int             // Optional, defaults to 64 KB, bodies are truncated above
+	SkipRequest  bool            // Optional
+	SkipResponse bool            // Optional
+	Redaction    RedactionConfig // Optional
+	Store        BodyStore       // Optional, bodies are attached to the audit record when nil
+}
+
+func (b *BodyCaptureConfig) init() {
+	if len(b.ContentTypes) == 0 {
+		b.ContentTypes = []string{echo.MIMEApplicationJSON}
+	}
+	if b.MaxBytes <= 0 {
+		b.MaxBytes = 64 << 10
+	}
+}
+
+func (b *BodyCaptureConfig) capturesRoute(route string) bool {
+	if len(b.Routes) == 0 {
+		return true
+	}
+	for _, r := range b.Routes {
+		if r == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *BodyCaptureConfig) capturesContentType(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+
+	for _, ct := range b.ContentTypes {
+		if ct == mediaType || strings.HasSuffix(ct, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(ct, "*")) {
+			return mediaType, true
+		}
+	}
+
+	return "", false
+}
+
+// bodyCapture records bodies of a single request.
+type bodyCapture struct {
+	cfg      *BodyCaptureConfig
+	redactor *redactor
+	request  *limitedBuffer
+	response *limitedBuffer
+}
+
+// start wraps request body and response writer of c to capture what is read and written.
+func (b *BodyCaptureConfig) start(c echo.Context, body *countingReadCloser, r *redactor) *bodyCapture {
+	if !b.capturesRoute(c.Path()) {
+		return nil
+	}
+
+	bc := &bodyCapture{cfg: b, redactor: r}
+	if !b.SkipRequest {
+		bc.request = &limitedBuffer{limit: b.MaxBytes}
+		body.capture = bc.request
+	}
+	if !b.SkipResponse {
+		bc.response = &limitedBuffer{limit: b.MaxBytes}
+		c.Response().Writer = &captureWriter{ResponseWriter: c.Response().Writer, capture: bc.response}
+	}
+
+	return bc
+}
+
+// attach adds redacted bodies to the record, or stores them and adds the reference.
+func (bc *bodyCapture) attach(ctx context.Context, c echo.Context, record *AuditRecord) {
+	var body CapturedBody
+	if bc.request != nil {
+		body.Request, body.RequestTruncated = bc.redact(c.Request().Header.Get(echo.HeaderContentType), bc.request)
+	}
+	if bc.response != nil {
+		body.Response, body.ResponseTruncated = bc.redact(c.Response().Header().Get(echo.HeaderContentType), bc.response)
+	}
+	if body == (CapturedBody{}) {
+		return
+	}
+
+	if bc.cfg.Store == nil {
+		record.Body = &body
+		return
+	}
+
+	ref, err := bc.cfg.Store.Put(ctx, *record, body)
+	if err != nil {
+		log.Errorf("dispatch middleware - failed to store captured body: %v", err)
+		return
+	}
+	record.BodyRef = ref
+}
+
+// redact returns the redacted body, or nothing if its content type is not captured or it cannot be redacted.
+// Truncated JSON and form bodies cannot be parsed, hence cannot be redacted and are dropped.
+func (bc *bodyCapture) redact(contentType string, buf *limitedBuffer) (string, bool) {
+	if buf.buf.Len() == 0 {
+		return "", false
+	}
+
+	mediaType, ok := bc.cfg.capturesContentType(contentType)
+	if !ok {
+		return "", false
+	}
+
+	var (
+		redacted []byte
+		err      error
+	)
+	switch {
+	case mediaType == echo.MIMEApplicationJSON || strings.HasSuffix(mediaType, "+json"):
+		redacted, err = bc.redactor.redactJSON(buf.buf.Bytes())
+	case mediaType == echo.MIMEApplicationForm:
+		redacted, err = bc.redactor.redactForm(buf.buf.Bytes())
+	default:
+		return buf.buf.String(), buf.truncated
+	}
+	if err != nil || buf.truncated {
+		return "", buf.truncated
+	}
+
+	return string(redacted), false
+}
+
+// limitedBuffer keeps up to limit bytes written to it and drops the rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); room < len(p) {
+		l.truncated = true
+		l.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+
+	return l.buf.Write(p)
+}
+
+// captureWriter copies the response body into capture.
+type captureWriter struct {
+	http.ResponseWriter
+	capture *limitedBuffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.capture.Write(b[:n])
+
+	return n, err
+}
+
+// Unwrap returns the original http.ResponseWriter, so http.ResponseController keeps working.
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// DirBodyStore stores captured bodies as JSON files under a local directory,
+// one file per request in a directory per tenant.
+type DirBodyStore struct {
+	dir string
+}
+
+// NewDirBodyStore returns a store writing captured bodies under dir.
+func NewDirBodyStore(dir string) *DirBodyStore {
+	return &DirBodyStore{dir: dir}
+}
+
+func (s *DirBodyStore) Put(_ context.Context, record AuditRecord, body CapturedBody) (string, error) {
+	dir := filepath.Join(s.dir, record.TenantID.String())
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s.json", record.ID))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", err
+	}
+
+	return "file://" + path, nil
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatch_bodyCapture(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         BodyCaptureConfig
+		route       string
+		contentType string
+		body        string
+		want        *CapturedBody
+	}{
+		{
+			name:        "ShouldCaptureRedactedBodies",
+			cfg:         BodyCaptureConfig{Redaction: RedactionConfig{Paths: []string{"name"}}},
+			route:       "/workflows/:id",
+			contentType: echo.MIMEApplicationJSONCharsetUTF8,
+			body:        `{"name":"foo","password":"bar"}`,
+			want: &CapturedBody{
+				Request:  `{"name":"[REDACTED]","password":"[REDACTED]"}`,
+				Response: `{"id":"42","token":"[REDACTED]"}`,
+			},
+		},
+		{
+			name:        "ShouldSkipNotConfiguredRoute",
+			cfg:         BodyCaptureConfig{Routes: []string{"/users/:id"}},
+			route:       "/workflows/:id",
+			contentType: echo.MIMEApplicationJSON,
+			body:        `{"name":"foo"}`,
+		},
+		{
+			name:        "ShouldSkipNotConfiguredContentType",
+			cfg:         BodyCaptureConfig{SkipResponse: true},
+			route:       "/workflows/:id",
+			contentType: echo.MIMETextPlain,
+			body:        "foo",
+		},
+		{
+			name:        "ShouldCaptureWildcardContentTypeAsIs",
+			cfg:         BodyCaptureConfig{ContentTypes: []string{"text/*"}, SkipResponse: true},
+			route:       "/workflows/:id",
+			contentType: echo.MIMETextPlain,
+			body:        "foo",
+			want:        &CapturedBody{Request: "foo"},
+		},
+		{
+			name:        "ShouldDropTruncatedJSON",
+			cfg:         BodyCaptureConfig{MaxBytes: 10, SkipResponse: true},
+			route:       "/workflows/:id",
+			contentType: echo.MIMEApplicationJSON,
+			body:        `{"name":"foo","password":"bar"}`,
+			want:        &CapturedBody{RequestTruncated: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := &DispatchConfig{
+				Sink:        NewJSONLinesSink(&buf),
+				BodyCapture: &tt.cfg,
+			}
+
+			h, err := cfg.toMiddleware()
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			e := echo.New()
+
+			req := httptest.NewRequest(http.MethodPost, "/workflows/42", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, tt.contentType)
+			req.Header.Set(echo.HeaderXForwardedFor, "1.1.1.1")
+			req.RemoteAddr = "10.0.0.1:1234"
+			rec := httptest.NewRecorder()
+
+			ctx := e.NewContext(req, rec)
+			ctx.SetPath(tt.route)
+			cc := &Context{
+				Context:   ctx,
+				RequestID: requestID,
+				TenantID:  tenantID,
+				Sub:       userID,
+			}
+
+			err = h(func(c echo.Context) error {
+				if _, err := io.ReadAll(c.Request().Body); err != nil {
+					return err
+				}
+				return c.JSON(http.StatusOK, map[string]string{"id": "42", "token": "foo"})
+			})(cc)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, `{"id":"42","token":"foo"}`+"\n", rec.Body.String())
+
+			var got AuditRecord
+			if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &got)) {
+				return
+			}
+			assert.Equal(t, tt.want, got.Body)
+		})
+	}
+}
+
+func TestDirBodyStore_Put(t *testing.T) {
+	dir := t.TempDir()
+	body := CapturedBody{Request: `{"name":"foo"}`}
+
+	ref, err := NewDirBodyStore(dir).Put(context.Background(), auditRecord, body)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	path := filepath.Join(dir, tenantID.String(), requestID.String()+".json")
+	assert.Equal(t, "file://"+path, ref)
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var got CapturedBody
+	assert.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, body, got)
+}
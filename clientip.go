@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultTrustedProxies are the networks trusted to set proxy headers when no other are configured.
+// They cover loopback and private ranges, where load balancers in front of our services live.
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// ClientIPResolver resolves the IP address of the client which originated a request.
+// Proxy headers are honored only when set by a trusted proxy: `Forwarded` (RFC 7239) first,
+// then `X-Forwarded-For` and finally `X-Real-IP`. Proxy chains are walked from the nearest hop,
+// skipping trusted proxies, so a client cannot spoof its address by sending the headers itself.
+//
+// The same resolver can be used by echo itself, see Extractor, so audit, rate limiting
+// and IP allow-lists agree on the client address.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPResolver returns a resolver trusting proxies within the given CIDRs.
+// Without CIDRs DefaultTrustedProxies are trusted.
+func NewClientIPResolver(trustedProxies ...string) (*ClientIPResolver, error) {
+	if len(trustedProxies) == 0 {
+		trustedProxies = DefaultTrustedProxies
+	}
+
+	trusted, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("client ip resolver - %w", err)
+	}
+
+	return &ClientIPResolver{trusted: trusted}, nil
+}
+
+// ClientIP returns the address of the client which originated the request.
+// The returned address is invalid if not even the remote address of the request could be parsed.
+func (r *ClientIPResolver) ClientIP(req *http.Request) netip.Addr {
+	remote := parseHost(req.RemoteAddr)
+	if !remote.IsValid() || !r.isTrusted(remote) {
+		return remote
+	}
+
+	if chain, ok := forwardedChain(req.Header); ok {
+		return r.walk(remote, chain)
+	}
+	if chain := xForwardedForChain(req.Header); len(chain) != 0 {
+		return r.walk(remote, chain)
+	}
+	if ip := parseHost(strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP))); ip.IsValid() {
+		return ip
+	}
+
+	return remote
+}
+
+// Extractor returns the resolver as echo.IPExtractor, to be set as `e.IPExtractor`,
+// so that `c.RealIP()` and echo middlewares relying on it use the same client address.
+func (r *ClientIPResolver) Extractor() echo.IPExtractor {
+	return func(req *http.Request) string {
+		if ip := r.ClientIP(req); ip.IsValid() {
+			return ip.String()
+		}
+
+		return ""
+	}
+}
+
+// walk goes through the proxy chain starting from the hop nearest to us
+// and returns the first address not belonging to a trusted proxy.
+func (r *ClientIPResolver) walk(remote netip.Addr, chain []string) netip.Addr {
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseHost(chain[i])
+		if !ip.IsValid() {
+			// obfuscated or garbage hop, nothing further left can be trusted
+			return client
+		}
+		client = ip
+		if !r.isTrusted(ip) {
+			return ip
+		}
+	}
+
+	return client
+}
+
+func (r *ClientIPResolver) isTrusted(ip netip.Addr) bool {
+	for _, p := range r.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedChain returns the `for` nodes of the Forwarded header. Elements without `for` parameter,
+// e.g. `proto=https`, are skipped, and ok is false if no element has one.
+func forwardedChain(h http.Header) ([]string, bool) {
+	var chain []string
+	for _, v := range h.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(value, `"`))
+					break
+				}
+			}
+		}
+	}
+
+	return chain, len(chain) > 0
+}
+
+func xForwardedForChain(h http.Header) []string {
+	var chain []string
+	for _, v := range h.Values(echo.HeaderXForwardedFor) {
+		for _, hop := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+
+	return chain
+}
+
+// parseHost parses an address with an optional port, IPv6 addresses may be enclosed in brackets.
+func parseHost(s string) netip.Addr {
+	if ip, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return ip.Unmap()
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			return ip.Unmap()
+		}
+	}
+
+	return netip.Addr{}
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	return prefixes, nil
+}
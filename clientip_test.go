@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClientIPResolver(t *testing.T) {
+	_, err := NewClientIPResolver("foo_bar")
+	assert.EqualError(t, err, `client ip resolver - netip.ParsePrefix("foo_bar"): no '/'`)
+}
+
+func TestClientIPResolver_ClientIP(t *testing.T) {
+	type args struct {
+		remoteAddr string
+		headers    map[string][]string
+	}
+	tests := []struct {
+		name    string
+		trusted []string
+		args    args
+		want    string
+	}{
+		{
+			name: "ShouldUseRemoteAddrWithoutHeaders",
+			args: args{remoteAddr: "1.1.1.1:1234"},
+			want: "1.1.1.1",
+		},
+		{
+			name: "ShouldIgnoreHeadersFromUntrustedRemote",
+			args: args{
+				remoteAddr: "1.1.1.1:1234",
+				headers:    map[string][]string{echo.HeaderXForwardedFor: {"2.2.2.2"}},
+			},
+			want: "1.1.1.1",
+		},
+		{
+			name: "ShouldSkipTrustedProxiesInXForwardedFor",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers:    map[string][]string{echo.HeaderXForwardedFor: {"3.3.3.3, 2.2.2.2, 10.0.0.2"}},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "ShouldJoinMultipleXForwardedForHeaders",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers:    map[string][]string{echo.HeaderXForwardedFor: {"2.2.2.2", "10.0.0.3, 10.0.0.2"}},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "ShouldReturnLeftmostWhenAllHopsTrusted",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers:    map[string][]string{echo.HeaderXForwardedFor: {"192.168.1.1, 10.0.0.2"}},
+			},
+			want: "192.168.1.1",
+		},
+		{
+			name: "ShouldStopOnInvalidHop",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers:    map[string][]string{echo.HeaderXForwardedFor: {"2.2.2.2, foo_bar, 10.0.0.2"}},
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "ShouldPreferForwardedHeader",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers: map[string][]string{
+					"Forwarded":              {`for=192.0.2.60;proto=http;by=10.0.0.1, for="[2001:db8:cafe::17]:4711"`},
+					echo.HeaderXForwardedFor: {"2.2.2.2"},
+				},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:    "ShouldHonorConfiguredTrustedProxies",
+			trusted: []string{"10.0.0.0/8", "2001:db8::/32"},
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers: map[string][]string{
+					"Forwarded": {`for=192.0.2.60;proto=http, For="[2001:db8:cafe::17]:4711"`},
+				},
+			},
+			want: "192.0.2.60",
+		},
+		{
+			name: "ShouldStopOnObfuscatedForwardedNode",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers:    map[string][]string{"Forwarded": {"for=_hidden"}},
+			},
+			want: "10.0.0.1",
+		},
+		{
+			name: "ShouldSkipForwardedElementsWithoutFor",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers:    map[string][]string{"Forwarded": {"for=2.2.2.2, proto=https"}},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "ShouldFallbackToXForwardedForWithoutForwardedNodes",
+			args: args{
+				remoteAddr: "10.0.0.1:1234",
+				headers: map[string][]string{
+					"Forwarded":              {"proto=https"},
+					echo.HeaderXForwardedFor: {"2.2.2.2"},
+				},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "ShouldFallbackToXRealIP",
+			args: args{
+				remoteAddr: "[::1]:1234",
+				headers:    map[string][]string{echo.HeaderXRealIP: {"2.2.2.2"}},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "ShouldUnmapIPv4InIPv6",
+			args: args{remoteAddr: "[::ffff:1.1.1.1]:1234"},
+			want: "1.1.1.1",
+		},
+		{
+			name: "ShouldReturnInvalidOnGarbageRemoteAddr",
+			args: args{remoteAddr: "foo_bar"},
+			want: "invalid IP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewClientIPResolver(tt.trusted...)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.args.remoteAddr
+			for k, values := range tt.args.headers {
+				for _, v := range values {
+					req.Header.Add(k, v)
+				}
+			}
+
+			assert.Equal(t, tt.want, r.ClientIP(req).String())
+		})
+	}
+}
+
+func TestClientIPResolver_Extractor(t *testing.T) {
+	r, err := NewClientIPResolver()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	e := echo.New()
+	e.IPExtractor = r.Extractor()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(echo.HeaderXForwardedFor, "2.2.2.2")
+
+	assert.Equal(t, "2.2.2.2", e.NewContext(req, httptest.NewRecorder()).RealIP())
+}
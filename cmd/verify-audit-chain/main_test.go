@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grasp-labs/go-middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	tenantID := uuid.MustParse("1a9d7f3c-0f3e-4e5a-9f43-7c2b8d5a6e11")
+
+	var buf bytes.Buffer
+	sink := middleware.NewHashChainSink(middleware.NewJSONLinesSink(&buf), middleware.HashChainConfig{ChainID: "foo_chain", Key: []byte("foo")})
+	for i := 0; i < 2; i++ {
+		err := sink.Write(context.Background(), middleware.AuditRecord{
+			ID:        uuid.New(),
+			TenantID:  tenantID,
+			CreatedAt: time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC),
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if !assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600)) {
+		return
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:       "ShouldVerifyFile",
+			args:       []string{"-tenant", tenantID.String(), "-key", "666f6f", path},
+			wantStdout: "tenant " + tenantID.String() + ": 2 records in 1 chains verified, 0 unchained, 0 issues\n",
+		},
+		{
+			name:     "ShouldReportIssuesFromStdin",
+			args:     []string{"-tenant", tenantID.String()},
+			stdin:    buf.String(),
+			wantCode: 1,
+		},
+		{
+			name:       "ShouldFailOnInvalidTenant",
+			args:       []string{"-tenant", "foo"},
+			wantCode:   2,
+			wantStderr: "invalid tenant: invalid UUID length: 3\n",
+		},
+		{
+			name:       "ShouldFailOnInvalidKey",
+			args:       []string{"-tenant", tenantID.String(), "-key", "foo"},
+			wantCode:   2,
+			wantStderr: "invalid key: encoding/hex: invalid byte: U+006F 'o'\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			code := run(tt.args, bytes.NewBufferString(tt.stdin), &stdout, &stderr)
+
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantStdout != "" {
+				assert.Equal(t, tt.wantStdout, stdout.String())
+			}
+			assert.Equal(t, tt.wantStderr, stderr.String())
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
@@ -16,9 +17,12 @@ type Context struct {
 	Rol        []string  `json:"rol"`
 	Cls        string    `json:"cls"`
 	Ver        string    `json:"ver"`
+	Scopes     []string  `json:"scopes"`
 	TenantName string    `json:"tenant_name"`
 	TenantID   uuid.UUID `json:"tenant_id"`
 	RequestID  uuid.UUID `json:"request_id"`
+
+	usage *usageMeter // set by the usage middleware
 }
 
 func (c *Context) SetDataFromClaims(a JWTClaims) {
@@ -26,11 +30,30 @@ func (c *Context) SetDataFromClaims(a JWTClaims) {
 	c.Rol = a.Rol
 	c.Cls = a.Cls
 	c.Ver = a.Ver
-	parts := strings.Split(a.Rsc, ":")
-	if len(parts) == 2 {
-		c.TenantID = uuid.MustParse(parts[0])
-		c.TenantName = parts[1]
+	c.Scopes = a.Scopes()
+	if tenantID, tenantName, err := parseResource(a.Rsc); err == nil {
+		c.TenantID = tenantID
+		c.TenantName = tenantName
+	}
+}
+
+// errResourceWithoutTenant is returned by parseResource for `rsc` claims without tenant part,
+// which are accepted without tenant as they always were.
+var errResourceWithoutTenant = errors.New("malformed rsc claim: no tenant id")
+
+// parseResource parses the `rsc` claim in the form of `<tenant id>:<tenant name>`, the name may contain colons.
+func parseResource(rsc string) (uuid.UUID, string, error) {
+	id, name, found := strings.Cut(rsc, ":")
+	if !found || id == "" {
+		return uuid.Nil, "", errResourceWithoutTenant
 	}
+
+	tenantID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("malformed rsc claim: %w", err)
+	}
+
+	return tenantID, name, nil
 }
 
 func (c *Context) UserAndTenantIsPresent() bool {
@@ -46,14 +69,23 @@ func NewCustomContextMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		token, ok := c.Get("user").(*jwt.Token) // by default token is stored under `user` key
 		if !ok {
+			MarkSecurityEvent(c, SecurityEvent{Type: SecurityEventAuthenticationFailed, Reason: "JWT token missing or invalid"})
 			return fmt.Errorf("JWT token missing or invalid")
 		}
 
 		claims, ok := token.Claims.(*JWTClaims)
 		if !ok {
+			MarkSecurityEvent(c, SecurityEvent{Type: SecurityEventMalformedClaims, Reason: "failed to cast claims as jwt.JWTClaims"})
 			return fmt.Errorf("failed to cast claims as jwt.JWTClaims")
 		}
 
+		if claims.Rsc != "" {
+			if _, _, err := parseResource(claims.Rsc); err != nil && !errors.Is(err, errResourceWithoutTenant) {
+				MarkSecurityEvent(c, SecurityEvent{Type: SecurityEventMalformedClaims, Reason: err.Error()})
+				return err
+			}
+		}
+
 		reqID := c.Response().Header().Get("X-Request-Id")
 		if reqID == "" {
 			return fmt.Errorf("failed to get Request-ID from header")
@@ -64,6 +96,7 @@ func NewCustomContextMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			RequestID: uuid.MustParse(reqID),
 		}
 		cc.SetDataFromClaims(*claims)
+		cc.enrichLogger()
 
 		return next(cc)
 	}
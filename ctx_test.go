@@ -62,6 +62,74 @@ func TestNewCustomContextMiddleware(t *testing.T) {
 			},
 			wantErrMsg: "failed to get Request-ID from header",
 		},
+		{
+			name: "ShouldAcceptResourceWithoutTenant",
+			jwtToken: &jwt.Token{
+				Claims: &JWTClaims{
+					RegisteredClaims: jwt.RegisteredClaims{
+						Subject: "mock-sub",
+					},
+					Rsc: "mock-tenant-name",
+				},
+			},
+			requestID: requestID.String(),
+			args: args{
+				assertion: func(c echo.Context) error {
+					cc, ok := c.(*Context)
+					if !ok {
+						log.Fatalln("cannot cast context to custom context")
+					}
+
+					assert.Nil(t, cc.Get(securityEventKey))
+					assert.Equal(t, uuid.Nil, cc.TenantID)
+					assert.Empty(t, cc.TenantName)
+					return nil
+				},
+			},
+		},
+		{
+			name: "ShouldFailOnMalformedTenantID",
+			jwtToken: &jwt.Token{
+				Claims: &JWTClaims{
+					RegisteredClaims: jwt.RegisteredClaims{
+						Subject: "mock-sub",
+					},
+					Rsc: "mock-tenant-id:mock-tenant-name",
+				},
+			},
+			requestID: requestID.String(),
+			args: args{
+				assertion: func(c echo.Context) error {
+					return nil
+				},
+			},
+			wantErrMsg: "malformed rsc claim: invalid UUID length: 14",
+		},
+		{
+			name: "ShouldAcceptTenantNameWithColon",
+			jwtToken: &jwt.Token{
+				Claims: &JWTClaims{
+					RegisteredClaims: jwt.RegisteredClaims{
+						Subject: "mock-sub",
+					},
+					Rsc: "b9db1d4a-4364-4452-a2df-fcd44f38a63b:mock:tenant-name",
+				},
+			},
+			requestID: requestID.String(),
+			args: args{
+				assertion: func(c echo.Context) error {
+					cc, ok := c.(*Context)
+					if !ok {
+						log.Fatalln("cannot cast context to custom context")
+					}
+
+					assert.Nil(t, cc.Get(securityEventKey))
+					assert.Equal(t, uuid.MustParse("b9db1d4a-4364-4452-a2df-fcd44f38a63b"), cc.TenantID)
+					assert.Equal(t, "mock:tenant-name", cc.TenantName)
+					return nil
+				},
+			},
+		},
 		{
 			name: "ShouldCreateCustomContextApp",
 			jwtToken: &jwt.Token{
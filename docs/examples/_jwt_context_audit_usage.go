@@ -41,7 +41,7 @@ func main() {
 	e.Use(custommiddleware.Dispatch(context.Background(), "audit-table"))
 	e.Use(custommiddleware.UsageWithConfig(context.Background(), custommiddleware.UsageConfig{
 		ProductID: uuid.New(),
-		MemoryMB:  "1234",
+		MemoryMB:  1234,
 	}))
 
 	e.GET("/", func(c echo.Context) error {
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/grasp-labs/go-libs/aws/paramstore"
@@ -113,12 +117,19 @@ func ExampleUsageWithConfig() {
 
 	e.Use(middleware.UsageWithConfig(context.Background(), middleware.UsageConfig{
 		ProductID: uuid.MustParse("Product UUID"),
-		MemoryMB:  "1024",
+		MemoryMB:  1024,
+		// Bill the export routes to their own product
+		ProductRoutes: []middleware.UsageProductRoute{
+			{Prefix: "/exports", ProductID: uuid.MustParse("Export product UUID")},
+		},
 	}))
 
 	e.GET("/", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, "hello world")
 	})
+	e.GET("/exports/:id", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "export")
+	})
 
 	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
@@ -128,6 +139,104 @@ func ExampleUsageWithConfig() {
 	// hello world
 }
 
+func ExampleContext_RecordUsage() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	productID := uuid.MustParse("Product UUID")
+	e.Use(middleware.UsageWithConfig(context.Background(), middleware.UsageConfig{
+		ProductID: productID,
+		MemoryMB:  1024,
+		Units:     map[uuid.UUID][]string{productID: {"rows", "bytes"}},
+	}))
+
+	e.GET("/export", func(c echo.Context) error {
+		cc := c.(*middleware.Context)
+
+		// Bill the export by rows and bytes on top of the request
+		if err := cc.RecordUsage("rows", 5000); err != nil {
+			return err
+		}
+		if err := cc.RecordUsage("bytes", 1<<20); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, "exported")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+func ExampleNewUsageEmitter() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	// Keep usage which could not be sent on disk and replay it once the queue recovers
+	outbox, err := middleware.NewUsageOutbox(middleware.UsageOutboxConfig{
+		Path: "/var/lib/app/usage.outbox",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer outbox.Close()
+
+	// Send usage in background batches, off the request path
+	emitter, err := middleware.NewUsageEmitter(awssqs.New(awssqs.Options{Region: "eu-north-1"}), middleware.UsageEmitterConfig{
+		QueueURL: "https://sqs.eu-north-1.amazonaws.com/123456789012/daas-service-cost-handler-usage-queue-prod",
+		Outbox:   outbox,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer emitter.Close(context.Background())
+
+	e.Use(middleware.UsageWithConfig(context.Background(), middleware.UsageConfig{
+		ProductID: uuid.MustParse("Product UUID"),
+		MemoryMB:  1024,
+		Emitter:   emitter,
+		// Do not bill tenants for failures of the service
+		BillingPolicy: middleware.BillSuccessesAndClientErrors,
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleUsageRecorder_Track() {
+	recorder, err := middleware.NewUsageRecorder(context.Background(), middleware.UsageRecorderConfig{
+		ProductID: uuid.MustParse("Product UUID"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Bill a nightly job to the tenant it runs for
+	tenantID := uuid.MustParse("Tenant UUID")
+	if err := recorder.Track(context.Background(), tenantID, "nightly-export", func() error {
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func ExamplePermissionFilterWithConfig() {
 	// Create server
 	e := echo.New()
@@ -151,3 +260,370 @@ func ExamplePermissionFilterWithConfig() {
 	// Output:
 	// hello world
 }
+
+func ExampleRequireScopes() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	e.GET("/workflows", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	}, middleware.RequireScopes("workflows:read"))
+
+	e.POST("/workflows", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	}, middleware.RequireAnyScope("workflows:write", "workflows:admin"))
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleDispatchWithConfig() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	// Write audit records to a rotating local file and stdout
+	fileSink, err := middleware.NewFileSink(middleware.FileSinkConfig{Path: "/var/log/audit.log"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fileSink.Close()
+
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink: middleware.MultiSink(fileSink, middleware.NewStdoutSink()),
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleAuditPolicy() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	// Skip health checks, sample reads and always audit writes, the first matching policy applies
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink: middleware.NewStdoutSink(),
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/health"
+		},
+		Policies: []middleware.AuditPolicy{
+			{Method: http.MethodGet, Route: "/workflows/:id", Mode: middleware.AuditErrorsOnly},
+			{Method: http.MethodGet, Mode: middleware.AuditSample, SamplePercent: 10},
+		},
+		TenantPolicies: map[uuid.UUID][]middleware.AuditPolicy{
+			uuid.MustParse("dd49bb44-ac56-4e70-8697-89603f4125f2"): {{Mode: middleware.AuditAlways}},
+		},
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleNewAsyncAuditWriter() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	// Write audit records in the background, off the request path
+	writer := middleware.NewAsyncAuditWriter(middleware.NewStdoutSink(), middleware.AsyncAuditWriterConfig{
+		Overflow: middleware.OverflowDrop,
+	})
+	defer writer.Close(context.Background())
+
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink: writer,
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleNewClientIPResolver() {
+	// Create server
+	e := echo.New()
+
+	// Trust proxy headers only from our load balancers
+	resolver, err := middleware.NewClientIPResolver("10.0.0.0/8")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// c.RealIP() and echo middlewares relying on it, like the rate limiter, use the same client address
+	e.IPExtractor = resolver.Extractor()
+
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink:       middleware.NewStdoutSink(),
+		IPResolver: resolver,
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, c.RealIP())
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// 1.1.1.1
+}
+
+func ExampleSecurityEventsWithConfig() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+	e.Use(echomiddleware.RequestID())
+
+	// Record rejected requests, it has to wrap the middlewares rejecting them
+	e.Use(middleware.SecurityEventsWithConfig(middleware.SecurityEventsConfig{
+		Sink: middleware.NewStdoutSink(),
+	}))
+	e.Use(echojwt.WithConfig(echojwt.Config{
+		SigningKey:    []byte("secret"),
+		NewClaimsFunc: middleware.NewClaimsFunction,
+	}))
+	e.Use(middleware.NewCustomContextMiddleware)
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	}, middleware.RequireScopes("workflows:read"))
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleNewHashChainSink() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	fileSink, err := middleware.NewFileSink(middleware.FileSinkConfig{Path: "/var/log/audit.log"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fileSink.Close()
+
+	// Chain audit records, so they can be verified with VerifyAuditChain or cmd/verify-audit-chain
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink: middleware.NewHashChainSink(fileSink, middleware.HashChainConfig{
+			Key: []byte("secret"),
+		}),
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleOCSFEncoder() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	// Write audit records as OCSF API Activity events, e.g. for a log shipper feeding a SIEM
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink: middleware.NewStdoutSink().WithEncoder(middleware.OCSFEncoder{Product: "workflows"}),
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleNewPseudonymizingSink() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	client := awsdynamodb.New(awsdynamodb.Options{Region: "eu-north-1"})
+
+	pseudonymizer, err := middleware.NewPseudonymizer(middleware.PseudonymizerConfig{
+		KeyStore: middleware.NewDynamoDBKeyStore(client, "audit-keys"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Store pseudonyms instead of user IDs and client IPs, pseudonymizer.Forget(ctx, tenantID) makes them unlinkable
+	e.Use(middleware.DispatchWithConfig(middleware.DispatchConfig{
+		Sink: middleware.NewPseudonymizingSink(middleware.NewDynamoDBBatchSink(client, "audit"), pseudonymizer),
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleRegisterAuditRoutes() {
+	// Create server
+	e := echo.New()
+
+	// Echo middlewares
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+
+	reader, err := middleware.NewAuditReader(awsdynamodb.New(awsdynamodb.Options{Region: "eu-north-1"}), middleware.AuditReaderConfig{
+		Table: "audit",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tenant admins can read their audit events, e.g. GET /audit/events?status=4xx or GET /audit/events/export?format=csv
+	g := e.Group("/audit", echojwt.WithConfig(echojwt.Config{
+		SigningKey:    []byte("secret"),
+		NewClaimsFunc: middleware.NewClaimsFunction,
+	}), middleware.NewCustomContextMiddleware)
+	middleware.RegisterAuditRoutes(g, reader, middleware.AuditRoutesConfig{AdminRole: "service.audit.admin"})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// {"records":[]}
+}
+
+func ExampleRequestLoggerWithConfig() {
+	// Create server
+	e := echo.New()
+
+	e.Use(echomiddleware.Recover())
+	e.Use(echomiddleware.RequestID())
+	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		Handler: slog.NewJSONHandler(os.Stdout, nil),
+	}))
+	e.Use(echojwt.WithConfig(echojwt.Config{
+		SigningKey:    []byte("secret"),
+		NewClaimsFunc: middleware.NewClaimsFunction,
+	}))
+	e.Use(middleware.NewCustomContextMiddleware)
+
+	e.GET("/", func(c echo.Context) error {
+		// logged with request ID, tenant and subject of the request
+		middleware.LoggerFrom(c.Request().Context()).Info("hello")
+		c.Logger().Info("world")
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
+
+func ExampleQuotaWithConfig() {
+	// Create server
+	e := echo.New()
+
+	e.Use(echomiddleware.Recover())
+	e.Use(echojwt.WithConfig(echojwt.Config{
+		SigningKey:    []byte("secret"),
+		NewClaimsFunc: middleware.NewClaimsFunction,
+	}))
+	e.Use(middleware.NewCustomContextMiddleware)
+	e.Use(middleware.QuotaWithConfig(middleware.QuotaConfig{
+		Plans: middleware.QuotaPlanFunc(func(ctx context.Context, tenantID uuid.UUID) (middleware.QuotaPlan, error) {
+			return middleware.QuotaPlan{Name: "basic", Requests: 100000, ComputeSeconds: 3600, SoftLimit: 0.8}, nil
+		}),
+		Counters:           middleware.NewDynamoDBQuotaCounters(awsdynamodb.New(awsdynamodb.Options{Region: "eu-north-1"}), "quotas"),
+		MemoryMB:           1024,
+		ExceededStatusCode: http.StatusPaymentRequired,
+		BillingPolicy:      middleware.BillSuccessesAndClientErrors,
+	}))
+
+	e.GET("/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "hello world")
+	})
+
+	if err := e.Start(":8080"); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// hello world
+}
@@ -17,6 +17,10 @@ type JWTClaims struct {
 	Rol       []string `json:"rol"`
 	Rsc       string   `json:"rsc"`
 	TokenType string   `json:"token_type"`
+	// Scope and Scp carry OAuth scopes granted to third-party applications.
+	// Issuers differ on the claim name and on whether it is a space separated string or a list.
+	Scope ScopeClaim `json:"scope,omitempty"`
+	Scp   ScopeClaim `json:"scp,omitempty"`
 }
 
 const (
@@ -2,27 +2,45 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/grasp-labs/go-libs/aws/dynamodb"
 	"github.com/labstack/echo/v4"
+	echomiddleware "github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 )
 
-type item struct {
-	ID          uuid.UUID     `json:"id" dynamodbav:"id"`
-	TenantID    uuid.UUID     `json:"tenant_id" dynamodbav:"tenant_id"`
-	UserID      string        `json:"user_id" dynamodbav:"user_id"`
-	URL         string        `json:"url" dynamodbav:"url"`
-	Method      string        `json:"method" dynamodbav:"method"`
-	ClientIP    string        `json:"client_ip" dynamodbav:"client_id"`
-	StatusCode  int           `json:"status_code" dynamodbav:"status_code"`
-	CreatedAt   time.Time     `json:"created_at" dynamodbav:"created_at"`
-	ProcessTime time.Duration `json:"process_time" dynamodbav:"process_time"`
+// DispatchConfig defines the config for DispatchWithConfig middleware.
+type DispatchConfig struct {
+	Sink       AuditSink
+	IPResolver *ClientIPResolver // Optional, defaults to a resolver trusting DefaultTrustedProxies
+	// InternalNetworks are networks whose requests are not audited. Optional, defaults to DefaultInternalNetworks.
+	InternalNetworks []netip.Prefix
+	// ExcludeNetworks are carved out of InternalNetworks and audited like external ones. Optional.
+	ExcludeNetworks []netip.Prefix
+	// AuditInternal audits requests from internal networks too. Optional.
+	AuditInternal bool
+	// BodyCapture enables capturing redacted request and response bodies. Optional, disabled when nil.
+	BodyCapture *BodyCaptureConfig
+	// Retention sets AuditRecord.TTL, so DynamoDB removes records once it passes. Optional, records are kept when zero.
+	Retention time.Duration
+	// Skipper defines a function to skip auditing, e.g. of health checks. X-Process-Time is still set. Optional.
+	Skipper echomiddleware.Skipper
+	// Policies decide by route and method which requests are audited, the first matching one applies.
+	// Optional, requests matching no policy are always audited.
+	Policies []AuditPolicy
+	// TenantPolicies override Policies for single tenants. Optional.
+	TenantPolicies map[uuid.UUID][]AuditPolicy
+
+	networks networkFilter
+	policies auditPolicies
+	redactor *redactor
 }
 
 // Dispatch all requests made to api, internal and internet facing,
@@ -34,7 +52,14 @@ func Dispatch(ctx context.Context, dynamodbTable string) echo.MiddlewareFunc {
 		panic(err)
 	}
 
-	mw, err := toMiddleware(client, dynamodbTable)
+	return DispatchWithConfig(DispatchConfig{
+		Sink: NewDynamoDBSink(client, dynamodbTable),
+	})
+}
+
+// DispatchWithConfig returns an audit middleware like Dispatch, writing records to the configured sink.
+func DispatchWithConfig(cfg DispatchConfig) echo.MiddlewareFunc {
+	mw, err := cfg.toMiddleware()
 	if err != nil {
 		panic(err)
 	}
@@ -42,43 +67,94 @@ func Dispatch(ctx context.Context, dynamodbTable string) echo.MiddlewareFunc {
 	return mw
 }
 
-func toMiddleware(dynamo dynamodb.ClientDynamoDB, table string) (echo.MiddlewareFunc, error) {
+func (d *DispatchConfig) toMiddleware() (echo.MiddlewareFunc, error) {
+	if d.Sink == nil {
+		return nil, fmt.Errorf("dispatch middleware - audit sink is nil")
+	}
+	if d.IPResolver == nil {
+		resolver, err := NewClientIPResolver()
+		if err != nil {
+			return nil, err
+		}
+		d.IPResolver = resolver
+	}
+	d.networks = newNetworkFilter(d.InternalNetworks, d.ExcludeNetworks)
+	policies, err := newAuditPolicies(d.Policies, d.TenantPolicies)
+	if err != nil {
+		return nil, err
+	}
+	d.policies = policies
+	if d.BodyCapture != nil {
+		d.BodyCapture.init()
+		d.redactor = newRedactor(d.BodyCapture.Redaction)
+	}
+
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			if d.Skipper != nil && d.Skipper(c) {
+				_, _, err := timed(c, next)
+				return err
+			}
+
 			cc, ok := c.(*Context)
 			if !ok {
 				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("cannot cast context to custom context"))
 			}
 
-			startTime := time.Now()
-			handlerError := next(cc)
+			decision := d.policies.decide(cc)
+			if decision == skipAudit {
+				_, _, err := timed(cc, next)
+				return err
+			}
 
-			processTime := time.Since(startTime)
-			cc.Response().Header().Add("X-Process-Time", processTime.String())
+			body := newCountingReadCloser(cc.Request().Body)
+			cc.Request().Body = body
 
-			if ip := cc.Response().Header().Get("x-forwarded-for"); cc.UserAndTenantIsPresent() && ip != "" {
-				inNetworks, err := checkIPInNetworks(ip)
-				if err != nil {
-					return err
-				}
+			var capture *bodyCapture
+			if d.BodyCapture != nil {
+				capture = d.BodyCapture.start(cc, body, d.redactor)
+			}
+
+			startTime, processTime, handlerError := timed(cc, next)
 
-				if !inNetworks {
-					auditItem := item{
-						ID:          cc.RequestID,
-						URL:         cc.Request().URL.String(),
-						Method:      cc.Request().Method,
-						ClientIP:    ip,
-						StatusCode:  cc.Response().Status,
-						TenantID:    cc.TenantID,
-						UserID:      cc.Sub,
-						CreatedAt:   startTime,
-						ProcessTime: processTime,
+			status := responseStatus(cc, handlerError)
+			if ip := d.IPResolver.ClientIP(cc.Request()); cc.UserAndTenantIsPresent() && ip.IsValid() && decision.record(status) {
+				if d.AuditInternal || !d.networks.isInternal(ip) {
+					auditItem := AuditRecord{
+						Version:       AuditRecordVersion,
+						EventType:     AuditEventRequest,
+						ID:            cc.RequestID,
+						RequestID:     cc.RequestID,
+						URL:           cc.Request().URL.String(),
+						Route:         cc.Path(),
+						Method:        cc.Request().Method,
+						ClientIP:      ip.String(),
+						UserAgent:     cc.Request().UserAgent(),
+						StatusCode:    status,
+						RequestBytes:  body.n,
+						ResponseBytes: cc.Response().Size,
+						TenantID:      cc.TenantID,
+						TenantName:    cc.TenantName,
+						UserID:        cc.Sub,
+						PrincipalKind: cc.Cls,
+						Roles:         cc.Rol,
+						CreatedAt:     startTime.UTC(),
+						ProcessTime:   processTime,
+						TTL:           expiresAt(startTime, d.Retention),
+					}
+					if handlerError != nil {
+						auditItem.Error = handlerError.Error()
+					}
+					if capture != nil {
+						capture.attach(cc.Request().Context(), cc, &auditItem)
 					}
 
-					if err := dynamo.PutItem(cc.Request().Context(), table, auditItem); err != nil {
-						return err
+					// the response is already written, audit failures must not change the outcome of the request
+					if err := d.Sink.Write(cc.Request().Context(), auditItem); err != nil {
+						log.Errorf("dispatch middleware - failed to write audit record: %v", err)
+					} else {
+						LoggerFrom(cc.Request().Context()).Debug("audit record written", slog.String("audit_id", auditItem.ID.String()))
 					}
-					log.Info(auditItem)
 				}
 			}
 			if handlerError != nil {
@@ -90,42 +166,97 @@ func toMiddleware(dynamo dynamodb.ClientDynamoDB, table string) (echo.Middleware
 	}, nil
 }
 
-func checkIPInNetworks(ip string) (bool, error) {
-	networks := []string{
-		"0.0.0.0/8",
-		"10.0.0.0/8",
-		"100.64.0.0/10",
-		"127.0.0.0/8",
-		"169.254.0.0/16",
-		"172.16.0.0/12",
-		"172.0.0.0/8",
-		"192.0.0.0/24",
-		"192.0.2.0/24",
-		"192.88.99.0/24",
-		"192.168.0.0/16",
-		"198.18.0.0/15",
-		"198.51.100.0/24",
-		"203.0.113.0/24",
-		"240.0.0.0/4",
-		"255.255.255.255/32",
-		"224.0.0.0/4",
+// timed calls next and adds its process time to the X-Process-Time response header.
+func timed(c echo.Context, next echo.HandlerFunc) (time.Time, time.Duration, error) {
+	startTime := time.Now()
+	err := next(c)
+	processTime := time.Since(startTime)
+	c.Response().Header().Add("X-Process-Time", processTime.String())
+
+	return startTime, processTime, err
+}
+
+// DefaultInternalNetworks are special purpose, private and link-local IPv4 and IPv6 ranges.
+// Requests from these networks are considered internal and are not audited by default.
+var DefaultInternalNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// networkFilter decides whether an address belongs to internal networks.
+type networkFilter struct {
+	include []netip.Prefix
+	exclude []netip.Prefix
+}
+
+func newNetworkFilter(include, exclude []netip.Prefix) networkFilter {
+	if len(include) == 0 {
+		include = DefaultInternalNetworks
 	}
 
-	ipAddr := net.ParseIP(ip)
-	if ipAddr == nil {
-		return false, nil
+	f := networkFilter{}
+	for _, p := range include {
+		f.include = append(f.include, p.Masked())
+	}
+	for _, p := range exclude {
+		f.exclude = append(f.exclude, p.Masked())
 	}
 
-	for _, network := range networks {
-		_, ipNet, err := net.ParseCIDR(network)
-		if err != nil {
-			return false, err
-		}
+	return f
+}
 
-		if ipNet.Contains(ipAddr) {
-			return true, nil
+// isInternal reports whether ip is within included networks and not within excluded ones.
+func (f networkFilter) isInternal(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, p := range f.exclude {
+		if p.Contains(ip) {
+			return false
 		}
 	}
+	for _, p := range f.include {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseStatus returns the status code the client receives. Handler errors are rendered
+// by echo only after all middlewares returned, so their status is not written yet.
+func responseStatus(c echo.Context, handlerError error) int {
+	if handlerError == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+
+	var he *echo.HTTPError
+	if errors.As(handlerError, &he) {
+		return he.Code
+	}
 
-	return false, nil
+	return http.StatusInternalServerError
 }
@@ -1,11 +1,17 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grasp-labs/go-libs/aws/dynamodb"
@@ -54,13 +60,12 @@ func TestDispatch(t *testing.T) {
 			},
 		},
 		{
-			name: "ShouldErrorOnSaveDynamo",
+			name: "ShouldNotErrorOnSaveDynamo",
 			args: args{
 				next: func(c echo.Context) error {
 					return nil
 				},
 			},
-			wantErrMsg: "foo dynamo",
 			setup: func(f *fields) {
 				dbMock := mocks.NewClientDynamoDB(t)
 				dbMock.EXPECT().
@@ -93,7 +98,10 @@ func TestDispatch(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.setup(&tt.fields)
 
-			h, err := toMiddleware(tt.fields.dynamoClient, "dynamo-table")
+			cfg := &DispatchConfig{
+				Sink: NewDynamoDBSink(tt.fields.dynamoClient, "dynamo-table"),
+			}
+			h, err := cfg.toMiddleware()
 			if err != nil {
 				assert.EqualError(t, err, tt.wantErrMsg)
 				return
@@ -102,9 +110,10 @@ func TestDispatch(t *testing.T) {
 			e := echo.New()
 
 			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set(echo.HeaderXForwardedFor, "1.1.1.1")
 			rec := httptest.NewRecorder()
 
-			rec.Header().Set("x-forwarded-for", "1.1.1.1")
 			ctx := e.NewContext(req, rec)
 
 			cc := &Context{
@@ -122,15 +131,16 @@ func TestDispatch(t *testing.T) {
 	}
 }
 
-func TestCheckIPInNetworks(t *testing.T) {
+func TestNetworkFilter_isInternal(t *testing.T) {
 	type args struct {
 		ip string
 	}
 	tests := []struct {
-		name       string
-		args       args
-		want       bool
-		wantErrMsg string
+		name    string
+		include []netip.Prefix
+		exclude []netip.Prefix
+		args    args
+		want    bool
 	}{
 		{
 			name: "ShouldNotParse",
@@ -153,15 +163,248 @@ func TestCheckIPInNetworks(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "ShouldNotFindPublicIn172",
+			args: args{
+				"172.217.20.14",
+			},
+			want: false,
+		},
+		{
+			name: "ShouldFindIPv6UniqueLocal",
+			args: args{
+				"fd12:3456:789a::1",
+			},
+			want: true,
+		},
+		{
+			name: "ShouldFindIPv6LinkLocal",
+			args: args{
+				"fe80::1",
+			},
+			want: true,
+		},
+		{
+			name: "ShouldNotFindIPv6Public",
+			args: args{
+				"2a00:1450:400f:80d::200e",
+			},
+			want: false,
+		},
+		{
+			name: "ShouldFindIPv4MappedIPv6",
+			args: args{
+				"::ffff:10.0.0.1",
+			},
+			want: true,
+		},
+		{
+			name:    "ShouldUseConfiguredNetworks",
+			include: []netip.Prefix{netip.MustParsePrefix("1.1.1.0/24")},
+			args: args{
+				"1.1.1.1",
+			},
+			want: true,
+		},
+		{
+			name:    "ShouldNotFindInExcludedNetwork",
+			exclude: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+			args: args{
+				"10.1.2.3",
+			},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := checkIPInNetworks(tt.args.ip)
-			if err != nil {
-				assert.EqualError(t, err, tt.wantErrMsg)
+			ip, _ := netip.ParseAddr(tt.args.ip)
+
+			got := newNetworkFilter(tt.include, tt.exclude).isInternal(ip)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDispatchConfig_internalNetworks(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           DispatchConfig
+		forwardedFor  string
+		wantAuditLogs int
+	}{
+		{
+			name:          "ShouldAuditExternalClient",
+			forwardedFor:  "1.1.1.1",
+			wantAuditLogs: 1,
+		},
+		{
+			name:          "ShouldSkipInternalClient",
+			forwardedFor:  "fd00::1",
+			wantAuditLogs: 0,
+		},
+		{
+			name:          "ShouldAuditInternalClient",
+			cfg:           DispatchConfig{AuditInternal: true},
+			forwardedFor:  "fd00::1",
+			wantAuditLogs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.cfg.Sink = NewJSONLinesSink(&buf)
+
+			h, err := tt.cfg.toMiddleware()
+			if !assert.NoError(t, err) {
 				return
 			}
-			assert.Equal(t, tt.want, got)
+
+			e := echo.New()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set(echo.HeaderXForwardedFor, tt.forwardedFor)
+			rec := httptest.NewRecorder()
+
+			cc := &Context{
+				Context:   e.NewContext(req, rec),
+				RequestID: requestID,
+				TenantID:  tenantID,
+				Sub:       userID,
+			}
+			err = h(func(c echo.Context) error {
+				return c.String(http.StatusOK, "Hello, World!")
+			})(cc)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAuditLogs, strings.Count(buf.String(), "\n"))
+		})
+	}
+}
+
+func TestDispatchConfig_toMiddleware(t *testing.T) {
+	cfg := &DispatchConfig{}
+
+	_, err := cfg.toMiddleware()
+	assert.EqualError(t, err, "dispatch middleware - audit sink is nil")
+}
+
+func TestDispatch_auditRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention time.Duration
+		handler   echo.HandlerFunc
+		want      AuditRecord
+	}{
+		{
+			name: "ShouldRecordSuccessfulRequest",
+			handler: func(c echo.Context) error {
+				if _, err := io.ReadAll(c.Request().Body); err != nil {
+					return err
+				}
+				return c.String(http.StatusCreated, "Hello, World!")
+			},
+			want: AuditRecord{
+				StatusCode:    http.StatusCreated,
+				ResponseBytes: 13,
+			},
+		},
+		{
+			name: "ShouldRecordHandlerError",
+			handler: func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusNotFound, "foo_error")
+			},
+			want: AuditRecord{
+				StatusCode: http.StatusNotFound,
+				Error:      "code=404, message=foo_error",
+			},
+		},
+		{
+			name: "ShouldRecordInternalErrorStatus",
+			handler: func(c echo.Context) error {
+				return fmt.Errorf("foo error")
+			},
+			want: AuditRecord{
+				StatusCode: http.StatusInternalServerError,
+				Error:      "foo error",
+			},
+		},
+		{
+			name:      "ShouldSetTTLFromRetention",
+			retention: 24 * time.Hour,
+			handler: func(c echo.Context) error {
+				if _, err := io.ReadAll(c.Request().Body); err != nil {
+					return err
+				}
+				return c.NoContent(http.StatusNoContent)
+			},
+			want: AuditRecord{
+				StatusCode: http.StatusNoContent,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := &DispatchConfig{Sink: NewJSONLinesSink(&buf), Retention: tt.retention}
+
+			h, err := cfg.toMiddleware()
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			e := echo.New()
+
+			req := httptest.NewRequest(http.MethodPost, "/workflows/42?foo=bar", strings.NewReader(`{"name":"foo"}`))
+			req.Header.Set(echo.HeaderXForwardedFor, "1.1.1.1")
+			req.Header.Set("User-Agent", "foo-agent/1.0")
+			req.RemoteAddr = "10.0.0.1:1234"
+			rec := httptest.NewRecorder()
+
+			ctx := e.NewContext(req, rec)
+			ctx.SetPath("/workflows/:id")
+			cc := &Context{
+				Context:    ctx,
+				RequestID:  requestID,
+				TenantID:   tenantID,
+				TenantName: "foo_tenant",
+				Sub:        userID,
+				Cls:        "user",
+				Rol:        []string{"service.workflow.user"},
+			}
+			_ = h(tt.handler)(cc)
+
+			var got AuditRecord
+			if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &got)) {
+				return
+			}
+
+			want := tt.want
+			want.Version = AuditRecordVersion
+			want.EventType = AuditEventRequest
+			want.ID = requestID
+			want.RequestID = requestID
+			want.TenantID = tenantID
+			want.TenantName = "foo_tenant"
+			want.UserID = userID
+			want.PrincipalKind = "user"
+			want.Roles = []string{"service.workflow.user"}
+			want.URL = "/workflows/42?foo=bar"
+			want.Route = "/workflows/:id"
+			want.Method = http.MethodPost
+			want.ClientIP = "1.1.1.1"
+			want.UserAgent = "foo-agent/1.0"
+			if want.Error == "" {
+				want.RequestBytes = 14
+			}
+			want.CreatedAt = got.CreatedAt
+			want.ProcessTime = got.ProcessTime
+			if tt.retention != 0 {
+				want.TTL = got.CreatedAt.Add(tt.retention).Unix()
+			}
+
+			assert.Equal(t, want, got)
+			assert.Equal(t, time.UTC, got.CreatedAt.Location())
 		})
 	}
 }
@@ -78,14 +78,19 @@ func (p *PermissionFilterConfig) toMiddleware() (echo.MiddlewareFunc, error) {
 				roles[r.Name] = struct{}{}
 			}
 
-			rolesMatched := 0
+			var missingRoles []string
 			for _, r := range p.Roles {
-				if _, ok := roles[r]; ok {
-					rolesMatched++
+				if _, ok := roles[r]; !ok {
+					missingRoles = append(missingRoles, r)
 				}
 			}
 
-			if rolesMatched != len(p.Roles) {
+			if len(missingRoles) != 0 {
+				MarkSecurityEvent(cc, SecurityEvent{
+					Type:         SecurityEventPermissionDenied,
+					Reason:       "user has not enough entitlements",
+					MissingRoles: missingRoles,
+				})
 				return echo.NewHTTPError(http.StatusForbidden, fmt.Errorf("user has not enough entitlements"))
 			}
 
@@ -0,0 +1,332 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// pseudonymKeySize is the size of generated tenant keys in bytes.
+const pseudonymKeySize = 32
+
+// Pseudonymized fields, part of the HMAC input so equal values of different fields get different pseudonyms.
+const (
+	pseudonymFieldUser     = "user_id"
+	pseudonymFieldClientIP = "client_ip"
+)
+
+// ErrPseudonymWithoutTenant is returned when pseudonymizing identifiers without tenant. They would share
+// a key no tenant owns, which Forget could never delete.
+var ErrPseudonymWithoutTenant = errors.New("pseudonymizer - identifiers without tenant cannot be pseudonymized")
+
+// PseudonymKeyStore stores the pseudonymization key of every tenant.
+type PseudonymKeyStore interface {
+	// Key returns the key of the tenant, creating one if the tenant has none yet.
+	Key(ctx context.Context, tenantID uuid.UUID) ([]byte, error)
+	// DeleteKey deletes the key of the tenant. Pseudonyms created with it can no longer be linked to identifiers.
+	DeleteKey(ctx context.Context, tenantID uuid.UUID) error
+}
+
+// PseudonymizerConfig defines the config for NewPseudonymizer.
+type PseudonymizerConfig struct {
+	KeyStore PseudonymKeyStore
+	CacheTTL time.Duration // Optional, how long keys are cached, defaults to 5 minutes, negative disables caching
+}
+
+// Pseudonymizer replaces user IDs and client IPs with HMAC-SHA256 pseudonyms keyed per tenant.
+// Pseudonyms are stable as long as the tenant key exists, so records of a user can still be correlated
+// and queried. Deleting the key with Forget shreds the link between pseudonyms and identifiers.
+// Identifiers without a tenant are rejected with ErrPseudonymWithoutTenant.
+type Pseudonymizer struct {
+	store PseudonymKeyStore
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[uuid.UUID]cachedPseudonymKey
+}
+
+type cachedPseudonymKey struct {
+	key     []byte
+	expires time.Time
+}
+
+// NewPseudonymizer returns a pseudonymizer with keys from the configured store.
+func NewPseudonymizer(cfg PseudonymizerConfig) (*Pseudonymizer, error) {
+	if cfg.KeyStore == nil {
+		return nil, fmt.Errorf("pseudonymizer - key store is nil")
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 5 * time.Minute
+	}
+
+	return &Pseudonymizer{
+		store: cfg.KeyStore,
+		ttl:   cfg.CacheTTL,
+		cache: make(map[uuid.UUID]cachedPseudonymKey),
+	}, nil
+}
+
+// UserID returns the pseudonym of the user of the tenant, e.g. to query audit records by user.
+func (p *Pseudonymizer) UserID(ctx context.Context, tenantID uuid.UUID, userID string) (string, error) {
+	return p.pseudonym(ctx, tenantID, pseudonymFieldUser, userID)
+}
+
+// ClientIP returns the pseudonym of the client IP of a request to the tenant.
+func (p *Pseudonymizer) ClientIP(ctx context.Context, tenantID uuid.UUID, ip string) (string, error) {
+	return p.pseudonym(ctx, tenantID, pseudonymFieldClientIP, ip)
+}
+
+// Record replaces user ID and client IP of the record with their pseudonyms. URL, Error and the captured
+// Body may hold the same identifiers in clear text and are dropped, Route still names the endpoint.
+// Reason, UserAgent and bodies kept in a BodyStore are left as they are.
+func (p *Pseudonymizer) Record(ctx context.Context, record *AuditRecord) error {
+	userID, err := p.UserID(ctx, record.TenantID, record.UserID)
+	if err != nil {
+		return err
+	}
+	clientIP, err := p.ClientIP(ctx, record.TenantID, record.ClientIP)
+	if err != nil {
+		return err
+	}
+	record.UserID, record.ClientIP = userID, clientIP
+	record.URL, record.Error, record.Body = "", "", nil
+
+	return nil
+}
+
+// Forget deletes the key of the tenant, making its historic pseudonyms unlinkable. New identifiers
+// get pseudonyms of a new key. Other processes may keep using their cached key for up to CacheTTL.
+func (p *Pseudonymizer) Forget(ctx context.Context, tenantID uuid.UUID) error {
+	p.mu.Lock()
+	delete(p.cache, tenantID)
+	p.mu.Unlock()
+
+	if err := p.store.DeleteKey(ctx, tenantID); err != nil {
+		return fmt.Errorf("pseudonymizer - failed to delete key of tenant %s: %w", tenantID, err)
+	}
+
+	return nil
+}
+
+func (p *Pseudonymizer) pseudonym(ctx context.Context, tenantID uuid.UUID, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if tenantID == uuid.Nil {
+		return "", ErrPseudonymWithoutTenant
+	}
+
+	key, err := p.key(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (p *Pseudonymizer) key(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+	p.mu.Lock()
+	cached, ok := p.cache[tenantID]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := p.store.Key(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("pseudonymizer - failed to get key of tenant %s: %w", tenantID, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("pseudonymizer - key of tenant %s is empty", tenantID)
+	}
+
+	if p.ttl > 0 {
+		p.mu.Lock()
+		p.cache[tenantID] = cachedPseudonymKey{key: key, expires: time.Now().Add(p.ttl)}
+		p.mu.Unlock()
+	}
+
+	return key, nil
+}
+
+// PseudonymizingSink pseudonymizes audit records before writing them to another sink.
+// Wrap a HashChainSink rather than the other way around, so chain hashes cover the pseudonyms.
+type PseudonymizingSink struct {
+	sink          AuditSink
+	pseudonymizer *Pseudonymizer
+}
+
+// NewPseudonymizingSink returns a sink pseudonymizing audit records before writing them to sink.
+func NewPseudonymizingSink(sink AuditSink, pseudonymizer *Pseudonymizer) *PseudonymizingSink {
+	return &PseudonymizingSink{sink: sink, pseudonymizer: pseudonymizer}
+}
+
+func (s *PseudonymizingSink) Write(ctx context.Context, record AuditRecord) error {
+	if err := s.pseudonymizer.Record(ctx, &record); err != nil {
+		return err
+	}
+
+	return s.sink.Write(ctx, record)
+}
+
+// WriteBatch pseudonymizes the records and writes them in a single batch if the sink supports it.
+func (s *PseudonymizingSink) WriteBatch(ctx context.Context, records []AuditRecord) error {
+	pseudonymized := make([]AuditRecord, len(records))
+	for i, r := range records {
+		if err := s.pseudonymizer.Record(ctx, &r); err != nil {
+			return err
+		}
+		pseudonymized[i] = r
+	}
+
+	if bs, ok := s.sink.(BatchAuditSink); ok {
+		return bs.WriteBatch(ctx, pseudonymized)
+	}
+	for _, r := range pseudonymized {
+		if err := s.sink.Write(ctx, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MemoryKeyStore keeps random tenant keys in memory. Keys are lost on restart,
+// so pseudonyms are stable only within a process, use it for tests and local development.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[uuid.UUID][]byte
+}
+
+// NewMemoryKeyStore returns an empty in-memory key store.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[uuid.UUID][]byte)}
+}
+
+func (s *MemoryKeyStore) Key(_ context.Context, tenantID uuid.UUID) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[tenantID]; ok {
+		return key, nil
+	}
+
+	key, err := newPseudonymKey()
+	if err != nil {
+		return nil, err
+	}
+	s.keys[tenantID] = key
+
+	return key, nil
+}
+
+func (s *MemoryKeyStore) DeleteKey(_ context.Context, tenantID uuid.UUID) error {
+	s.mu.Lock()
+	delete(s.keys, tenantID)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// DynamoDBKeyStoreAPI is the part of the DynamoDB client used by DynamoDBKeyStore.
+type DynamoDBKeyStoreAPI interface {
+	GetItem(ctx context.Context, params *awsdynamodb.GetItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *awsdynamodb.PutItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *awsdynamodb.DeleteItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.DeleteItemOutput, error)
+}
+
+// DynamoDBKeyStore keeps tenant keys in a DynamoDB table with partition key tenant_id (S)
+// and the key in the binary attribute key. The table must be kept apart from audit and usage
+// storage, and should be encrypted with a customer managed KMS key.
+type DynamoDBKeyStore struct {
+	client DynamoDBKeyStoreAPI
+	table  string
+}
+
+// NewDynamoDBKeyStore returns a key store backed by the DynamoDB table.
+func NewDynamoDBKeyStore(client DynamoDBKeyStoreAPI, table string) *DynamoDBKeyStore {
+	return &DynamoDBKeyStore{client: client, table: table}
+}
+
+func (s *DynamoDBKeyStore) Key(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+	key, err := s.get(ctx, tenantID)
+	if err != nil || key != nil {
+		return key, err
+	}
+
+	if key, err = newPseudonymKey(); err != nil {
+		return nil, err
+	}
+	_, err = s.client.PutItem(ctx, &awsdynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"tenant_id": &types.AttributeValueMemberS{Value: tenantID.String()},
+			"key":       &types.AttributeValueMemberB{Value: key},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(tenant_id)"),
+	})
+
+	// another process created the key in the meantime
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return s.get(ctx, tenantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (s *DynamoDBKeyStore) DeleteKey(ctx context.Context, tenantID uuid.UUID) error {
+	_, err := s.client.DeleteItem(ctx, &awsdynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       map[string]types.AttributeValue{"tenant_id": &types.AttributeValueMemberS{Value: tenantID.String()}},
+	})
+
+	return err
+}
+
+// get returns the stored key of the tenant, or nil if there is none.
+func (s *DynamoDBKeyStore) get(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+	out, err := s.client.GetItem(ctx, &awsdynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]types.AttributeValue{"tenant_id": &types.AttributeValueMemberS{Value: tenantID.String()}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := out.Item["key"].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, nil
+	}
+
+	return key.Value, nil
+}
+
+func newPseudonymKey() ([]byte, error) {
+	key := make([]byte, pseudonymKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,248 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type pseudonymKeyStoreFunc func(ctx context.Context, tenantID uuid.UUID) ([]byte, error)
+
+func (f pseudonymKeyStoreFunc) Key(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+	return f(ctx, tenantID)
+}
+
+func (f pseudonymKeyStoreFunc) DeleteKey(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func newTestPseudonymizer(t *testing.T) *Pseudonymizer {
+	p, err := NewPseudonymizer(PseudonymizerConfig{KeyStore: NewMemoryKeyStore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestNewPseudonymizer(t *testing.T) {
+	_, err := NewPseudonymizer(PseudonymizerConfig{})
+	assert.EqualError(t, err, "pseudonymizer - key store is nil")
+}
+
+func TestPseudonymizer(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPseudonymizer(t)
+	otherTenant := uuid.New()
+
+	user, err := p.UserID(ctx, tenantID, userID)
+	assert.NoError(t, err)
+	assert.Len(t, user, 64)
+	assert.NotContains(t, user, userID)
+
+	again, _ := p.UserID(ctx, tenantID, userID)
+	assert.Equal(t, user, again)
+
+	other, _ := p.UserID(ctx, otherTenant, userID)
+	assert.NotEqual(t, user, other)
+
+	ip, _ := p.ClientIP(ctx, tenantID, userID)
+	assert.NotEqual(t, user, ip)
+
+	empty, _ := p.UserID(ctx, tenantID, "")
+	assert.Equal(t, "", empty)
+
+	_, err = p.UserID(ctx, uuid.Nil, userID)
+	assert.ErrorIs(t, err, ErrPseudonymWithoutTenant)
+
+	assert.NoError(t, p.Forget(ctx, tenantID))
+	forgotten, _ := p.UserID(ctx, tenantID, userID)
+	assert.NotEqual(t, user, forgotten)
+	stillOther, _ := p.UserID(ctx, otherTenant, userID)
+	assert.Equal(t, other, stillOther)
+}
+
+func TestPseudonymizer_key(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      pseudonymKeyStoreFunc
+		cacheTTL   time.Duration
+		wantCalls  int
+		wantErrMsg string
+	}{
+		{
+			name: "ShouldCacheKey",
+			store: func(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+				return []byte("foo_key"), nil
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "ShouldNotCacheKeyWithNegativeTTL",
+			store: func(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+				return []byte("foo_key"), nil
+			},
+			cacheTTL:  -1,
+			wantCalls: 2,
+		},
+		{
+			name: "ShouldErrorOnKeyStore",
+			store: func(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+				return nil, fmt.Errorf("foo store")
+			},
+			wantCalls:  2,
+			wantErrMsg: fmt.Sprintf("pseudonymizer - failed to get key of tenant %s: foo store", tenantID),
+		},
+		{
+			name: "ShouldErrorOnEmptyKey",
+			store: func(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+				return nil, nil
+			},
+			wantCalls:  2,
+			wantErrMsg: fmt.Sprintf("pseudonymizer - key of tenant %s is empty", tenantID),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			p, _ := NewPseudonymizer(PseudonymizerConfig{
+				KeyStore: pseudonymKeyStoreFunc(func(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+					calls++
+					return tt.store(ctx, tenantID)
+				}),
+				CacheTTL: tt.cacheTTL,
+			})
+
+			for i := 0; i < 2; i++ {
+				_, err := p.UserID(context.Background(), tenantID, userID)
+				if tt.wantErrMsg != "" {
+					assert.EqualError(t, err, tt.wantErrMsg)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestPseudonymizingSink(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPseudonymizer(t)
+	wantUser, _ := p.UserID(ctx, tenantID, auditRecord.UserID)
+	wantIP, _ := p.ClientIP(ctx, tenantID, auditRecord.ClientIP)
+
+	record := auditRecord
+	record.Error = "foo error of " + userID
+	record.Body = &CapturedBody{Request: `{"user":"` + userID + `"}`}
+
+	want := auditRecord
+	want.UserID, want.ClientIP = wantUser, wantIP
+	want.URL, want.Error, want.Body = "", "", nil
+
+	t.Run("ShouldPseudonymizeRecord", func(t *testing.T) {
+		sink := &recordingSink{}
+		assert.NoError(t, NewPseudonymizingSink(sink, p).Write(ctx, record))
+		assert.Equal(t, [][]AuditRecord{{want}}, sink.batches)
+	})
+	t.Run("ShouldPseudonymizeBatch", func(t *testing.T) {
+		sink := &recordingBatchSink{}
+		assert.NoError(t, NewPseudonymizingSink(sink, p).WriteBatch(ctx, []AuditRecord{record, record}))
+		assert.Equal(t, [][]AuditRecord{{want, want}}, sink.batches)
+	})
+	t.Run("ShouldWriteBatchOneByOne", func(t *testing.T) {
+		sink := &recordingSink{}
+		assert.NoError(t, NewPseudonymizingSink(sink, p).WriteBatch(ctx, []AuditRecord{record, record}))
+		assert.Equal(t, [][]AuditRecord{{want}, {want}}, sink.batches)
+	})
+	t.Run("ShouldNotWriteWithoutKey", func(t *testing.T) {
+		failing, _ := NewPseudonymizer(PseudonymizerConfig{
+			KeyStore: pseudonymKeyStoreFunc(func(ctx context.Context, tenantID uuid.UUID) ([]byte, error) {
+				return nil, fmt.Errorf("foo store")
+			}),
+		})
+		sink := &recordingSink{}
+		assert.Error(t, NewPseudonymizingSink(sink, failing).Write(ctx, auditRecord))
+		assert.Empty(t, sink.batches)
+	})
+	t.Run("ShouldNotWriteWithoutTenant", func(t *testing.T) {
+		withoutTenant := auditRecord
+		withoutTenant.TenantID = uuid.Nil
+		sink := &recordingSink{}
+		assert.ErrorIs(t, NewPseudonymizingSink(sink, p).Write(ctx, withoutTenant), ErrPseudonymWithoutTenant)
+		assert.Empty(t, sink.batches)
+	})
+}
+
+// fakeKeyTable implements DynamoDBKeyStoreAPI on top of a map. If conflict is set, puts fail
+// as if another writer stored conflict first.
+type fakeKeyTable struct {
+	items    map[string][]byte
+	conflict []byte
+	puts     int
+}
+
+func (f *fakeKeyTable) GetItem(_ context.Context, params *awsdynamodb.GetItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.GetItemOutput, error) {
+	id := params.Key["tenant_id"].(*dynamotypes.AttributeValueMemberS).Value
+	key, ok := f.items[id]
+	if !ok {
+		return &awsdynamodb.GetItemOutput{}, nil
+	}
+
+	return &awsdynamodb.GetItemOutput{Item: map[string]dynamotypes.AttributeValue{
+		"tenant_id": params.Key["tenant_id"],
+		"key":       &dynamotypes.AttributeValueMemberB{Value: key},
+	}}, nil
+}
+
+func (f *fakeKeyTable) PutItem(_ context.Context, params *awsdynamodb.PutItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.PutItemOutput, error) {
+	f.puts++
+	id := params.Item["tenant_id"].(*dynamotypes.AttributeValueMemberS).Value
+	if f.conflict != nil {
+		f.items[id] = f.conflict
+		return nil, &dynamotypes.ConditionalCheckFailedException{Message: aws.String("foo conflict")}
+	}
+	f.items[id] = params.Item["key"].(*dynamotypes.AttributeValueMemberB).Value
+
+	return &awsdynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeKeyTable) DeleteItem(_ context.Context, params *awsdynamodb.DeleteItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.DeleteItemOutput, error) {
+	delete(f.items, params.Key["tenant_id"].(*dynamotypes.AttributeValueMemberS).Value)
+
+	return &awsdynamodb.DeleteItemOutput{}, nil
+}
+
+func TestDynamoDBKeyStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ShouldCreateKeyOnce", func(t *testing.T) {
+		table := &fakeKeyTable{items: map[string][]byte{}}
+		store := NewDynamoDBKeyStore(table, "keys")
+
+		key, err := store.Key(ctx, tenantID)
+		assert.NoError(t, err)
+		assert.Len(t, key, 32)
+		again, _ := store.Key(ctx, tenantID)
+		assert.Equal(t, key, again)
+		assert.Equal(t, 1, table.puts)
+
+		assert.NoError(t, store.DeleteKey(ctx, tenantID))
+		recreated, _ := store.Key(ctx, tenantID)
+		assert.NotEqual(t, key, recreated)
+	})
+	t.Run("ShouldUseKeyOfConcurrentWriter", func(t *testing.T) {
+		table := &fakeKeyTable{items: map[string][]byte{}, conflict: []byte("foo_key")}
+
+		key, err := NewDynamoDBKeyStore(table, "keys").Key(ctx, tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("foo_key"), key)
+	})
+}
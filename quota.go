@@ -0,0 +1,344 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// Quota response headers. Remaining values account for the current request, limits and remaining
+// values of unlimited plans are not sent.
+const (
+	HeaderQuotaRequestsLimit     = "X-Quota-Requests-Limit"
+	HeaderQuotaRequestsRemaining = "X-Quota-Requests-Remaining"
+	HeaderQuotaComputeLimit      = "X-Quota-Compute-Limit"     // GB-seconds
+	HeaderQuotaComputeRemaining  = "X-Quota-Compute-Remaining" // GB-seconds
+	HeaderQuotaReset             = "X-Quota-Reset"             // seconds until the quota period ends
+	HeaderQuotaWarning           = "X-Quota-Warning"           // limits past the soft limit, e.g. "requests, compute"
+)
+
+// QuotaPlan holds the monthly limits of the plan of a tenant. Zero limits are unlimited.
+type QuotaPlan struct {
+	Name           string
+	Requests       int64   // requests per month
+	ComputeSeconds float64 // GB-seconds per month, i.e. duration in seconds × memory in GB
+	// SoftLimit is the fraction of a limit past which responses carry the X-Quota-Warning header,
+	// e.g. 0.8. Optional, no warnings are sent when 0.
+	SoftLimit float64
+}
+
+// QuotaPlanProvider returns the plan of a tenant.
+type QuotaPlanProvider interface {
+	Plan(ctx context.Context, tenantID uuid.UUID) (QuotaPlan, error)
+}
+
+// QuotaPlanFunc is a QuotaPlanProvider function.
+type QuotaPlanFunc func(ctx context.Context, tenantID uuid.UUID) (QuotaPlan, error)
+
+func (f QuotaPlanFunc) Plan(ctx context.Context, tenantID uuid.UUID) (QuotaPlan, error) {
+	return f(ctx, tenantID)
+}
+
+// QuotaUsage is the consumption of a tenant in a quota period.
+type QuotaUsage struct {
+	Requests       int64
+	ComputeSeconds float64 // GB-seconds
+}
+
+// QuotaCounterStore keeps the consumption of tenants per period, e.g. 2024-06.
+type QuotaCounterStore interface {
+	// Get returns the consumption of the tenant in the period, zero if there is none.
+	Get(ctx context.Context, tenantID uuid.UUID, period string) (QuotaUsage, error)
+	// Add atomically adds usage to the consumption of the tenant in the period.
+	Add(ctx context.Context, tenantID uuid.UUID, period string, usage QuotaUsage) error
+}
+
+// QuotaStatus is the consumption of a tenant against its plan, before the current request.
+type QuotaStatus struct {
+	TenantID uuid.UUID
+	Plan     QuotaPlan
+	Usage    QuotaUsage
+	Reset    time.Time // end of the quota period
+}
+
+// QuotaConfig defines the config for QuotaWithConfig middleware.
+type QuotaConfig struct {
+	Plans    QuotaPlanProvider
+	Counters QuotaCounterStore
+	MemoryMB int // Optional, detected with DetectMemoryMB when 0, see UsageConfig.MemoryMB
+	// ExceededStatusCode is the status of requests of tenants past a limit. Optional, defaults to
+	// 429 Too Many Requests, e.g. 402 Payment Required asks tenants to upgrade their plan.
+	ExceededStatusCode int
+	// BillingPolicy and BillingFunc decide which requests count against the quota, as for UsageConfig.
+	// Optional, defaults to BillAll.
+	BillingPolicy BillingPolicy
+	BillingFunc   BillingFunc
+	// OnSoftLimit is called for requests of tenants past the soft limit of their plan, e.g. to notify them.
+	// Optional.
+	OnSoftLimit func(c echo.Context, status QuotaStatus)
+	// FailClosed rejects requests with 503 when the plan or consumption of the tenant cannot be read.
+	// Optional, such requests are let through and the failure is logged.
+	FailClosed bool
+}
+
+// QuotaWithConfig returns a middleware enforcing monthly request and compute limits of tenant plans.
+// Requests of tenants past a limit are rejected with cfg.ExceededStatusCode, other requests are counted
+// once handled. Consumption is read before and added after the request, so concurrent requests may
+// exceed a limit by the number of requests in flight. Requests without tenant are not limited.
+func QuotaWithConfig(cfg QuotaConfig) echo.MiddlewareFunc {
+	mw, err := cfg.toMiddleware()
+	if err != nil {
+		panic(err)
+	}
+
+	return mw
+}
+
+func (q *QuotaConfig) toMiddleware() (echo.MiddlewareFunc, error) {
+	if q.Plans == nil {
+		return nil, fmt.Errorf("quota middleware - plan provider is nil")
+	}
+	if q.Counters == nil {
+		return nil, fmt.Errorf("quota middleware - counter store is nil")
+	}
+	if q.ExceededStatusCode == 0 {
+		q.ExceededStatusCode = http.StatusTooManyRequests
+	}
+	if q.ExceededStatusCode < http.StatusBadRequest || q.ExceededStatusCode > 599 {
+		return nil, fmt.Errorf("quota middleware - exceeded status code %d is not an error status", q.ExceededStatusCode)
+	}
+	if err := q.BillingPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("quota middleware - %w", err)
+	}
+	memoryMB, err := usageMemoryMB(q.MemoryMB)
+	if err != nil {
+		return nil, fmt.Errorf("quota middleware - %w", err)
+	}
+	billing := usageBilling{policy: q.BillingPolicy, billingFunc: q.BillingFunc}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cc, ok := c.(*Context)
+			if !ok {
+				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("cannot cast context to custom context"))
+			}
+			if cc.TenantID == uuid.Nil {
+				return next(cc)
+			}
+
+			ctx := cc.Request().Context()
+			startTime := time.Now()
+			period, reset := quotaPeriod(startTime)
+			status, err := q.status(ctx, cc.TenantID, period)
+			if err != nil {
+				if q.FailClosed {
+					return echo.NewHTTPError(http.StatusServiceUnavailable, fmt.Errorf("quota cannot be checked"))
+				}
+				log.Errorf("quota middleware - failed to check quota of tenant %s: %v", cc.TenantID, err)
+				return next(cc)
+			}
+			status.Reset = reset
+
+			header := cc.Response().Header()
+			status.setHeaders(header, startTime)
+			if exceeded := status.exceeded(); exceeded != "" {
+				header.Set(echo.HeaderRetryAfter, header.Get(HeaderQuotaReset))
+				return echo.NewHTTPError(q.ExceededStatusCode, fmt.Errorf("%s quota of plan %s is exceeded", exceeded, status.Plan.Name))
+			}
+			if warnings := status.warnings(); len(warnings) > 0 {
+				header.Set(HeaderQuotaWarning, strings.Join(warnings, ", "))
+				if q.OnSoftLimit != nil {
+					q.OnSoftLimit(cc, status)
+				}
+			}
+
+			handlerError := next(cc)
+
+			if billing.bills(responseStatus(cc, handlerError), handlerError) {
+				usage := QuotaUsage{
+					Requests:       1,
+					ComputeSeconds: time.Since(startTime).Seconds() * float64(memoryMB) / 1024,
+				}
+				// the response is already written, counting failures must not change the outcome of the request
+				if err := q.Counters.Add(ctx, cc.TenantID, period, usage); err != nil {
+					log.Errorf("quota middleware - failed to count usage of tenant %s: %v", cc.TenantID, err)
+				}
+			}
+
+			return handlerError
+		}
+	}, nil
+}
+
+func (q *QuotaConfig) status(ctx context.Context, tenantID uuid.UUID, period string) (QuotaStatus, error) {
+	plan, err := q.Plans.Plan(ctx, tenantID)
+	if err != nil {
+		return QuotaStatus{}, fmt.Errorf("failed to get plan: %w", err)
+	}
+	usage, err := q.Counters.Get(ctx, tenantID, period)
+	if err != nil {
+		return QuotaStatus{}, fmt.Errorf("failed to get consumption: %w", err)
+	}
+
+	return QuotaStatus{TenantID: tenantID, Plan: plan, Usage: usage}, nil
+}
+
+// exceeded returns the limit the tenant is past, or "" if none. Limits are reached once consumed,
+// so the current request would exceed them.
+func (s QuotaStatus) exceeded() string {
+	if s.Plan.Requests > 0 && s.Usage.Requests >= s.Plan.Requests {
+		return "requests"
+	}
+	if s.Plan.ComputeSeconds > 0 && s.Usage.ComputeSeconds >= s.Plan.ComputeSeconds {
+		return "compute"
+	}
+
+	return ""
+}
+
+// warnings returns the limits past the soft limit of the plan.
+func (s QuotaStatus) warnings() []string {
+	if s.Plan.SoftLimit <= 0 {
+		return nil
+	}
+
+	var warnings []string
+	if s.Plan.Requests > 0 && float64(s.Usage.Requests+1) >= s.Plan.SoftLimit*float64(s.Plan.Requests) {
+		warnings = append(warnings, "requests")
+	}
+	if s.Plan.ComputeSeconds > 0 && s.Usage.ComputeSeconds >= s.Plan.SoftLimit*s.Plan.ComputeSeconds {
+		warnings = append(warnings, "compute")
+	}
+
+	return warnings
+}
+
+func (s QuotaStatus) setHeaders(header http.Header, now time.Time) {
+	if s.Plan.Requests > 0 {
+		header.Set(HeaderQuotaRequestsLimit, strconv.FormatInt(s.Plan.Requests, 10))
+		header.Set(HeaderQuotaRequestsRemaining, strconv.FormatInt(max(s.Plan.Requests-s.Usage.Requests-1, 0), 10))
+	}
+	if s.Plan.ComputeSeconds > 0 {
+		header.Set(HeaderQuotaComputeLimit, strconv.FormatFloat(s.Plan.ComputeSeconds, 'f', -1, 64))
+		header.Set(HeaderQuotaComputeRemaining, strconv.FormatFloat(max(s.Plan.ComputeSeconds-s.Usage.ComputeSeconds, 0), 'f', 3, 64))
+	}
+	header.Set(HeaderQuotaReset, strconv.Itoa(int(s.Reset.Sub(now).Seconds())))
+}
+
+// quotaPeriod returns the month of t in UTC, e.g. 2024-06, and the time it ends.
+func quotaPeriod(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+// MemoryQuotaCounters keeps consumption in memory. Counters are lost on restart and not shared
+// between instances, use it for tests, local development and single instance services.
+type MemoryQuotaCounters struct {
+	mu       sync.Mutex
+	counters map[uuid.UUID]map[string]QuotaUsage
+}
+
+// NewMemoryQuotaCounters returns empty in-memory counters.
+func NewMemoryQuotaCounters() *MemoryQuotaCounters {
+	return &MemoryQuotaCounters{counters: make(map[uuid.UUID]map[string]QuotaUsage)}
+}
+
+func (m *MemoryQuotaCounters) Get(_ context.Context, tenantID uuid.UUID, period string) (QuotaUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters[tenantID][period], nil
+}
+
+func (m *MemoryQuotaCounters) Add(_ context.Context, tenantID uuid.UUID, period string, usage QuotaUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	periods, ok := m.counters[tenantID]
+	if !ok {
+		periods = make(map[string]QuotaUsage)
+		m.counters[tenantID] = periods
+	}
+	counted := periods[period]
+	counted.Requests += usage.Requests
+	counted.ComputeSeconds += usage.ComputeSeconds
+	periods[period] = counted
+
+	return nil
+}
+
+// DynamoDBQuotaCountersAPI is the part of the DynamoDB client used by DynamoDBQuotaCounters.
+type DynamoDBQuotaCountersAPI interface {
+	GetItem(ctx context.Context, params *awsdynamodb.GetItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.GetItemOutput, error)
+	UpdateItem(ctx context.Context, params *awsdynamodb.UpdateItemInput, optFns ...func(*awsdynamodb.Options)) (*awsdynamodb.UpdateItemOutput, error)
+}
+
+// DynamoDBQuotaCounters keeps consumption in a DynamoDB table with partition key tenant_id (S) and
+// sort key period (S), counted with atomic ADD updates of the number attributes requests and compute_seconds.
+type DynamoDBQuotaCounters struct {
+	client DynamoDBQuotaCountersAPI
+	table  string
+}
+
+// NewDynamoDBQuotaCounters returns counters backed by the DynamoDB table.
+func NewDynamoDBQuotaCounters(client DynamoDBQuotaCountersAPI, table string) *DynamoDBQuotaCounters {
+	return &DynamoDBQuotaCounters{client: client, table: table}
+}
+
+func (s *DynamoDBQuotaCounters) Get(ctx context.Context, tenantID uuid.UUID, period string) (QuotaUsage, error) {
+	out, err := s.client.GetItem(ctx, &awsdynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key:       quotaCounterKey(tenantID, period),
+	})
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+
+	var usage QuotaUsage
+	if n, ok := out.Item["requests"].(*types.AttributeValueMemberN); ok {
+		if usage.Requests, err = strconv.ParseInt(n.Value, 10, 64); err != nil {
+			return QuotaUsage{}, fmt.Errorf("malformed requests counter: %w", err)
+		}
+	}
+	if n, ok := out.Item["compute_seconds"].(*types.AttributeValueMemberN); ok {
+		if usage.ComputeSeconds, err = strconv.ParseFloat(n.Value, 64); err != nil {
+			return QuotaUsage{}, fmt.Errorf("malformed compute_seconds counter: %w", err)
+		}
+	}
+
+	return usage, nil
+}
+
+func (s *DynamoDBQuotaCounters) Add(ctx context.Context, tenantID uuid.UUID, period string, usage QuotaUsage) error {
+	_, err := s.client.UpdateItem(ctx, &awsdynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              quotaCounterKey(tenantID, period),
+		UpdateExpression: aws.String("ADD requests :requests, compute_seconds :compute_seconds"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":requests":        &types.AttributeValueMemberN{Value: strconv.FormatInt(usage.Requests, 10)},
+			":compute_seconds": &types.AttributeValueMemberN{Value: strconv.FormatFloat(usage.ComputeSeconds, 'f', -1, 64)},
+		},
+	})
+
+	return err
+}
+
+func quotaCounterKey(tenantID uuid.UUID, period string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"tenant_id": &types.AttributeValueMemberS{Value: tenantID.String()},
+		"period":    &types.AttributeValueMemberS{Value: period},
+	}
+}
@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaConfig_toMiddleware(t *testing.T) {
+	plan := QuotaPlan{Name: "basic", Requests: 100, ComputeSeconds: 50, SoftLimit: 0.8}
+	period, _ := quotaPeriod(time.Now())
+
+	tests := []struct {
+		name        string
+		cfg         QuotaConfig
+		plan        QuotaPlan
+		planErr     error
+		usage       QuotaUsage
+		tenantID    uuid.UUID
+		status      int
+		wantErrMsg  string
+		wantHeaders map[string]string
+		wantSoft    bool
+		wantCounted int64
+	}{
+		{
+			name:       "ShouldErrorOnNilPlans",
+			cfg:        QuotaConfig{Counters: NewMemoryQuotaCounters(), MemoryMB: 1024},
+			wantErrMsg: "quota middleware - plan provider is nil",
+		},
+		{
+			name:       "ShouldErrorOnNilCounters",
+			cfg:        QuotaConfig{Plans: QuotaPlanFunc(nil), MemoryMB: 1024},
+			wantErrMsg: "quota middleware - counter store is nil",
+		},
+		{
+			name:       "ShouldErrorOnSuccessExceededStatus",
+			cfg:        QuotaConfig{ExceededStatusCode: http.StatusOK},
+			wantErrMsg: "quota middleware - exceeded status code 200 is not an error status",
+		},
+		{
+			name:       "ShouldErrorOnUnknownBillingPolicy",
+			cfg:        QuotaConfig{BillingPolicy: 42},
+			wantErrMsg: "quota middleware - unknown billing policy 42",
+		},
+		{
+			name:     "ShouldCountRequestWithinQuota",
+			plan:     plan,
+			usage:    QuotaUsage{Requests: 10, ComputeSeconds: 5},
+			tenantID: tenantID,
+			wantHeaders: map[string]string{
+				HeaderQuotaRequestsLimit:     "100",
+				HeaderQuotaRequestsRemaining: "89",
+				HeaderQuotaComputeLimit:      "50",
+				HeaderQuotaComputeRemaining:  "45.000",
+				HeaderQuotaWarning:           "",
+			},
+			wantCounted: 11,
+		},
+		{
+			name:     "ShouldWarnPastSoftLimit",
+			plan:     plan,
+			usage:    QuotaUsage{Requests: 79, ComputeSeconds: 45},
+			tenantID: tenantID,
+			wantHeaders: map[string]string{
+				HeaderQuotaRequestsRemaining: "20",
+				HeaderQuotaWarning:           "requests, compute",
+			},
+			wantSoft:    true,
+			wantCounted: 80,
+		},
+		{
+			name:       "ShouldRejectExceededRequests",
+			plan:       plan,
+			usage:      QuotaUsage{Requests: 100},
+			tenantID:   tenantID,
+			wantErrMsg: "code=429, message=requests quota of plan basic is exceeded",
+			wantHeaders: map[string]string{
+				HeaderQuotaRequestsRemaining: "0",
+				HeaderQuotaComputeRemaining:  "50.000",
+			},
+			wantCounted: 100,
+		},
+		{
+			name:       "ShouldRejectExceededComputeWithConfiguredStatus",
+			cfg:        QuotaConfig{ExceededStatusCode: http.StatusPaymentRequired},
+			plan:       plan,
+			usage:      QuotaUsage{Requests: 10, ComputeSeconds: 50.5},
+			tenantID:   tenantID,
+			wantErrMsg: "code=402, message=compute quota of plan basic is exceeded",
+			wantHeaders: map[string]string{
+				HeaderQuotaComputeRemaining: "0.000",
+			},
+			wantCounted: 10,
+		},
+		{
+			name:     "ShouldNotLimitUnlimitedPlan",
+			plan:     QuotaPlan{Name: "enterprise"},
+			usage:    QuotaUsage{Requests: 1000000},
+			tenantID: tenantID,
+			wantHeaders: map[string]string{
+				HeaderQuotaRequestsLimit:     "",
+				HeaderQuotaRequestsRemaining: "",
+			},
+			wantCounted: 1000001,
+		},
+		{
+			name:        "ShouldNotCountUnbilledRequest",
+			cfg:         QuotaConfig{BillingPolicy: BillSuccessesAndClientErrors},
+			plan:        plan,
+			tenantID:    tenantID,
+			status:      http.StatusBadGateway,
+			wantCounted: 0,
+		},
+		{
+			name:        "ShouldNotLimitRequestWithoutTenant",
+			plan:        QuotaPlan{Name: "basic", Requests: 1},
+			usage:       QuotaUsage{Requests: 1},
+			wantHeaders: map[string]string{HeaderQuotaRequestsLimit: ""},
+			wantCounted: 1,
+		},
+		{
+			name:        "ShouldFailOpenOnPlanError",
+			planErr:     fmt.Errorf("foo plans"),
+			tenantID:    tenantID,
+			wantHeaders: map[string]string{HeaderQuotaRequestsLimit: ""},
+			wantCounted: 0,
+		},
+		{
+			name:       "ShouldFailClosedOnPlanError",
+			cfg:        QuotaConfig{FailClosed: true},
+			planErr:    fmt.Errorf("foo plans"),
+			tenantID:   tenantID,
+			wantErrMsg: "code=503, message=quota cannot be checked",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := NewMemoryQuotaCounters()
+			assert.NoError(t, counters.Add(context.Background(), tenantID, period, tt.usage))
+
+			cfg := tt.cfg
+			if cfg.Plans == nil && cfg.Counters == nil {
+				cfg.Plans = QuotaPlanFunc(func(_ context.Context, id uuid.UUID) (QuotaPlan, error) {
+					assert.Equal(t, tenantID, id)
+					return tt.plan, tt.planErr
+				})
+				cfg.Counters = counters
+				cfg.MemoryMB = 1024
+			}
+			soft := false
+			cfg.OnSoftLimit = func(_ echo.Context, status QuotaStatus) {
+				soft = true
+				assert.Equal(t, tt.usage, status.Usage)
+			}
+
+			h, err := cfg.toMiddleware()
+			if err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			rec := httptest.NewRecorder()
+			cc := &Context{Context: e.NewContext(req, rec), TenantID: tt.tenantID}
+
+			err = h(func(c echo.Context) error {
+				if tt.status != 0 {
+					return echo.NewHTTPError(tt.status, "foo upstream")
+				}
+				return c.String(http.StatusOK, "Hello, World!")
+			})(cc)
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				assert.Equal(t, rec.Header().Get(HeaderQuotaReset), rec.Header().Get(echo.HeaderRetryAfter))
+			} else if tt.status == 0 {
+				assert.NoError(t, err)
+			}
+			for header, want := range tt.wantHeaders {
+				assert.Equal(t, want, rec.Header().Get(header), header)
+			}
+			assert.Equal(t, tt.wantSoft, soft)
+
+			counted, _ := counters.Get(context.Background(), tenantID, period)
+			assert.Equal(t, tt.wantCounted, counted.Requests)
+		})
+	}
+}
+
+func TestQuotaStatus_reset(t *testing.T) {
+	period, reset := quotaPeriod(time.Date(2024, 12, 31, 23, 0, 0, 0, time.FixedZone("CET", 60*60)))
+	assert.Equal(t, "2024-12", period)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), reset)
+
+	header := http.Header{}
+	QuotaStatus{Reset: reset}.setHeaders(header, reset.Add(-90*time.Second))
+	assert.Equal(t, "90", header.Get(HeaderQuotaReset))
+}
+
+// fakeCounterTable implements DynamoDBQuotaCountersAPI on top of a map, applying ADD updates.
+type fakeCounterTable struct {
+	items map[string]map[string]dynamotypes.AttributeValue
+}
+
+func (f *fakeCounterTable) GetItem(_ context.Context, params *awsdynamodb.GetItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.GetItemOutput, error) {
+	return &awsdynamodb.GetItemOutput{Item: f.items[f.key(params.Key)]}, nil
+}
+
+func (f *fakeCounterTable) UpdateItem(_ context.Context, params *awsdynamodb.UpdateItemInput, _ ...func(*awsdynamodb.Options)) (*awsdynamodb.UpdateItemOutput, error) {
+	if *params.UpdateExpression != "ADD requests :requests, compute_seconds :compute_seconds" {
+		return nil, fmt.Errorf("unexpected update %s", *params.UpdateExpression)
+	}
+
+	key := f.key(params.Key)
+	item, ok := f.items[key]
+	if !ok {
+		item = map[string]dynamotypes.AttributeValue{}
+		f.items[key] = item
+	}
+	for _, attribute := range []string{"requests", "compute_seconds"} {
+		var counted float64
+		if n, ok := item[attribute].(*dynamotypes.AttributeValueMemberN); ok {
+			counted, _ = strconv.ParseFloat(n.Value, 64)
+		}
+		added, _ := strconv.ParseFloat(params.ExpressionAttributeValues[":"+attribute].(*dynamotypes.AttributeValueMemberN).Value, 64)
+		item[attribute] = &dynamotypes.AttributeValueMemberN{Value: strconv.FormatFloat(counted+added, 'f', -1, 64)}
+	}
+
+	return &awsdynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeCounterTable) key(key map[string]dynamotypes.AttributeValue) string {
+	return key["tenant_id"].(*dynamotypes.AttributeValueMemberS).Value + "#" + key["period"].(*dynamotypes.AttributeValueMemberS).Value
+}
+
+func TestDynamoDBQuotaCounters(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ShouldAddCounters", func(t *testing.T) {
+		counters := NewDynamoDBQuotaCounters(&fakeCounterTable{items: map[string]map[string]dynamotypes.AttributeValue{}}, "quotas")
+
+		usage, err := counters.Get(ctx, tenantID, "2024-06")
+		assert.NoError(t, err)
+		assert.Equal(t, QuotaUsage{}, usage)
+
+		assert.NoError(t, counters.Add(ctx, tenantID, "2024-06", QuotaUsage{Requests: 1, ComputeSeconds: 1.5}))
+		assert.NoError(t, counters.Add(ctx, tenantID, "2024-06", QuotaUsage{Requests: 1, ComputeSeconds: 0.25}))
+		assert.NoError(t, counters.Add(ctx, tenantID, "2024-07", QuotaUsage{Requests: 1}))
+
+		usage, err = counters.Get(ctx, tenantID, "2024-06")
+		assert.NoError(t, err)
+		assert.Equal(t, QuotaUsage{Requests: 2, ComputeSeconds: 1.75}, usage)
+	})
+	t.Run("ShouldErrorOnMalformedCounter", func(t *testing.T) {
+		table := &fakeCounterTable{items: map[string]map[string]dynamotypes.AttributeValue{
+			tenantID.String() + "#2024-06": {"requests": &dynamotypes.AttributeValueMemberN{Value: "1.5"}},
+		}}
+
+		_, err := NewDynamoDBQuotaCounters(table, "quotas").Get(ctx, tenantID, "2024-06")
+		assert.EqualError(t, err, `malformed requests counter: strconv.ParseInt: parsing "1.5": invalid syntax`)
+	})
+}
@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactedKeys are keys holding secrets or personal data, masked wherever they appear in captured bodies.
+var DefaultRedactedKeys = []string{
+	"password",
+	"secret",
+	"token",
+	"access_token",
+	"refresh_token",
+	"id_token",
+	"authorization",
+	"api_key",
+	"apikey",
+	"client_secret",
+	"ssn",
+	"national_id",
+	"card_number",
+	"credit_card",
+	"cvv",
+	"iban",
+	"email",
+	"phone",
+	"date_of_birth",
+}
+
+// DefaultRedactionMask replaces redacted values.
+const DefaultRedactionMask = "[REDACTED]"
+
+// RedactionConfig defines which values are masked in captured bodies.
+type RedactionConfig struct {
+	// Paths are dot separated JSON paths, e.g. `customer.address.street`.
+	// `*` matches any object key or array element, e.g. `items.*.owner`. Optional.
+	Paths []string
+	// Keys are masked at any depth, compared case-insensitively. Optional, defaults to DefaultRedactedKeys.
+	Keys []string
+	// Mask replaces redacted values. Optional, defaults to DefaultRedactionMask.
+	Mask string
+}
+
+type redactor struct {
+	paths [][]string
+	keys  map[string]struct{}
+	mask  string
+}
+
+func newRedactor(cfg RedactionConfig) *redactor {
+	if len(cfg.Keys) == 0 {
+		cfg.Keys = DefaultRedactedKeys
+	}
+	if cfg.Mask == "" {
+		cfg.Mask = DefaultRedactionMask
+	}
+
+	r := &redactor{keys: make(map[string]struct{}), mask: cfg.Mask}
+	for _, k := range cfg.Keys {
+		r.keys[strings.ToLower(k)] = struct{}{}
+	}
+	for _, p := range cfg.Paths {
+		r.paths = append(r.paths, strings.Split(p, "."))
+	}
+
+	return r
+}
+
+// redactJSON returns the JSON document with redacted values masked.
+func (r *redactor) redactJSON(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	doc = r.redactKeys(doc)
+	for _, p := range r.paths {
+		doc = r.redactPath(doc, p)
+	}
+
+	return json.Marshal(doc)
+}
+
+// redactForm returns the url encoded form with redacted keys masked.
+func (r *redactor) redactForm(body []byte) ([]byte, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range values {
+		if r.isRedactedKey(k) || r.isRedactedPath(k) {
+			for i := range v {
+				v[i] = r.mask
+			}
+		}
+	}
+
+	return []byte(values.Encode()), nil
+}
+
+func (r *redactor) redactKeys(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if r.isRedactedKey(k) {
+				t[k] = r.mask
+				continue
+			}
+			t[k] = r.redactKeys(child)
+		}
+	case []any:
+		for i, child := range t {
+			t[i] = r.redactKeys(child)
+		}
+	}
+
+	return v
+}
+
+func (r *redactor) redactPath(v any, path []string) any {
+	if len(path) == 0 {
+		return r.mask
+	}
+
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if path[0] == "*" || path[0] == k {
+				t[k] = r.redactPath(child, path[1:])
+			}
+		}
+	case []any:
+		for i, child := range t {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				t[i] = r.redactPath(child, path[1:])
+			}
+		}
+	}
+
+	return v
+}
+
+func (r *redactor) isRedactedKey(k string) bool {
+	_, ok := r.keys[strings.ToLower(k)]
+	return ok
+}
+
+func (r *redactor) isRedactedPath(k string) bool {
+	for _, p := range r.paths {
+		if len(p) == 1 && (p[0] == "*" || p[0] == k) {
+			return true
+		}
+	}
+
+	return false
+}
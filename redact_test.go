@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor_redactJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        RedactionConfig
+		body       string
+		want       string
+		wantErrMsg string
+	}{
+		{
+			name: "ShouldMaskDefaultKeysAtAnyDepth",
+			body: `{"name":"foo","Password":"bar","owner":{"email":"foo@bar.com","tags":[{"token":"baz"}]}}`,
+			want: `{"name":"foo","owner":{"email":"[REDACTED]","tags":[{"token":"[REDACTED]"}]},"Password":"[REDACTED]"}`,
+		},
+		{
+			name: "ShouldMaskPathsWithWildcards",
+			cfg: RedactionConfig{
+				Keys:  []string{"secret"},
+				Paths: []string{"customer.address", "items.*.owner", "items.0.id"},
+				Mask:  "***",
+			},
+			body: `{"customer":{"address":{"street":"foo"},"name":"bar"},"items":[{"id":1,"owner":"foo"},{"id":2,"owner":"bar"}]}`,
+			want: `{"customer":{"address":"***","name":"bar"},"items":[{"id":"***","owner":"***"},{"id":2,"owner":"***"}]}`,
+		},
+		{
+			name: "ShouldKeepNumbersIntact",
+			body: `{"amount":12345678901234567890}`,
+			want: `{"amount":12345678901234567890}`,
+		},
+		{
+			name:       "ShouldErrorOnInvalidJSON",
+			body:       `{"name":`,
+			wantErrMsg: "unexpected EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newRedactor(tt.cfg).redactJSON([]byte(tt.body))
+			if err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestRedactor_redactForm(t *testing.T) {
+	cfg := RedactionConfig{Paths: []string{"card"}}
+
+	got, err := newRedactor(cfg).redactForm([]byte("name=foo&password=bar&card=1234"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "card=%5BREDACTED%5D&name=foo&password=%5BREDACTED%5D", string(got))
+}
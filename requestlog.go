@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+type loggerKey struct{}
+
+// LoggerFrom returns the request logger stored in ctx by RequestLogger middleware,
+// carrying request and identity fields, or slog.Default() outside of a logged request.
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// RequestLoggerConfig defines the config for RequestLoggerWithConfig middleware.
+type RequestLoggerConfig struct {
+	Handler slog.Handler // Optional, defaults to the handler of slog.Default()
+}
+
+// RequestLogger returns a middleware logging every request with slog.Default().
+func RequestLogger() echo.MiddlewareFunc {
+	return RequestLoggerWithConfig(RequestLoggerConfig{})
+}
+
+// RequestLoggerWithConfig returns a middleware logging a structured line for every request with its ID,
+// identity, route, status, latency and error. 5xx responses are logged as errors, 4xx as warnings.
+// The request logger is available to handlers through LoggerFrom and c.Logger(), so their logs
+// are correlated with the request. Identity fields are added once NewCustomContextMiddleware ran.
+func RequestLoggerWithConfig(cfg RequestLoggerConfig) echo.MiddlewareFunc {
+	mw, err := cfg.toMiddleware()
+	if err != nil {
+		panic(err)
+	}
+
+	return mw
+}
+
+func (r *RequestLoggerConfig) toMiddleware() (echo.MiddlewareFunc, error) {
+	if r.Handler == nil {
+		r.Handler = slog.Default().Handler()
+	}
+	base := slog.New(r.Handler)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			startTime := time.Now()
+
+			requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+			if requestID == "" {
+				requestID = c.Request().Header.Get(echo.HeaderXRequestID)
+			}
+			setLogger(c, base.With(
+				slog.String("request_id", requestID),
+				slog.String("method", c.Request().Method),
+				slog.String("route", c.Path()),
+			))
+			if cc, ok := c.(*Context); ok {
+				cc.enrichLogger()
+			}
+
+			handlerError := next(c)
+
+			status := responseStatus(c, handlerError)
+			level := slog.LevelInfo
+			switch {
+			case status >= http.StatusInternalServerError:
+				level = slog.LevelError
+			case status >= http.StatusBadRequest:
+				level = slog.LevelWarn
+			}
+
+			attrs := []slog.Attr{
+				slog.String("uri", c.Request().RequestURI),
+				slog.Int("status", status),
+				slog.Duration("latency", time.Since(startTime)),
+			}
+			if handlerError != nil {
+				attrs = append(attrs, slog.String("error", handlerError.Error()))
+			}
+
+			// the custom context shares the request with c, so its identity fields are picked up here
+			LoggerFrom(c.Request().Context()).LogAttrs(c.Request().Context(), level, "request", attrs...)
+
+			return handlerError
+		}
+	}, nil
+}
+
+// enrichLogger adds identity fields to the request logger, if the request is logged.
+func (c *Context) enrichLogger() {
+	logger, ok := c.Request().Context().Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		return
+	}
+
+	setLogger(c, logger.With(
+		slog.String("tenant_id", c.TenantID.String()),
+		slog.String("tenant_name", c.TenantName),
+		slog.String("sub", c.Sub),
+	))
+}
+
+// setLogger stores logger in the request context and as the echo logger of c.
+func setLogger(c echo.Context, logger *slog.Logger) {
+	c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), loggerKey{}, logger)))
+	c.SetLogger(&slogEchoLogger{logger: logger, level: log.DEBUG})
+}
+
+// slogEchoLogger implements echo.Logger on top of a slog.Logger, so c.Logger() writes request logs.
+type slogEchoLogger struct {
+	logger *slog.Logger
+	prefix string
+	level  log.Lvl
+}
+
+func (l *slogEchoLogger) Output() io.Writer {
+	return io.Discard
+}
+
+// SetOutput is a no-op, the output is defined by the slog handler.
+func (l *slogEchoLogger) SetOutput(io.Writer) {}
+
+func (l *slogEchoLogger) Prefix() string {
+	return l.prefix
+}
+
+func (l *slogEchoLogger) SetPrefix(p string) {
+	l.prefix = p
+}
+
+func (l *slogEchoLogger) Level() log.Lvl {
+	return l.level
+}
+
+func (l *slogEchoLogger) SetLevel(v log.Lvl) {
+	l.level = v
+}
+
+// SetHeader is a no-op, the format is defined by the slog handler.
+func (l *slogEchoLogger) SetHeader(string) {}
+
+func (l *slogEchoLogger) log(lvl log.Lvl, level slog.Level, msg string, attrs ...slog.Attr) {
+	if lvl < l.level {
+		return
+	}
+	l.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+func jsonAttrs(j log.JSON) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(j))
+	for k, v := range j {
+		attrs = append(attrs, slog.Any(k, v))
+	}
+
+	return attrs
+}
+
+func (l *slogEchoLogger) Print(i ...interface{}) {
+	l.log(log.INFO, slog.LevelInfo, fmt.Sprint(i...))
+}
+
+func (l *slogEchoLogger) Printf(format string, args ...interface{}) {
+	l.log(log.INFO, slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *slogEchoLogger) Printj(j log.JSON) {
+	l.log(log.INFO, slog.LevelInfo, "", jsonAttrs(j)...)
+}
+
+func (l *slogEchoLogger) Debug(i ...interface{}) {
+	l.log(log.DEBUG, slog.LevelDebug, fmt.Sprint(i...))
+}
+
+func (l *slogEchoLogger) Debugf(format string, args ...interface{}) {
+	l.log(log.DEBUG, slog.LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *slogEchoLogger) Debugj(j log.JSON) {
+	l.log(log.DEBUG, slog.LevelDebug, "", jsonAttrs(j)...)
+}
+
+func (l *slogEchoLogger) Info(i ...interface{}) {
+	l.log(log.INFO, slog.LevelInfo, fmt.Sprint(i...))
+}
+
+func (l *slogEchoLogger) Infof(format string, args ...interface{}) {
+	l.log(log.INFO, slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *slogEchoLogger) Infoj(j log.JSON) {
+	l.log(log.INFO, slog.LevelInfo, "", jsonAttrs(j)...)
+}
+
+func (l *slogEchoLogger) Warn(i ...interface{}) {
+	l.log(log.WARN, slog.LevelWarn, fmt.Sprint(i...))
+}
+
+func (l *slogEchoLogger) Warnf(format string, args ...interface{}) {
+	l.log(log.WARN, slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *slogEchoLogger) Warnj(j log.JSON) {
+	l.log(log.WARN, slog.LevelWarn, "", jsonAttrs(j)...)
+}
+
+func (l *slogEchoLogger) Error(i ...interface{}) {
+	l.log(log.ERROR, slog.LevelError, fmt.Sprint(i...))
+}
+
+func (l *slogEchoLogger) Errorf(format string, args ...interface{}) {
+	l.log(log.ERROR, slog.LevelError, fmt.Sprintf(format, args...))
+}
+
+func (l *slogEchoLogger) Errorj(j log.JSON) {
+	l.log(log.ERROR, slog.LevelError, "", jsonAttrs(j)...)
+}
+
+func (l *slogEchoLogger) Fatal(i ...interface{}) {
+	l.logger.Error(fmt.Sprint(i...))
+	os.Exit(1)
+}
+
+func (l *slogEchoLogger) Fatalj(j log.JSON) {
+	l.logger.LogAttrs(context.Background(), slog.LevelError, "", jsonAttrs(j)...)
+	os.Exit(1)
+}
+
+func (l *slogEchoLogger) Fatalf(format string, args ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l *slogEchoLogger) Panic(i ...interface{}) {
+	msg := fmt.Sprint(i...)
+	l.logger.Error(msg)
+	panic(msg)
+}
+
+func (l *slogEchoLogger) Panicj(j log.JSON) {
+	l.logger.LogAttrs(context.Background(), slog.LevelError, "", jsonAttrs(j)...)
+	panic(j)
+}
+
+func (l *slogEchoLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	l.logger.Error(msg)
+	panic(msg)
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLoggerConfig_toMiddleware(t *testing.T) {
+	claims := &JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: userID},
+		Rsc:              tenantID.String() + ":foo_tenant",
+	}
+	identity := fmt.Sprintf(`"tenant_id":%q,"tenant_name":"foo_tenant","sub":%q,`, tenantID, userID)
+	request := fmt.Sprintf(`"request_id":%q,"method":"GET","route":"/workflows/:id",`, requestID)
+
+	tests := []struct {
+		name          string
+		authenticated bool
+		handler       echo.HandlerFunc
+		want          []string
+	}{
+		{
+			name: "ShouldLogSuccessAsInfo",
+			handler: func(c echo.Context) error {
+				c.Logger().Infof("foo %d", 42)
+				LoggerFrom(c.Request().Context()).Debug("bar", slog.Int("n", 1))
+				return c.String(http.StatusOK, "Hello, World!")
+			},
+			want: []string{
+				`{"level":"INFO","msg":"foo 42",` + request[:len(request)-1] + `}`,
+				`{"level":"DEBUG","msg":"bar",` + request + `"n":1}`,
+				`{"level":"INFO","msg":"request",` + request + `"uri":"/workflows/42?foo=bar","status":200}`,
+			},
+		},
+		{
+			name: "ShouldLogClientErrorAsWarning",
+			handler: func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusNotFound, "foo_error")
+			},
+			want: []string{
+				`{"level":"WARN","msg":"request",` + request + `"uri":"/workflows/42?foo=bar","status":404,"error":"code=404, message=foo_error"}`,
+			},
+		},
+		{
+			name: "ShouldLogServerErrorAsError",
+			handler: func(c echo.Context) error {
+				return fmt.Errorf("foo error")
+			},
+			want: []string{
+				`{"level":"ERROR","msg":"request",` + request + `"uri":"/workflows/42?foo=bar","status":500,"error":"foo error"}`,
+			},
+		},
+		{
+			name:          "ShouldAddIdentityOfCustomContext",
+			authenticated: true,
+			handler: func(c echo.Context) error {
+				c.Logger().Warn("foo")
+				return c.NoContent(http.StatusNoContent)
+			},
+			want: []string{
+				`{"level":"WARN","msg":"foo",` + request + identity[:len(identity)-1] + `}`,
+				`{"level":"INFO","msg":"request",` + request + identity + `"uri":"/workflows/42?foo=bar","status":204}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.TimeKey || a.Key == "latency" {
+						return slog.Attr{}
+					}
+					return a
+				},
+			})
+
+			e := echo.New()
+			e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					c.Response().Header().Set(echo.HeaderXRequestID, requestID.String())
+					return next(c)
+				}
+			})
+			e.Use(RequestLoggerWithConfig(RequestLoggerConfig{Handler: handler}))
+
+			h := tt.handler
+			if tt.authenticated {
+				h = func(c echo.Context) error {
+					c.Set("user", &jwt.Token{Claims: claims})
+					return NewCustomContextMiddleware(tt.handler)(c)
+				}
+			}
+			e.GET("/workflows/:id", h)
+
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/workflows/42?foo=bar", nil))
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if !assert.Len(t, lines, len(tt.want)) {
+				return
+			}
+			for i, want := range tt.want {
+				assert.JSONEq(t, want, lines[i])
+			}
+		})
+	}
+}
+
+func TestLoggerFrom(t *testing.T) {
+	assert.Equal(t, slog.Default(), LoggerFrom(context.Background()))
+}
@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ScopeClaim holds OAuth scopes from a token. It accepts both a space separated string,
+// as defined for the `scope` claim in RFC 8693, and a list of strings as some issuers emit for `scp`.
+type ScopeClaim []string
+
+func (s *ScopeClaim) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = strings.Fields(str)
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("scope claim must be a string or a list of strings")
+	}
+	*s = list
+
+	return nil
+}
+
+// Scopes returns scopes granted by both `scope` and `scp` claims, without duplicates.
+func (a JWTClaims) Scopes() []string {
+	var scopes []string
+	seen := make(map[string]struct{})
+	for _, claim := range []ScopeClaim{a.Scope, a.Scp} {
+		for _, s := range claim {
+			if _, ok := seen[s]; ok || s == "" {
+				continue
+			}
+			seen[s] = struct{}{}
+			scopes = append(scopes, s)
+		}
+	}
+
+	return scopes
+}
+
+// HasScope reports whether the token used for the request was granted the scope.
+func (c *Context) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScopeMatch defines how ScopeConfig.Scopes are matched against granted scopes.
+type ScopeMatch int
+
+const (
+	// ScopeMatchAll requires every configured scope to be granted.
+	ScopeMatchAll ScopeMatch = iota
+	// ScopeMatchAny requires at least one of configured scopes to be granted.
+	ScopeMatchAny
+)
+
+// ScopeConfig defines the config for RequireScopesWithConfig middleware.
+type ScopeConfig struct {
+	Scopes []string
+	Match  ScopeMatch // Optional
+	Realm  string     // Optional
+}
+
+// RequireScopes returns a middleware that rejects requests unless all given scopes were granted.
+func RequireScopes(scopes ...string) echo.MiddlewareFunc {
+	return RequireScopesWithConfig(ScopeConfig{Scopes: scopes})
+}
+
+// RequireAnyScope returns a middleware that rejects requests unless at least one of given scopes was granted.
+func RequireAnyScope(scopes ...string) echo.MiddlewareFunc {
+	return RequireScopesWithConfig(ScopeConfig{Scopes: scopes, Match: ScopeMatchAny})
+}
+
+// RequireScopesWithConfig returns a middleware for OAuth scope based authorization.
+// Requests with insufficient scopes are rejected with 403 and a `WWW-Authenticate` header
+// carrying the `insufficient_scope` error as defined in RFC 6750.
+func RequireScopesWithConfig(cfg ScopeConfig) echo.MiddlewareFunc {
+	mw, err := cfg.toMiddleware()
+	if err != nil {
+		panic(err)
+	}
+
+	return mw
+}
+
+func (s *ScopeConfig) toMiddleware() (echo.MiddlewareFunc, error) {
+	if len(s.Scopes) == 0 {
+		return nil, fmt.Errorf("scope middleware - scopes are empty")
+	}
+	if s.Match != ScopeMatchAll && s.Match != ScopeMatchAny {
+		return nil, fmt.Errorf("scope middleware - unknown scope match %d", s.Match)
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cc, ok := c.(*Context)
+			if !ok {
+				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("cannot cast context to custom context"))
+			}
+
+			if !s.granted(cc) {
+				MarkSecurityEvent(cc, SecurityEvent{
+					Type:          SecurityEventPermissionDenied,
+					Reason:        "token has insufficient scope",
+					MissingScopes: s.missing(cc),
+				})
+				cc.Response().Header().Set(echo.HeaderWWWAuthenticate, s.challenge())
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Errorf("token has insufficient scope"))
+			}
+
+			return next(cc)
+		}
+	}, nil
+}
+
+func (s *ScopeConfig) granted(cc *Context) bool {
+	matched := 0
+	for _, scope := range s.Scopes {
+		if cc.HasScope(scope) {
+			matched++
+		}
+	}
+
+	if s.Match == ScopeMatchAny {
+		return matched > 0
+	}
+
+	return matched == len(s.Scopes)
+}
+
+func (s *ScopeConfig) missing(cc *Context) []string {
+	var missing []string
+	for _, scope := range s.Scopes {
+		if !cc.HasScope(scope) {
+			missing = append(missing, scope)
+		}
+	}
+
+	return missing
+}
+
+func (s *ScopeConfig) challenge() string {
+	var b strings.Builder
+	b.WriteString("Bearer ")
+	if s.Realm != "" {
+		fmt.Fprintf(&b, "realm=%q, ", s.Realm)
+	}
+	fmt.Fprintf(&b, "error=%q, scope=%q", "insufficient_scope", strings.Join(s.Scopes, " "))
+
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTClaims_Scopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		want       []string
+		wantErrMsg string
+	}{
+		{
+			name:    "ShouldParseSpaceSeparatedScope",
+			payload: `{"scope":"workflows:read workflows:write"}`,
+			want:    []string{"workflows:read", "workflows:write"},
+		},
+		{
+			name:    "ShouldParseScpList",
+			payload: `{"scp":["workflows:read","workflows:write"]}`,
+			want:    []string{"workflows:read", "workflows:write"},
+		},
+		{
+			name:    "ShouldMergeScopeAndScp",
+			payload: `{"scope":"workflows:read","scp":"workflows:read usage:read"}`,
+			want:    []string{"workflows:read", "usage:read"},
+		},
+		{
+			name:    "ShouldReturnNilWithoutScopes",
+			payload: `{"sub":"foo"}`,
+		},
+		{
+			name:       "ShouldErrorOnInvalidScope",
+			payload:    `{"scope":1}`,
+			wantErrMsg: "scope claim must be a string or a list of strings",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims JWTClaims
+			if err := json.Unmarshal([]byte(tt.payload), &claims); err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.Equal(t, tt.want, claims.Scopes())
+		})
+	}
+}
+
+func TestScopeConfig_toMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           ScopeConfig
+		scopes        []string
+		wantErrMsg    string
+		wantChallenge string
+	}{
+		{
+			name:       "ShouldErrorOnEmptyScopes",
+			wantErrMsg: "scope middleware - scopes are empty",
+		},
+		{
+			name:       "ShouldErrorOnUnknownMatch",
+			cfg:        ScopeConfig{Scopes: []string{"workflows:read"}, Match: 5},
+			wantErrMsg: "scope middleware - unknown scope match 5",
+		},
+		{
+			name:          "ShouldRejectMissingScopeOnMatchAll",
+			cfg:           ScopeConfig{Scopes: []string{"workflows:read", "workflows:write"}},
+			scopes:        []string{"workflows:read"},
+			wantErrMsg:    "code=403, message=token has insufficient scope",
+			wantChallenge: `Bearer error="insufficient_scope", scope="workflows:read workflows:write"`,
+		},
+		{
+			name:   "ShouldAllowAllScopesOnMatchAll",
+			cfg:    ScopeConfig{Scopes: []string{"workflows:read", "workflows:write"}},
+			scopes: []string{"workflows:write", "workflows:read"},
+		},
+		{
+			name:          "ShouldRejectNoScopeOnMatchAny",
+			cfg:           ScopeConfig{Scopes: []string{"workflows:read", "workflows:write"}, Match: ScopeMatchAny, Realm: "grasp"},
+			scopes:        []string{"usage:read"},
+			wantErrMsg:    "code=403, message=token has insufficient scope",
+			wantChallenge: `Bearer realm="grasp", error="insufficient_scope", scope="workflows:read workflows:write"`,
+		},
+		{
+			name:   "ShouldAllowOneScopeOnMatchAny",
+			cfg:    ScopeConfig{Scopes: []string{"workflows:read", "workflows:write"}, Match: ScopeMatchAny},
+			scopes: []string{"workflows:write"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := tt.cfg.toMiddleware()
+			if err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+
+			e := echo.New()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			rec := httptest.NewRecorder()
+			ctx := e.NewContext(req, rec)
+			cc := &Context{
+				Context:  ctx,
+				TenantID: tenantID,
+				Scopes:   tt.scopes,
+			}
+
+			err = h(func(c echo.Context) error {
+				return c.String(http.StatusOK, "Hello, World!")
+			})(cc)
+			assert.Equal(t, tt.wantChallenge, rec.Header().Get(echo.HeaderWWWAuthenticate))
+			if err != nil {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.Equal(t, http.StatusOK, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// Audit record event types. Regular requests are recorded by Dispatch as AuditEventRequest,
+// the others are security events recorded by SecurityEventsWithConfig.
+const (
+	AuditEventRequest                 = "request"
+	SecurityEventAuthenticationFailed = "authentication_failed"
+	SecurityEventPermissionDenied     = "permission_denied"
+	SecurityEventTokenRevoked         = "token_revoked"
+	SecurityEventMalformedClaims      = "malformed_claims"
+)
+
+// ErrTokenRevoked is meant to be wrapped by token parsing or revocation checks rejecting revoked tokens,
+// so that the rejection is recorded as SecurityEventTokenRevoked.
+var ErrTokenRevoked = errors.New("token is revoked")
+
+// securityEventKey is the echo context key under which middlewares leave a SecurityEvent.
+const securityEventKey = "middleware.security_event"
+
+// SecurityEvent describes why a request was rejected.
+type SecurityEvent struct {
+	Type          string
+	Reason        string
+	MissingRoles  []string
+	MissingScopes []string
+
+	tenantID uuid.UUID
+	userID   string
+}
+
+// MarkSecurityEvent marks the request as rejected for a security reason.
+// The event is recorded by SecurityEventsWithConfig middleware once the request is done.
+func MarkSecurityEvent(c echo.Context, event SecurityEvent) {
+	if cc, ok := c.(*Context); ok {
+		event.tenantID, event.userID = cc.TenantID, cc.Sub
+	}
+	c.Set(securityEventKey, &event)
+}
+
+// SecurityEventsConfig defines the config for SecurityEventsWithConfig middleware.
+type SecurityEventsConfig struct {
+	Sink       AuditSink
+	IPResolver *ClientIPResolver // Optional, defaults to a resolver trusting DefaultTrustedProxies
+	Retention  time.Duration     // Optional, sets AuditRecord.TTL, records are kept when zero
+}
+
+// SecurityEventsWithConfig returns a middleware recording failed authentication, permission denials,
+// revoked token use and malformed claims to the audit sink. It has to be registered before JWT, custom context
+// and permission middlewares, so it sees requests they reject.
+func SecurityEventsWithConfig(cfg SecurityEventsConfig) echo.MiddlewareFunc {
+	mw, err := cfg.toMiddleware()
+	if err != nil {
+		panic(err)
+	}
+
+	return mw
+}
+
+func (s *SecurityEventsConfig) toMiddleware() (echo.MiddlewareFunc, error) {
+	if s.Sink == nil {
+		return nil, fmt.Errorf("security events middleware - audit sink is nil")
+	}
+	if s.IPResolver == nil {
+		resolver, err := NewClientIPResolver()
+		if err != nil {
+			return nil, err
+		}
+		s.IPResolver = resolver
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			startTime := time.Now()
+			handlerError := next(c)
+
+			event := securityEventFrom(c, handlerError)
+			if event == nil {
+				return handlerError
+			}
+
+			record := AuditRecord{
+				Version:       AuditRecordVersion,
+				EventType:     event.Type,
+				ID:            uuid.New(),
+				RequestID:     requestIDFrom(c),
+				TenantID:      event.tenantID,
+				UserID:        event.userID,
+				URL:           c.Request().URL.String(),
+				Route:         c.Path(),
+				Method:        c.Request().Method,
+				UserAgent:     c.Request().UserAgent(),
+				StatusCode:    responseStatus(c, handlerError),
+				Reason:        event.Reason,
+				MissingRoles:  event.MissingRoles,
+				MissingScopes: event.MissingScopes,
+				CreatedAt:     startTime.UTC(),
+				ProcessTime:   time.Since(startTime),
+				TTL:           expiresAt(startTime, s.Retention),
+			}
+			if ip := s.IPResolver.ClientIP(c.Request()); ip.IsValid() {
+				record.ClientIP = ip.String()
+			}
+			if record.TenantID == uuid.Nil && record.UserID == "" {
+				record.TenantID, record.UserID = identityFromToken(c)
+			}
+
+			if err := s.Sink.Write(c.Request().Context(), record); err != nil {
+				log.Errorf("security events middleware - failed to write audit record: %v", err)
+			}
+
+			return handlerError
+		}
+	}, nil
+}
+
+// securityEventFrom returns the event marked by inner middlewares, or derives one from the error status.
+func securityEventFrom(c echo.Context, err error) *SecurityEvent {
+	if event, ok := c.Get(securityEventKey).(*SecurityEvent); ok {
+		return event
+	}
+
+	if errors.Is(err, ErrTokenRevoked) {
+		return &SecurityEvent{Type: SecurityEventTokenRevoked, Reason: err.Error()}
+	}
+
+	var he *echo.HTTPError
+	if !errors.As(err, &he) {
+		return nil
+	}
+
+	switch {
+	case he.Code == http.StatusUnauthorized:
+		return &SecurityEvent{Type: SecurityEventAuthenticationFailed, Reason: err.Error()}
+	case he.Code == http.StatusForbidden:
+		return &SecurityEvent{Type: SecurityEventPermissionDenied, Reason: err.Error()}
+	}
+
+	return nil
+}
+
+func requestIDFrom(c echo.Context) uuid.UUID {
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	if id == "" {
+		id = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+	requestID, _ := uuid.Parse(id)
+
+	return requestID
+}
+
+// identityFromToken returns tenant and subject of the token stored by JWT middleware, if any.
+func identityFromToken(c echo.Context) (uuid.UUID, string) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return uuid.Nil, ""
+	}
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok {
+		return uuid.Nil, ""
+	}
+	tenantID, _, _ := parseResource(claims.Rsc)
+
+	return tenantID, claims.Subject
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityEventsConfig_toMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      any
+		handler    echo.HandlerFunc
+		wantErrMsg string
+		want       *AuditRecord
+	}{
+		{
+			name: "ShouldNotRecordSuccess",
+			handler: func(c echo.Context) error {
+				return c.String(http.StatusOK, "Hello, World!")
+			},
+		},
+		{
+			name: "ShouldNotRecordOtherErrors",
+			handler: func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusNotFound, "foo_error")
+			},
+			wantErrMsg: "code=404, message=foo_error",
+		},
+		{
+			name: "ShouldRecordUnauthorized",
+			handler: func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired jwt")
+			},
+			wantErrMsg: "code=401, message=invalid or expired jwt",
+			want: &AuditRecord{
+				EventType:  SecurityEventAuthenticationFailed,
+				StatusCode: http.StatusUnauthorized,
+				Reason:     "code=401, message=invalid or expired jwt",
+			},
+		},
+		{
+			name: "ShouldRecordRevokedToken",
+			handler: func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired jwt").SetInternal(fmt.Errorf("foo: %w", ErrTokenRevoked))
+			},
+			wantErrMsg: "code=401, message=invalid or expired jwt, internal=foo: token is revoked",
+			want: &AuditRecord{
+				EventType:  SecurityEventTokenRevoked,
+				StatusCode: http.StatusUnauthorized,
+				Reason:     "code=401, message=invalid or expired jwt, internal=foo: token is revoked",
+			},
+		},
+		{
+			name: "ShouldRecordWrappedRevokedToken",
+			handler: func(c echo.Context) error {
+				return fmt.Errorf("foo: %w", ErrTokenRevoked)
+			},
+			wantErrMsg: "foo: token is revoked",
+			want: &AuditRecord{
+				EventType:  SecurityEventTokenRevoked,
+				StatusCode: http.StatusInternalServerError,
+				Reason:     "foo: token is revoked",
+			},
+		},
+		{
+			name:  "ShouldRecordMalformedClaims",
+			token: &jwt.Token{Claims: &JWTClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: userID}, Rsc: "foo_bar:tenant"}},
+			handler: NewCustomContextMiddleware(func(c echo.Context) error {
+				return nil
+			}),
+			wantErrMsg: "malformed rsc claim: invalid UUID length: 7",
+			want: &AuditRecord{
+				EventType:  SecurityEventMalformedClaims,
+				UserID:     userID,
+				StatusCode: http.StatusInternalServerError,
+				Reason:     "malformed rsc claim: invalid UUID length: 7",
+			},
+		},
+		{
+			name: "ShouldRecordMissingScopes",
+			handler: func(c echo.Context) error {
+				cc := &Context{Context: c, TenantID: tenantID, Sub: userID, Scopes: []string{"workflows:read"}}
+				return RequireScopes("workflows:read", "workflows:write")(func(c echo.Context) error {
+					return nil
+				})(cc)
+			},
+			wantErrMsg: "code=403, message=token has insufficient scope",
+			want: &AuditRecord{
+				EventType:     SecurityEventPermissionDenied,
+				TenantID:      tenantID,
+				UserID:        userID,
+				StatusCode:    http.StatusForbidden,
+				Reason:        "token has insufficient scope",
+				MissingScopes: []string{"workflows:write"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := &SecurityEventsConfig{Sink: NewJSONLinesSink(&buf)}
+
+			h, err := cfg.toMiddleware()
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			e := echo.New()
+
+			req := httptest.NewRequest(http.MethodGet, "/workflows", nil)
+			req.RemoteAddr = "1.1.1.1:1234"
+			rec := httptest.NewRecorder()
+			rec.Header().Set(echo.HeaderXRequestID, requestID.String())
+
+			ctx := e.NewContext(req, rec)
+			if tt.token != nil {
+				ctx.Set("user", tt.token)
+			}
+
+			err = h(tt.handler)(ctx)
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if tt.want == nil {
+				assert.Empty(t, buf.String())
+				return
+			}
+
+			var got AuditRecord
+			if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &got)) {
+				return
+			}
+			assert.NotEqual(t, uuid.Nil, got.ID)
+
+			want := *tt.want
+			want.Version = AuditRecordVersion
+			want.ID = got.ID
+			want.RequestID = requestID
+			want.URL = "/workflows"
+			want.Method = http.MethodGet
+			want.ClientIP = "1.1.1.1"
+			want.CreatedAt = got.CreatedAt
+			want.ProcessTime = got.ProcessTime
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestPermissionFilterConfig_securityEvent(t *testing.T) {
+	ts, err := setupTestServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("[{\"name\":\"service.workflow.user\"}]"))
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ts.Close()
+
+	cfg := &PermissionFilterConfig{Roles: defaultRoles, Url: ts.URL}
+	h, err := cfg.toMiddleware()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer foo_token")
+	ctx := e.NewContext(req, httptest.NewRecorder())
+	cc := &Context{Context: ctx, TenantID: tenantID, Sub: userID}
+
+	assert.EqualError(t, h(func(c echo.Context) error { return nil })(cc), "code=403, message=user has not enough entitlements")
+
+	event, ok := ctx.Get(securityEventKey).(*SecurityEvent)
+	if assert.True(t, ok) {
+		assert.Equal(t, SecurityEventPermissionDenied, event.Type)
+		assert.Equal(t, []string{"service.workflow.admin"}, event.MissingRoles)
+		assert.Equal(t, tenantID, event.tenantID)
+		assert.Equal(t, userID, event.userID)
+	}
+}
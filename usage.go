@@ -2,39 +2,74 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
 	"github.com/grasp-labs/go-libs/aws/sqs"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 )
 
+// ErrUnknownUsageUnit is returned by Context.RecordUsage for units missing from the catalogue of the product.
+var ErrUnknownUsageUnit = errors.New("unknown usage unit")
+
 // UsageConfig defines the config for UsageWithConfig middleware.
 type UsageConfig struct {
 	ProductID uuid.UUID
-	MemoryMB  string
+	MemoryMB  int // Optional, detected with DetectMemoryMB when 0
+	// Pseudonymizer pseudonymizes UsageEvent.Subject, the legacy format gets it as user_id attribute.
+	// Optional, the legacy format reports no user when nil.
+	Pseudonymizer *Pseudonymizer
+	// Emitter sends usage as UsageEvent JSON bodies in background batches. Optional, usage is sent
+	// during the request in the legacy attribute format when nil.
+	Emitter *UsageEmitter
+	// Units is the catalogue of units handlers may record with Context.RecordUsage, per product.
+	// Optional, handlers can record no units when the product has none.
+	Units map[uuid.UUID][]string
+	// ProductRoutes bills routes of a group to a product other than ProductID. Optional, the longest
+	// matching prefix wins and routes matching none are billed to ProductID.
+	ProductRoutes []UsageProductRoute
+	// WorkflowNameFunc names the workflow of a request. Optional, defaults to the route pattern,
+	// e.g. /workflows/:id, keeping IDs of the path out of workflow names.
+	WorkflowNameFunc func(c echo.Context) string
+	// BillingPolicy decides which requests are billed by their final status. Optional, defaults to BillAll.
+	// Usage not billed is sent with UsageEvent.Billing set to UsageNotBilled, or not at all in the legacy format.
+	BillingPolicy BillingPolicy
+	// BillingFunc decides which requests are billed instead of BillingPolicy. Optional.
+	BillingFunc BillingFunc
+}
+
+// UsageProductRoute bills the routes under Prefix to ProductID.
+type UsageProductRoute struct {
+	Prefix    string // echo route pattern prefix, e.g. /exports matches /exports and /exports/:id
+	ProductID uuid.UUID
+}
+
+func (r UsageProductRoute) matches(route string) bool {
+	prefix := strings.TrimSuffix(r.Prefix, "/")
+	return route == prefix || strings.HasPrefix(route, prefix+"/")
 }
 
 // UsageWithConfig returns a middleware for tracing service usage in api applications.
+// Usage is sent to the queue of the building mode, or of queueName if given, unless cfg.Emitter is set.
 func UsageWithConfig(ctx context.Context, cfg UsageConfig, queueName ...string) echo.MiddlewareFunc {
-	sqsQueueName := ""
-	switch os.Getenv("BUILDING_MODE") {
-	case "test":
-		sqsQueueName = "daas-service-cost-handler-usage-queue-test"
-	case "dev":
-		sqsQueueName = "daas-service-cost-handler-usage-queue-dev"
-	case "prod":
-		sqsQueueName = "daas-service-cost-handler-usage-queue-prod"
-	default:
-		panic("unknown building mode!")
-	}
-	if len(queueName) != 0 {
-		sqsQueueName = queueName[0]
+	if cfg.Emitter != nil {
+		mw, err := cfg.toMiddleware(nil)
+		if err != nil {
+			panic(err)
+		}
+
+		return mw
+	}
+
+	sqsQueueName, err := usageQueueName(queueName...)
+	if err != nil {
+		panic(err)
 	}
 	client, err := sqs.NewClient(ctx, sqsQueueName)
 	if err != nil {
@@ -53,8 +88,33 @@ func (c *UsageConfig) toMiddleware(sqsClient sqs.ClientSqs) (echo.MiddlewareFunc
 	if c.ProductID == uuid.Nil {
 		return nil, fmt.Errorf("usage middleware - product id is nil")
 	}
-	if c.MemoryMB == "" {
-		return nil, fmt.Errorf("usage middleware - memory MB is empty")
+	memoryMB, err := usageMemoryMB(c.MemoryMB)
+	if err != nil {
+		return nil, fmt.Errorf("usage middleware - %w", err)
+	}
+	if err := c.BillingPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("usage middleware - %w", err)
+	}
+	for _, r := range c.ProductRoutes {
+		if r.ProductID == uuid.Nil {
+			return nil, fmt.Errorf("usage middleware - product id of routes %s is nil", r.Prefix)
+		}
+	}
+	for productID, units := range c.Units {
+		for _, unit := range units {
+			if unit == "" {
+				return nil, fmt.Errorf("usage middleware - empty unit in catalogue of product %s", productID)
+			}
+		}
+	}
+
+	recorder := &UsageRecorder{
+		productID:     c.ProductID,
+		memoryMB:      memoryMB,
+		pseudonymizer: c.Pseudonymizer,
+		emitter:       c.Emitter,
+		sqsClient:     sqsClient,
+		billing:       usageBilling{policy: c.BillingPolicy, billingFunc: c.BillingFunc},
 	}
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -64,39 +124,30 @@ func (c *UsageConfig) toMiddleware(sqsClient sqs.ClientSqs) (echo.MiddlewareFunc
 				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("cannot cast context to custom context"))
 			}
 
+			productID := c.productID(cc.Path())
+			cc.usage = newUsageMeter(c.Units[productID])
 			startTime := time.Now()
 			handlerError := next(cc)
 			processTime := time.Now()
 
 			if cc.TenantID != uuid.Nil {
-				queueInput := map[string]types.MessageAttributeValue{
-					"product_id": {
-						DataType:    aws.String("String"),
-						StringValue: aws.String(c.ProductID.String()),
-					},
-					"tenant_id": {
-						DataType:    aws.String("String"),
-						StringValue: aws.String(cc.TenantID.String()),
-					},
-					"memory_mb": {
-						DataType:    aws.String("String"),
-						StringValue: aws.String(c.MemoryMB),
-					},
-					"start_timestamp": {
-						DataType:    aws.String("String"),
-						StringValue: aws.String(startTime.String()),
-					},
-					"end_timestamp": {
-						DataType:    aws.String("String"),
-						StringValue: aws.String(processTime.String()),
-					},
-					"workflow": {
-						DataType:    aws.String("String"),
-						StringValue: aws.String(cc.Request().URL.Path),
-					},
+				event := UsageEvent{
+					ProductID:  productID,
+					TenantID:   cc.TenantID,
+					RequestID:  cc.RequestID,
+					Subject:    cc.Sub,
+					Workflow:   c.workflow(cc),
+					Method:     cc.Request().Method,
+					StatusCode: responseStatus(cc, handlerError),
+					Units:      cc.usage.totals(),
+					StartTime:  startTime,
+					EndTime:    processTime,
 				}
-				if err := sqsClient.SendMsg(cc.Request().Context(), queueInput); err != nil {
-					return err
+
+				// the response is already written, usage failures must not change the outcome of the request,
+				// messages dropped by a full emitter buffer are counted by the emitter
+				if err := recorder.record(cc.Request().Context(), event, handlerError); err != nil && !errors.Is(err, ErrUsageBufferFull) {
+					log.Errorf("usage middleware - failed to send usage: %v", err)
 				}
 			}
 
@@ -107,3 +158,85 @@ func (c *UsageConfig) toMiddleware(sqsClient sqs.ClientSqs) (echo.MiddlewareFunc
 		}
 	}, nil
 }
+
+// productID returns the product the route is billed to.
+func (c *UsageConfig) productID(route string) uuid.UUID {
+	productID, longest := c.ProductID, -1
+	for _, r := range c.ProductRoutes {
+		if r.matches(route) && len(r.Prefix) > longest {
+			productID, longest = r.ProductID, len(r.Prefix)
+		}
+	}
+
+	return productID
+}
+
+func (c *UsageConfig) workflow(ctx echo.Context) string {
+	if c.WorkflowNameFunc != nil {
+		return c.WorkflowNameFunc(ctx)
+	}
+
+	return ctx.Path()
+}
+
+// RecordUsage adds n of the unit, e.g. rows or bytes processed, to the usage reported for the request.
+// Units must be in the catalogue of the product set in UsageConfig.Units. It is safe for concurrent use.
+func (c *Context) RecordUsage(unit string, n int64) error {
+	if n < 0 {
+		return fmt.Errorf("usage - negative amount %d of %q", n, unit)
+	}
+	if c.usage == nil {
+		return fmt.Errorf("%w %q: usage is not tracked for the request", ErrUnknownUsageUnit, unit)
+	}
+
+	return c.usage.add(unit, n)
+}
+
+// usageMeter sums the units recorded during a request.
+type usageMeter struct {
+	catalogue map[string]bool
+
+	mu    sync.Mutex
+	units map[string]int64
+}
+
+func newUsageMeter(catalogue []string) *usageMeter {
+	m := &usageMeter{catalogue: make(map[string]bool, len(catalogue))}
+	for _, unit := range catalogue {
+		m.catalogue[unit] = true
+	}
+
+	return m
+}
+
+func (m *usageMeter) add(unit string, n int64) error {
+	if !m.catalogue[unit] {
+		return fmt.Errorf("%w %q", ErrUnknownUsageUnit, unit)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.units == nil {
+		m.units = make(map[string]int64)
+	}
+	m.units[unit] += n
+
+	return nil
+}
+
+// totals returns a copy of the recorded units, nil if none were recorded.
+func (m *usageMeter) totals() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.units) == 0 {
+		return nil
+	}
+	totals := make(map[string]int64, len(m.units))
+	for unit, n := range m.units {
+		totals[unit] = n
+	}
+
+	return totals
+}
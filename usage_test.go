@@ -2,11 +2,15 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
 	"github.com/grasp-labs/go-libs/aws/sqs"
 	"github.com/grasp-labs/go-libs/mocks"
@@ -20,24 +24,61 @@ var (
 )
 
 func TestUsageConfig_toMiddleware(t *testing.T) {
+	pseudonymizer := newTestPseudonymizer(t)
+	wantUser, _ := pseudonymizer.UserID(context.Background(), tenantID, userID)
+
 	type fields struct {
-		ProductID uuid.UUID
-		MemoryMB  string
-		sqsClient sqs.ClientSqs
+		ProductID     uuid.UUID
+		MemoryMB      int
+		Pseudonymizer *Pseudonymizer
+		Units         map[uuid.UUID][]string
+		ProductRoutes []UsageProductRoute
+		BillingPolicy BillingPolicy
+		sqsClient     sqs.ClientSqs
 	}
 	tests := []struct {
 		name       string
 		fields     fields
+		env        map[string]string
 		want       echo.MiddlewareFunc
 		wantErrMsg string
 		setup      func(f *fields)
 		handler    func(c echo.Context) error
 	}{
 		{
-			name: "ShouldErrorOnSQS",
+			name: "ShouldErrorOnMemoryMB",
 			fields: fields{
 				ProductID: productID,
-				MemoryMB:  "1234",
+				MemoryMB:  -1,
+			},
+			setup:      func(f *fields) {},
+			wantErrMsg: "usage middleware - memory MB -1 is negative",
+		},
+		{
+			name: "ShouldDetectMemoryMB",
+			fields: fields{
+				ProductID: productID,
+			},
+			env: map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "2048"},
+			setup: func(f *fields) {
+				m := mocks.NewClientSqs(t)
+				m.EXPECT().
+					SendMsg(context.Background(), mock.MatchedBy(func(attrs map[string]types.MessageAttributeValue) bool {
+						return aws.ToString(attrs["memory_mb"].StringValue) == "2048"
+					})).
+					Return(nil).
+					Once()
+				f.sqsClient = m
+			},
+			handler: func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			},
+		},
+		{
+			name: "ShouldNotErrorOnSQS",
+			fields: fields{
+				ProductID: productID,
+				MemoryMB:  1234,
 			},
 			setup: func(f *fields) {
 				m := mocks.NewClientSqs(t)
@@ -47,7 +88,6 @@ func TestUsageConfig_toMiddleware(t *testing.T) {
 					Once()
 				f.sqsClient = m
 			},
-			wantErrMsg: "foo sqs",
 			handler: func(c echo.Context) error {
 				return nil
 			},
@@ -56,7 +96,7 @@ func TestUsageConfig_toMiddleware(t *testing.T) {
 			name: "ShouldErrorOnHandler",
 			fields: fields{
 				ProductID: productID,
-				MemoryMB:  "1234",
+				MemoryMB:  1234,
 			},
 			setup: func(f *fields) {
 				m := mocks.NewClientSqs(t)
@@ -75,7 +115,7 @@ func TestUsageConfig_toMiddleware(t *testing.T) {
 			name: "ShouldLogUsage",
 			fields: fields{
 				ProductID: productID,
-				MemoryMB:  "1234",
+				MemoryMB:  1234,
 			},
 			setup: func(f *fields) {
 				m := mocks.NewClientSqs(t)
@@ -89,14 +129,137 @@ func TestUsageConfig_toMiddleware(t *testing.T) {
 				return c.String(http.StatusOK, "Hello, World!")
 			},
 		},
+		{
+			name: "ShouldAddPseudonymizedUser",
+			fields: fields{
+				ProductID:     productID,
+				MemoryMB:      1234,
+				Pseudonymizer: pseudonymizer,
+			},
+			setup: func(f *fields) {
+				m := mocks.NewClientSqs(t)
+				m.EXPECT().
+					SendMsg(context.Background(), mock.MatchedBy(func(attrs map[string]types.MessageAttributeValue) bool {
+						return aws.ToString(attrs["user_id"].StringValue) == wantUser
+					})).
+					Return(nil).
+					Once()
+				f.sqsClient = m
+			},
+			handler: func(c echo.Context) error {
+				return c.String(http.StatusOK, "Hello, World!")
+			},
+		},
+		{
+			name: "ShouldAddUnits",
+			fields: fields{
+				ProductID: productID,
+				MemoryMB:  1234,
+				Units:     map[uuid.UUID][]string{productID: {"rows", "bytes"}},
+			},
+			setup: func(f *fields) {
+				m := mocks.NewClientSqs(t)
+				m.EXPECT().
+					SendMsg(context.Background(), mock.MatchedBy(func(attrs map[string]types.MessageAttributeValue) bool {
+						return aws.ToString(attrs["units"].StringValue) == `{"rows":5000}`
+					})).
+					Return(nil).
+					Once()
+				f.sqsClient = m
+			},
+			handler: func(c echo.Context) error {
+				cc := c.(*Context)
+				if err := cc.RecordUsage("rows", 3000); err != nil {
+					return err
+				}
+				if err := cc.RecordUsage("rows", 2000); err != nil {
+					return err
+				}
+				return c.NoContent(http.StatusOK)
+			},
+		},
+		{
+			name: "ShouldAddBillingDecision",
+			fields: fields{
+				ProductID:     productID,
+				MemoryMB:      1234,
+				BillingPolicy: BillSuccessesAndClientErrors,
+			},
+			setup: func(f *fields) {
+				m := mocks.NewClientSqs(t)
+				m.EXPECT().
+					SendMsg(context.Background(), mock.MatchedBy(func(attrs map[string]types.MessageAttributeValue) bool {
+						return aws.ToString(attrs["billing"].StringValue) == UsageBilled &&
+							aws.ToString(attrs["billing_policy"].StringValue) == "successes_and_client_errors"
+					})).
+					Return(nil).
+					Once()
+				f.sqsClient = m
+			},
+			handler: func(c echo.Context) error {
+				return c.NoContent(http.StatusNotFound)
+			},
+		},
+		{
+			name: "ShouldNotSendUnbilledUsage",
+			fields: fields{
+				ProductID:     productID,
+				MemoryMB:      1234,
+				BillingPolicy: BillSuccessesAndClientErrors,
+			},
+			setup: func(f *fields) {
+				f.sqsClient = mocks.NewClientSqs(t)
+			},
+			wantErrMsg: "foo handler",
+			handler: func(c echo.Context) error {
+				return fmt.Errorf("foo handler")
+			},
+		},
+		{
+			name: "ShouldErrorOnUnknownBillingPolicy",
+			fields: fields{
+				ProductID:     productID,
+				MemoryMB:      1234,
+				BillingPolicy: BillingPolicy(42),
+			},
+			setup:      func(f *fields) {},
+			wantErrMsg: "usage middleware - unknown billing policy 42",
+		},
+		{
+			name: "ShouldErrorOnNilRouteProduct",
+			fields: fields{
+				ProductID:     productID,
+				MemoryMB:      1234,
+				ProductRoutes: []UsageProductRoute{{Prefix: "/exports"}},
+			},
+			setup:      func(f *fields) {},
+			wantErrMsg: "usage middleware - product id of routes /exports is nil",
+		},
+		{
+			name: "ShouldErrorOnEmptyUnit",
+			fields: fields{
+				ProductID: productID,
+				MemoryMB:  1234,
+				Units:     map[uuid.UUID][]string{productID: {"rows", ""}},
+			},
+			setup:      func(f *fields) {},
+			wantErrMsg: "usage middleware - empty unit in catalogue of product 40bb5b9b-0b3d-40f0-932f-2969200660d5",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
 			tt.setup(&tt.fields)
 
 			c := &UsageConfig{
-				ProductID: tt.fields.ProductID,
-				MemoryMB:  tt.fields.MemoryMB,
+				ProductID:     tt.fields.ProductID,
+				MemoryMB:      tt.fields.MemoryMB,
+				Pseudonymizer: tt.fields.Pseudonymizer,
+				Units:         tt.fields.Units,
+				ProductRoutes: tt.fields.ProductRoutes,
+				BillingPolicy: tt.fields.BillingPolicy,
 			}
 
 			h, err := c.toMiddleware(tt.fields.sqsClient)
@@ -115,12 +278,146 @@ func TestUsageConfig_toMiddleware(t *testing.T) {
 				TenantName: "foo_tenant",
 				TenantID:   tenantID,
 				RequestID:  requestID,
+				Sub:        userID,
 			}
 
-			if err := h(tt.handler)(cc); err != nil {
+			err = h(tt.handler)(cc)
+			if tt.wantErrMsg != "" {
 				assert.EqualError(t, err, tt.wantErrMsg)
 				return
 			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestContext_RecordUsage(t *testing.T) {
+	tests := []struct {
+		name    string
+		meter   *usageMeter
+		unit    string
+		n       int64
+		wantErr error
+		want    map[string]int64
+	}{
+		{
+			name:  "ShouldRecordUnit",
+			meter: newUsageMeter([]string{"rows"}),
+			unit:  "rows",
+			n:     5000,
+			want:  map[string]int64{"rows": 5000},
+		},
+		{
+			name:    "ShouldErrorOnUnknownUnit",
+			meter:   newUsageMeter([]string{"rows"}),
+			unit:    "bytes",
+			n:       1,
+			wantErr: ErrUnknownUsageUnit,
+		},
+		{
+			name:    "ShouldErrorWithoutUsageMiddleware",
+			unit:    "rows",
+			n:       1,
+			wantErr: ErrUnknownUsageUnit,
+		},
+		{
+			name:    "ShouldErrorOnNegativeAmount",
+			meter:   newUsageMeter([]string{"rows"}),
+			unit:    "rows",
+			n:       -1,
+			wantErr: errors.New(`usage - negative amount -1 of "rows"`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &Context{usage: tt.meter}
+
+			err := cc.RecordUsage(tt.unit, tt.n)
+			switch {
+			case errors.Is(tt.wantErr, ErrUnknownUsageUnit):
+				assert.ErrorIs(t, err, tt.wantErr)
+			case tt.wantErr != nil:
+				assert.EqualError(t, err, tt.wantErr.Error())
+			default:
+				assert.NoError(t, err)
+			}
+			if tt.meter != nil {
+				assert.Equal(t, tt.want, tt.meter.totals())
+			}
+		})
+	}
+}
+
+func TestUsageMeter_concurrent(t *testing.T) {
+	m := newUsageMeter([]string{"rows"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, m.add("rows", 100))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]int64{"rows": 1000}, m.totals())
+}
+
+func TestUsageConfig_productID(t *testing.T) {
+	exportsID := uuid.MustParse("b0f1b7a4-3c55-4b9e-9d0c-4f5b8e0e7f11")
+	reportsID := uuid.MustParse("6d1c9a3e-2f4b-4e8a-b1c7-0a9e8d7c6b52")
+	cfg := &UsageConfig{
+		ProductID: productID,
+		ProductRoutes: []UsageProductRoute{
+			{Prefix: "/exports", ProductID: exportsID},
+			{Prefix: "/exports/reports/", ProductID: reportsID},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		route string
+		want  uuid.UUID
+	}{
+		{name: "ShouldMatchPrefix", route: "/exports", want: exportsID},
+		{name: "ShouldMatchRoutesUnderPrefix", route: "/exports/:id", want: exportsID},
+		{name: "ShouldMatchLongestPrefix", route: "/exports/reports/:id", want: reportsID},
+		{name: "ShouldNotMatchPartialSegment", route: "/exportsv2", want: productID},
+		{name: "ShouldDefaultToProductID", route: "/workflows/:id", want: productID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, cfg.productID(tt.route))
+		})
+	}
+}
+
+func TestUsageConfig_workflow(t *testing.T) {
+	tests := []struct {
+		name             string
+		workflowNameFunc func(c echo.Context) string
+		want             string
+	}{
+		{
+			name: "ShouldDefaultToRoutePattern",
+			want: "/workflows/:id",
+		},
+		{
+			name: "ShouldUseWorkflowNameFunc",
+			workflowNameFunc: func(c echo.Context) string {
+				return c.Request().Method + " " + c.Path()
+			},
+			want: "GET /workflows/:id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &UsageConfig{WorkflowNameFunc: tt.workflowNameFunc}
+
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/workflows/42", nil), httptest.NewRecorder())
+			c.SetPath("/workflows/:id")
+			assert.Equal(t, tt.want, cfg.workflow(c))
 		})
 	}
 }
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// BillingPolicy decides which usage is billed by the final status of the request.
+type BillingPolicy int
+
+const (
+	// BillAll bills every request, the default.
+	BillAll BillingPolicy = iota
+	// BillSuccesses bills requests with a status below 400.
+	BillSuccesses
+	// BillSuccessesAndClientErrors bills requests with a status below 500, failures of the service are not billed.
+	BillSuccessesAndClientErrors
+)
+
+// Billing decisions recorded in UsageEvent.Billing.
+const (
+	UsageBilled    = "billed"
+	UsageNotBilled = "not_billed"
+)
+
+// BillingFunc decides whether usage is billed by the final status and error of the request.
+// The status is 0 for work recorded with UsageRecorder.Track.
+type BillingFunc func(statusCode int, err error) bool
+
+func (p BillingPolicy) String() string {
+	switch p {
+	case BillAll:
+		return "all"
+	case BillSuccesses:
+		return "successes"
+	case BillSuccessesAndClientErrors:
+		return "successes_and_client_errors"
+	default:
+		return fmt.Sprintf("BillingPolicy(%d)", int(p))
+	}
+}
+
+func (p BillingPolicy) validate() error {
+	if p < BillAll || p > BillSuccessesAndClientErrors {
+		return fmt.Errorf("unknown billing policy %d", p)
+	}
+
+	return nil
+}
+
+func (p BillingPolicy) bills(statusCode int, err error) bool {
+	if statusCode == 0 {
+		// work outside of requests fails with an error only
+		statusCode = http.StatusOK
+		if err != nil {
+			statusCode = http.StatusInternalServerError
+		}
+	}
+
+	switch p {
+	case BillSuccesses:
+		return statusCode < http.StatusBadRequest
+	case BillSuccessesAndClientErrors:
+		return statusCode < http.StatusInternalServerError
+	default:
+		return true
+	}
+}
+
+// usageBilling applies the billing policy, or billingFunc if set, to usage.
+type usageBilling struct {
+	policy      BillingPolicy
+	billingFunc BillingFunc
+}
+
+// decide records the billing decision on the event and returns whether the usage is billed.
+func (b usageBilling) decide(event *UsageEvent, err error) bool {
+	billed := b.bills(event.StatusCode, err)
+	event.BillingPolicy = b.policy.String()
+	if b.billingFunc != nil {
+		event.BillingPolicy = "custom"
+	}
+
+	event.Billing = UsageNotBilled
+	if billed {
+		event.Billing = UsageBilled
+	}
+
+	return billed
+}
+
+// bills returns whether usage with the status and error is billed.
+func (b usageBilling) bills(statusCode int, err error) bool {
+	if b.billingFunc != nil {
+		return b.billingFunc(statusCode, err)
+	}
+
+	return b.policy.bills(statusCode, err)
+}
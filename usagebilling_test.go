@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageBilling_decide(t *testing.T) {
+	tests := []struct {
+		name       string
+		billing    usageBilling
+		statusCode int
+		err        error
+		wantBilled bool
+		wantPolicy string
+	}{
+		{
+			name:       "ShouldBillAllByDefault",
+			statusCode: http.StatusInternalServerError,
+			err:        errors.New("foo bug"),
+			wantBilled: true,
+			wantPolicy: "all",
+		},
+		{
+			name:       "ShouldBillSuccess",
+			billing:    usageBilling{policy: BillSuccesses},
+			statusCode: http.StatusCreated,
+			wantBilled: true,
+			wantPolicy: "successes",
+		},
+		{
+			name:       "ShouldNotBillClientErrorOnSuccesses",
+			billing:    usageBilling{policy: BillSuccesses},
+			statusCode: http.StatusNotFound,
+			err:        echo.ErrNotFound,
+			wantPolicy: "successes",
+		},
+		{
+			name:       "ShouldBillClientError",
+			billing:    usageBilling{policy: BillSuccessesAndClientErrors},
+			statusCode: http.StatusBadRequest,
+			err:        echo.ErrBadRequest,
+			wantBilled: true,
+			wantPolicy: "successes_and_client_errors",
+		},
+		{
+			name:       "ShouldNotBillServerError",
+			billing:    usageBilling{policy: BillSuccessesAndClientErrors},
+			statusCode: http.StatusBadGateway,
+			err:        errors.New("foo upstream"),
+			wantPolicy: "successes_and_client_errors",
+		},
+		{
+			name:       "ShouldBillSucceededWork",
+			billing:    usageBilling{policy: BillSuccesses},
+			wantBilled: true,
+			wantPolicy: "successes",
+		},
+		{
+			name:       "ShouldNotBillFailedWork",
+			billing:    usageBilling{policy: BillSuccessesAndClientErrors},
+			err:        errors.New("foo job"),
+			wantPolicy: "successes_and_client_errors",
+		},
+		{
+			name: "ShouldUseBillingFunc",
+			billing: usageBilling{policy: BillSuccesses, billingFunc: func(statusCode int, err error) bool {
+				// timeouts of the client are billed, the work was done
+				return statusCode < http.StatusInternalServerError || errors.Is(err, context.DeadlineExceeded)
+			}},
+			statusCode: http.StatusServiceUnavailable,
+			err:        context.DeadlineExceeded,
+			wantBilled: true,
+			wantPolicy: "custom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := UsageEvent{StatusCode: tt.statusCode}
+
+			assert.Equal(t, tt.wantBilled, tt.billing.decide(&event, tt.err))
+			assert.Equal(t, tt.wantPolicy, event.BillingPolicy)
+			if tt.wantBilled {
+				assert.Equal(t, UsageBilled, event.Billing)
+			} else {
+				assert.Equal(t, UsageNotBilled, event.Billing)
+			}
+		})
+	}
+}
+
+func TestBillingPolicy_validate(t *testing.T) {
+	assert.NoError(t, BillSuccessesAndClientErrors.validate())
+	assert.EqualError(t, BillingPolicy(42).validate(), "unknown billing policy 42")
+}
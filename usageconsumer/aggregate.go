@@ -0,0 +1,156 @@
+package usageconsumer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	middleware "github.com/grasp-labs/go-middleware"
+)
+
+// AggregateKey identifies the usage of a tenant for a product and workflow within a window.
+type AggregateKey struct {
+	TenantID    uuid.UUID
+	ProductID   uuid.UUID
+	Workflow    string
+	WindowStart time.Time // in UTC
+}
+
+// Aggregate is the usage summed over the events of its key.
+type Aggregate struct {
+	AggregateKey
+	Requests        int64            // billed events
+	NotBilled       int64            // events not billed by the billing policy, not counted in the sums below
+	DurationSeconds float64          // duration of billed events
+	ComputeSeconds  float64          // duration in seconds × memory in GB of billed events, i.e. GB-seconds
+	Units           map[string]int64 // units recorded by handlers of billed events
+}
+
+// Aggregates keeps aggregates. MemoryAggregates keeps them in memory, implementations backed by
+// a database let several consumers share them.
+type Aggregates interface {
+	// Add adds the aggregate to the one stored under its key.
+	Add(ctx context.Context, aggregate Aggregate) error
+	// List returns the aggregates of the tenant with a window starting within [from, to).
+	List(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]Aggregate, error)
+}
+
+// Aggregator aggregates usage events into windows of Aggregates.
+type Aggregator struct {
+	aggregates Aggregates
+	window     time.Duration
+}
+
+// NewAggregator returns an aggregator adding events to aggregates in windows of the given length,
+// e.g. time.Hour. Windows are aligned to the zero time in UTC.
+func NewAggregator(aggregates Aggregates, window time.Duration) (*Aggregator, error) {
+	if aggregates == nil {
+		return nil, fmt.Errorf("usage consumer - aggregates are nil")
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("usage consumer - window must be positive")
+	}
+
+	return &Aggregator{aggregates: aggregates, window: window}, nil
+}
+
+// Add adds the event to the aggregate of its window, by start time.
+func (a *Aggregator) Add(ctx context.Context, event middleware.UsageEvent) error {
+	return a.aggregates.Add(ctx, a.aggregate(event))
+}
+
+func (a *Aggregator) aggregate(event middleware.UsageEvent) Aggregate {
+	aggregate := Aggregate{AggregateKey: AggregateKey{
+		TenantID:    event.TenantID,
+		ProductID:   event.ProductID,
+		Workflow:    event.Workflow,
+		WindowStart: event.StartTime.UTC().Truncate(a.window),
+	}}
+	if event.Billing == middleware.UsageNotBilled {
+		aggregate.NotBilled = 1
+		return aggregate
+	}
+
+	seconds := event.DurationMS / 1000
+	aggregate.Requests = 1
+	aggregate.DurationSeconds = seconds
+	aggregate.ComputeSeconds = seconds * float64(event.MemoryMB) / 1024
+	if len(event.Units) > 0 {
+		aggregate.Units = make(map[string]int64, len(event.Units))
+		for unit, n := range event.Units {
+			aggregate.Units[unit] = n
+		}
+	}
+
+	return aggregate
+}
+
+func (a *Aggregate) merge(other Aggregate) {
+	a.Requests += other.Requests
+	a.NotBilled += other.NotBilled
+	a.DurationSeconds += other.DurationSeconds
+	a.ComputeSeconds += other.ComputeSeconds
+	for unit, n := range other.Units {
+		if a.Units == nil {
+			a.Units = make(map[string]int64)
+		}
+		a.Units[unit] += n
+	}
+}
+
+// MemoryAggregates keeps aggregates in memory. It is safe for concurrent use.
+type MemoryAggregates struct {
+	mu         sync.Mutex
+	aggregates map[AggregateKey]*Aggregate
+}
+
+// NewMemoryAggregates returns empty in-memory aggregates.
+func NewMemoryAggregates() *MemoryAggregates {
+	return &MemoryAggregates{aggregates: make(map[AggregateKey]*Aggregate)}
+}
+
+func (m *MemoryAggregates) Add(_ context.Context, aggregate Aggregate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.aggregates[aggregate.AggregateKey]
+	if !ok {
+		stored = &Aggregate{AggregateKey: aggregate.AggregateKey}
+		m.aggregates[aggregate.AggregateKey] = stored
+	}
+	stored.merge(aggregate)
+
+	return nil
+}
+
+// List returns the aggregates ordered by window, product and workflow.
+func (m *MemoryAggregates) List(_ context.Context, tenantID uuid.UUID, from, to time.Time) ([]Aggregate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var aggregates []Aggregate
+	for key, aggregate := range m.aggregates {
+		if key.TenantID != tenantID || key.WindowStart.Before(from) || !key.WindowStart.Before(to) {
+			continue
+		}
+		copied := *aggregate
+		copied.Units = nil
+		copied.merge(Aggregate{Units: aggregate.Units})
+		aggregates = append(aggregates, copied)
+	}
+	sort.Slice(aggregates, func(i, j int) bool {
+		a, b := aggregates[i], aggregates[j]
+		if !a.WindowStart.Equal(b.WindowStart) {
+			return a.WindowStart.Before(b.WindowStart)
+		}
+		if a.ProductID != b.ProductID {
+			return a.ProductID.String() < b.ProductID.String()
+		}
+		return a.Workflow < b.Workflow
+	})
+
+	return aggregates, nil
+}
@@ -0,0 +1,128 @@
+package usageconsumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	middleware "github.com/grasp-labs/go-middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAggregator(t *testing.T) {
+	_, err := NewAggregator(nil, time.Hour)
+	assert.EqualError(t, err, "usage consumer - aggregates are nil")
+
+	_, err = NewAggregator(NewMemoryAggregates(), 0)
+	assert.EqualError(t, err, "usage consumer - window must be positive")
+}
+
+func TestAggregator_Add(t *testing.T) {
+	otherTenantID := uuid.MustParse("6d1c9a3e-2f4b-4e8a-b1c7-0a9e8d7c6b52")
+	hour := time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC)
+	event := func(start time.Time, durationMS float64, memoryMB int) middleware.UsageEvent {
+		return middleware.UsageEvent{
+			ProductID:  productID,
+			TenantID:   tenantID,
+			Workflow:   "/workflows/:id",
+			MemoryMB:   memoryMB,
+			StartTime:  start,
+			DurationMS: durationMS,
+		}
+	}
+	key := func(windowStart time.Time, workflow string) AggregateKey {
+		return AggregateKey{TenantID: tenantID, ProductID: productID, Workflow: workflow, WindowStart: windowStart}
+	}
+
+	tests := []struct {
+		name   string
+		events func() []middleware.UsageEvent
+		want   []Aggregate
+	}{
+		{
+			name: "ShouldComputeGBSeconds",
+			events: func() []middleware.UsageEvent {
+				return []middleware.UsageEvent{
+					event(hour.Add(time.Minute), 1500, 1024),
+					event(hour.Add(59*time.Minute), 2000, 512),
+				}
+			},
+			want: []Aggregate{
+				{AggregateKey: key(hour, "/workflows/:id"), Requests: 2, DurationSeconds: 3.5, ComputeSeconds: 2.5},
+			},
+		},
+		{
+			name: "ShouldSplitWindowsAndWorkflows",
+			events: func() []middleware.UsageEvent {
+				other := event(hour, 1000, 1024)
+				other.Workflow = "nightly-export"
+				return []middleware.UsageEvent{
+					event(hour.Add(-time.Second), 1000, 1024),
+					event(hour, 1000, 1024),
+					other,
+				}
+			},
+			want: []Aggregate{
+				{AggregateKey: key(hour.Add(-time.Hour), "/workflows/:id"), Requests: 1, DurationSeconds: 1, ComputeSeconds: 1},
+				{AggregateKey: key(hour, "/workflows/:id"), Requests: 1, DurationSeconds: 1, ComputeSeconds: 1},
+				{AggregateKey: key(hour, "nightly-export"), Requests: 1, DurationSeconds: 1, ComputeSeconds: 1},
+			},
+		},
+		{
+			name: "ShouldSumUnits",
+			events: func() []middleware.UsageEvent {
+				first, second := event(hour, 1000, 1024), event(hour, 1000, 1024)
+				first.Units = map[string]int64{"rows": 5000}
+				second.Units = map[string]int64{"rows": 1000, "bytes": 42}
+				return []middleware.UsageEvent{first, second}
+			},
+			want: []Aggregate{
+				{AggregateKey: key(hour, "/workflows/:id"), Requests: 2, DurationSeconds: 2, ComputeSeconds: 2, Units: map[string]int64{"rows": 6000, "bytes": 42}},
+			},
+		},
+		{
+			name: "ShouldCountNotBilled",
+			events: func() []middleware.UsageEvent {
+				notBilled := event(hour, 1000, 1024)
+				notBilled.Billing = middleware.UsageNotBilled
+				notBilled.Units = map[string]int64{"rows": 5000}
+				return []middleware.UsageEvent{event(hour, 1000, 1024), notBilled}
+			},
+			want: []Aggregate{
+				{AggregateKey: key(hour, "/workflows/:id"), Requests: 1, NotBilled: 1, DurationSeconds: 1, ComputeSeconds: 1},
+			},
+		},
+		{
+			name: "ShouldListTenantOnly",
+			events: func() []middleware.UsageEvent {
+				other := event(hour, 1000, 1024)
+				other.TenantID = otherTenantID
+				return []middleware.UsageEvent{other}
+			},
+		},
+		{
+			name: "ShouldListWindowsInRange",
+			events: func() []middleware.UsageEvent {
+				return []middleware.UsageEvent{event(hour.Add(-2*time.Hour), 1000, 1024), event(hour.Add(24*time.Hour), 1000, 1024)}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregates := NewMemoryAggregates()
+			a, err := NewAggregator(aggregates, time.Hour)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			for _, e := range tt.events() {
+				assert.NoError(t, a.Add(context.Background(), e))
+			}
+
+			got, err := aggregates.List(context.Background(), tenantID, hour.Add(-time.Hour), hour.Add(24*time.Hour))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package usageconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/labstack/gommon/log"
+)
+
+// SQSConsumerAPI is the part of the SQS client used by Consumer.
+type SQSConsumerAPI interface {
+	ReceiveMessage(ctx context.Context, params *awssqs.ReceiveMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *awssqs.DeleteMessageBatchInput, optFns ...func(*awssqs.Options)) (*awssqs.DeleteMessageBatchOutput, error)
+}
+
+// ConsumerConfig defines the config for NewConsumer.
+type ConsumerConfig struct {
+	QueueURL     string
+	Aggregator   *Aggregator
+	WaitTime     time.Duration // Optional, defaults to 20s, the long polling limit of SQS
+	ErrorBackoff time.Duration // Optional, defaults to 1s, wait after failing to receive messages
+	// MaxReceiveErrors stops Run after that many consecutive failures to receive messages.
+	// Optional, Run retries until ctx is done when 0.
+	MaxReceiveErrors int
+}
+
+// Consumer receives usage messages from SQS and adds them to an Aggregator. Messages are deleted
+// once added, messages which cannot be decoded or added are left for the redrive policy of the queue.
+// SQS delivers messages at least once, so aggregates may count a message twice.
+type Consumer struct {
+	client SQSConsumerAPI
+	cfg    ConsumerConfig
+}
+
+// NewConsumer returns a consumer of the queue.
+func NewConsumer(client SQSConsumerAPI, cfg ConsumerConfig) (*Consumer, error) {
+	if cfg.QueueURL == "" {
+		return nil, fmt.Errorf("usage consumer - queue URL is empty")
+	}
+	if cfg.Aggregator == nil {
+		return nil, fmt.Errorf("usage consumer - aggregator is nil")
+	}
+	if cfg.WaitTime <= 0 {
+		cfg.WaitTime = 20 * time.Second
+	}
+	if cfg.ErrorBackoff <= 0 {
+		cfg.ErrorBackoff = time.Second
+	}
+
+	return &Consumer{client: client, cfg: cfg}, nil
+}
+
+// Run consumes messages until ctx is done and returns ctx.Err(), or the last error once receiving
+// failed MaxReceiveErrors times in a row. Failures are logged, receiving is retried after ErrorBackoff.
+func (c *Consumer) Run(ctx context.Context) error {
+	receiveErrors := 0
+	for ctx.Err() == nil {
+		messages, err := c.receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			receiveErrors++
+			if c.cfg.MaxReceiveErrors > 0 && receiveErrors >= c.cfg.MaxReceiveErrors {
+				return fmt.Errorf("usage consumer - %w", err)
+			}
+			log.Errorf("usage consumer - %v", err)
+
+			select {
+			case <-time.After(c.cfg.ErrorBackoff):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		receiveErrors = 0
+
+		if err := c.process(ctx, messages); err != nil {
+			log.Errorf("usage consumer - %v", err)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// Poll receives one batch of messages, aggregates and deletes them.
+func (c *Consumer) Poll(ctx context.Context) error {
+	messages, err := c.receive(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.process(ctx, messages)
+}
+
+func (c *Consumer) receive(ctx context.Context) ([]types.Message, error) {
+	out, err := c.client.ReceiveMessage(ctx, &awssqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(c.cfg.QueueURL),
+		MaxNumberOfMessages:   10,
+		WaitTimeSeconds:       int32(c.cfg.WaitTime / time.Second),
+		MessageAttributeNames: []string{"All"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive messages: %w", err)
+	}
+
+	return out.Messages, nil
+}
+
+// process aggregates the messages and deletes the aggregated ones.
+func (c *Consumer) process(ctx context.Context, messages []types.Message) error {
+	var handled []types.DeleteMessageBatchRequestEntry
+	var errs []error
+	for _, msg := range messages {
+		if err := c.handle(ctx, msg); err != nil {
+			errs = append(errs, fmt.Errorf("message %s: %w", aws.ToString(msg.MessageId), err))
+			continue
+		}
+		handled = append(handled, types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(len(handled))),
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+	}
+
+	if len(handled) > 0 {
+		out, err := c.client.DeleteMessageBatch(ctx, &awssqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(c.cfg.QueueURL),
+			Entries:  handled,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete messages: %w", err))
+		} else if len(out.Failed) > 0 {
+			errs = append(errs, fmt.Errorf("failed to delete %d messages", len(out.Failed)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Consumer) handle(ctx context.Context, msg types.Message) error {
+	event, err := DecodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.cfg.Aggregator.Add(ctx, event)
+}
@@ -0,0 +1,156 @@
+package usageconsumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQueue hands out messages once, failing receive calls while receiveErrors is positive.
+type fakeQueue struct {
+	mu            sync.Mutex
+	messages      []types.Message
+	receiveErrors int
+	receives      int
+	deleted       []string
+}
+
+func (q *fakeQueue) ReceiveMessage(ctx context.Context, params *awssqs.ReceiveMessageInput, _ ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.receives++
+	if aws.ToString(params.QueueUrl) != "foo_queue" {
+		return nil, fmt.Errorf("unexpected queue %s", aws.ToString(params.QueueUrl))
+	}
+	if q.receiveErrors > 0 {
+		q.receiveErrors--
+		return nil, fmt.Errorf("foo sqs")
+	}
+
+	n := min(int(params.MaxNumberOfMessages), len(q.messages))
+	out := &awssqs.ReceiveMessageOutput{Messages: q.messages[:n]}
+	q.messages = q.messages[n:]
+
+	return out, ctx.Err()
+}
+
+func (q *fakeQueue) DeleteMessageBatch(_ context.Context, params *awssqs.DeleteMessageBatchInput, _ ...func(*awssqs.Options)) (*awssqs.DeleteMessageBatchOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, entry := range params.Entries {
+		q.deleted = append(q.deleted, aws.ToString(entry.ReceiptHandle))
+	}
+
+	return &awssqs.DeleteMessageBatchOutput{}, nil
+}
+
+func usageMessage(receiptHandle, body string) types.Message {
+	return types.Message{
+		MessageId:     aws.String(receiptHandle),
+		ReceiptHandle: aws.String(receiptHandle),
+		Body:          aws.String(body),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"version": {DataType: aws.String("String"), StringValue: aws.String("1")},
+		},
+	}
+}
+
+func newTestConsumer(t *testing.T, queue *fakeQueue) (*Consumer, *MemoryAggregates) {
+	t.Helper()
+
+	aggregates := NewMemoryAggregates()
+	aggregator, err := NewAggregator(aggregates, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConsumer(queue, ConsumerConfig{QueueURL: "foo_queue", Aggregator: aggregator, ErrorBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, aggregates
+}
+
+func TestNewConsumer(t *testing.T) {
+	_, err := NewConsumer(&fakeQueue{}, ConsumerConfig{})
+	assert.EqualError(t, err, "usage consumer - queue URL is empty")
+
+	_, err = NewConsumer(&fakeQueue{}, ConsumerConfig{QueueURL: "foo_queue"})
+	assert.EqualError(t, err, "usage consumer - aggregator is nil")
+}
+
+func TestConsumer_Poll(t *testing.T) {
+	body := fmt.Sprintf(`{"version":1,"product_id":"%s","tenant_id":"%s","workflow":"/workflows/:id","memory_mb":2048,"start_timestamp":"2024-06-18T12:00:00Z","duration_ms":500}`, productID, tenantID)
+	queue := &fakeQueue{messages: []types.Message{
+		usageMessage("foo_1", body),
+		usageMessage("foo_2", "not json"),
+		usageMessage("foo_3", body),
+	}}
+	c, aggregates := newTestConsumer(t, queue)
+
+	err := c.Poll(context.Background())
+	assert.EqualError(t, err, "message foo_2: usage consumer - malformed usage event: invalid character 'o' in literal null (expecting 'u')")
+	assert.Equal(t, []string{"foo_1", "foo_3"}, queue.deleted)
+
+	window := time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC)
+	got, err := aggregates.List(context.Background(), tenantID, window, window.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []Aggregate{{
+		AggregateKey:    AggregateKey{TenantID: tenantID, ProductID: productID, Workflow: "/workflows/:id", WindowStart: window},
+		Requests:        2,
+		DurationSeconds: 1,
+		ComputeSeconds:  2,
+	}}, got)
+}
+
+func TestConsumer_Run(t *testing.T) {
+	body := fmt.Sprintf(`{"version":1,"product_id":"%s","tenant_id":"%s","workflow":"/workflows/:id","memory_mb":1024,"start_timestamp":"2024-06-18T12:00:00Z","duration_ms":1000}`, productID, tenantID)
+	queue := &fakeQueue{receiveErrors: 2, messages: []types.Message{usageMessage("foo_1", body)}}
+	c, _ := newTestConsumer(t, queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		return len(queue.deleted) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("consumer did not stop")
+	}
+	assert.GreaterOrEqual(t, queue.receives, 3)
+}
+
+func TestConsumer_Run_maxReceiveErrors(t *testing.T) {
+	queue := &fakeQueue{receiveErrors: 3}
+	aggregator, err := NewAggregator(NewMemoryAggregates(), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := NewConsumer(queue, ConsumerConfig{QueueURL: "foo_queue", Aggregator: aggregator, ErrorBackoff: time.Millisecond, MaxReceiveErrors: 3})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = c.Run(context.Background())
+	assert.EqualError(t, err, "usage consumer - failed to receive messages: foo sqs")
+	assert.Equal(t, 3, queue.receives)
+}
@@ -0,0 +1,142 @@
+// Package usageconsumer decodes usage messages sent by the middleware package, in the legacy attribute
+// format and as UsageEvent, and aggregates them per tenant, product and workflow into time windows.
+package usageconsumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	middleware "github.com/grasp-labs/go-middleware"
+)
+
+// legacyTimeLayout is the layout of time.Time.String, used by timestamps of the legacy format.
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// DecodeMessage decodes a usage message received with the SQS ReceiveMessage API.
+// Message attributes must be requested with MessageAttributeNames.
+func DecodeMessage(msg types.Message) (middleware.UsageEvent, error) {
+	return Decode(aws.ToString(msg.Body), msg.MessageAttributes)
+}
+
+// Decode decodes a usage message. Messages with a version attribute carry a UsageEvent as body,
+// others are in the legacy attribute format and are returned with version 0, timestamps in UTC and
+// the duration computed from them.
+func Decode(body string, attributes map[string]types.MessageAttributeValue) (middleware.UsageEvent, error) {
+	if _, ok := attributes["version"]; ok {
+		return decodeEvent(body)
+	}
+
+	return decodeLegacy(attributes)
+}
+
+func decodeEvent(body string) (middleware.UsageEvent, error) {
+	var event middleware.UsageEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return middleware.UsageEvent{}, fmt.Errorf("usage consumer - malformed usage event: %w", err)
+	}
+	if event.Version < 1 || event.Version > middleware.UsageEventVersion {
+		return middleware.UsageEvent{}, fmt.Errorf("usage consumer - unsupported usage event version %d", event.Version)
+	}
+
+	return event, nil
+}
+
+func decodeLegacy(attributes map[string]types.MessageAttributeValue) (middleware.UsageEvent, error) {
+	d := legacyDecoder{attributes: attributes}
+	event := middleware.UsageEvent{
+		ProductID:     d.uuid("product_id"),
+		TenantID:      d.uuid("tenant_id"),
+		Subject:       d.optional("user_id"),
+		Workflow:      d.string("workflow"),
+		MemoryMB:      d.int("memory_mb"),
+		StartTime:     d.time("start_timestamp"),
+		EndTime:       d.time("end_timestamp"),
+		Billing:       d.optional("billing"),
+		BillingPolicy: d.optional("billing_policy"),
+	}
+	if units := d.optional("units"); units != "" && d.err == nil {
+		if err := json.Unmarshal([]byte(units), &event.Units); err != nil {
+			d.err = fmt.Errorf("usage consumer - malformed attribute units: %w", err)
+		}
+	}
+	if d.err != nil {
+		return middleware.UsageEvent{}, d.err
+	}
+	event.DurationMS = float64(event.EndTime.Sub(event.StartTime).Microseconds()) / 1000
+
+	return event, nil
+}
+
+// legacyDecoder reads attributes of the legacy format, keeping the first error.
+type legacyDecoder struct {
+	attributes map[string]types.MessageAttributeValue
+	err        error
+}
+
+func (d *legacyDecoder) optional(name string) string {
+	return aws.ToString(d.attributes[name].StringValue)
+}
+
+func (d *legacyDecoder) string(name string) string {
+	v, ok := d.attributes[name]
+	if !ok && d.err == nil {
+		d.err = fmt.Errorf("usage consumer - missing attribute %s", name)
+	}
+
+	return aws.ToString(v.StringValue)
+}
+
+func (d *legacyDecoder) malformed(name string, err error) {
+	if d.err == nil {
+		d.err = fmt.Errorf("usage consumer - malformed attribute %s: %w", name, err)
+	}
+}
+
+func (d *legacyDecoder) uuid(name string) uuid.UUID {
+	v := d.string(name)
+	if d.err != nil {
+		return uuid.Nil
+	}
+	id, err := uuid.Parse(v)
+	if err != nil {
+		d.malformed(name, err)
+	}
+
+	return id
+}
+
+func (d *legacyDecoder) int(name string) int {
+	v := d.string(name)
+	if d.err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		d.malformed(name, err)
+	}
+
+	return n
+}
+
+func (d *legacyDecoder) time(name string) time.Time {
+	v := d.string(name)
+	if d.err != nil {
+		return time.Time{}
+	}
+	// time.Now().String() ends with the monotonic clock reading, e.g. m=+0.001
+	if i := strings.Index(v, " m="); i >= 0 {
+		v = v[:i]
+	}
+	t, err := time.Parse(legacyTimeLayout, v)
+	if err != nil {
+		d.malformed(name, err)
+	}
+
+	return t.UTC()
+}
@@ -0,0 +1,221 @@
+package usageconsumer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	middleware "github.com/grasp-labs/go-middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	productID = uuid.MustParse("40bb5b9b-0b3d-40f0-932f-2969200660d5")
+	tenantID  = uuid.MustParse("dd49bb44-ac56-4e70-8697-89603f4125f2")
+	requestID = uuid.MustParse("03a3e1d6-8bf8-42ce-8e65-a83b2ba68c3a")
+)
+
+// batchQueue records the entries of SendMessageBatch calls.
+type batchQueue struct {
+	mu      sync.Mutex
+	entries []types.SendMessageBatchRequestEntry
+}
+
+func (q *batchQueue) SendMessageBatch(_ context.Context, params *awssqs.SendMessageBatchInput, _ ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.entries = append(q.entries, params.Entries...)
+	return &awssqs.SendMessageBatchOutput{}, nil
+}
+
+// TestDecode_legacy decodes the legacy attributes pinned by the golden file of the middleware package.
+func TestDecode_legacy(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "usageevent", "legacy.golden"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var values map[string]string
+	if !assert.NoError(t, json.Unmarshal(data, &values)) {
+		return
+	}
+	attributes := make(map[string]types.MessageAttributeValue, len(values))
+	for k, v := range values {
+		attributes[k] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+
+	event, err := Decode("", attributes)
+	assert.NoError(t, err)
+	start := time.Date(2024, 6, 18, 12, 0, 0, 123456789, time.UTC)
+	assert.Equal(t, middleware.UsageEvent{
+		ProductID:     productID,
+		TenantID:      tenantID,
+		Workflow:      "/workflows/:id",
+		MemoryMB:      1024,
+		Units:         map[string]int64{"rows": 5000},
+		StartTime:     start,
+		EndTime:       start.Add(1500 * time.Millisecond),
+		DurationMS:    1500,
+		Billing:       middleware.UsageBilled,
+		BillingPolicy: "successes",
+	}, event)
+}
+
+func TestDecode_event(t *testing.T) {
+	queue := &batchQueue{}
+	emitter, err := middleware.NewUsageEmitter(queue, middleware.UsageEmitterConfig{QueueURL: "foo_queue"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	recorder, err := middleware.NewUsageRecorder(context.Background(), middleware.UsageRecorderConfig{
+		ProductID: productID,
+		MemoryMB:  1024,
+		Emitter:   emitter,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	start := time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, recorder.Record(context.Background(), middleware.UsageEvent{
+		TenantID:   tenantID,
+		RequestID:  requestID,
+		Workflow:   "/workflows/:id",
+		StatusCode: 201,
+		StartTime:  start,
+		EndTime:    start.Add(time.Second),
+	}))
+	assert.NoError(t, emitter.Close(context.Background()))
+	if !assert.Len(t, queue.entries, 1) {
+		return
+	}
+
+	event, err := DecodeMessage(types.Message{
+		Body:              queue.entries[0].MessageBody,
+		MessageAttributes: queue.entries[0].MessageAttributes,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, middleware.UsageEvent{
+		Version:       middleware.UsageEventVersion,
+		ProductID:     productID,
+		TenantID:      tenantID,
+		RequestID:     requestID,
+		Workflow:      "/workflows/:id",
+		StatusCode:    201,
+		MemoryMB:      1024,
+		StartTime:     start,
+		EndTime:       start.Add(time.Second),
+		DurationMS:    1000,
+		Billing:       middleware.UsageBilled,
+		BillingPolicy: "all",
+	}, event)
+}
+
+func TestDecode(t *testing.T) {
+	legacy := func(overrides map[string]string) map[string]types.MessageAttributeValue {
+		values := map[string]string{
+			"product_id":      productID.String(),
+			"tenant_id":       tenantID.String(),
+			"memory_mb":       "512",
+			"start_timestamp": "2024-06-18 14:00:00.5 +0200 CEST m=+0.001234567",
+			"end_timestamp":   "2024-06-18 14:00:02 +0200 CEST m=+1.501234567",
+			"workflow":        "/workflows/:id",
+		}
+		for k, v := range overrides {
+			if v == "" {
+				delete(values, k)
+				continue
+			}
+			values[k] = v
+		}
+
+		attributes := make(map[string]types.MessageAttributeValue, len(values))
+		for k, v := range values {
+			attributes[k] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+		return attributes
+	}
+	versioned := map[string]types.MessageAttributeValue{
+		"version": {DataType: aws.String("String"), StringValue: aws.String("1")},
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		attributes map[string]types.MessageAttributeValue
+		want       middleware.UsageEvent
+		wantErrMsg string
+	}{
+		{
+			name:       "ShouldDecodeLegacyTimestamps",
+			body:       "usage",
+			attributes: legacy(map[string]string{"user_id": "foo_pseudonym"}),
+			want: middleware.UsageEvent{
+				ProductID:  productID,
+				TenantID:   tenantID,
+				Subject:    "foo_pseudonym",
+				Workflow:   "/workflows/:id",
+				MemoryMB:   512,
+				StartTime:  time.Date(2024, 6, 18, 12, 0, 0, 500000000, time.UTC),
+				EndTime:    time.Date(2024, 6, 18, 12, 0, 2, 0, time.UTC),
+				DurationMS: 1500,
+			},
+		},
+		{
+			name:       "ShouldErrorOnMissingAttribute",
+			attributes: legacy(map[string]string{"workflow": ""}),
+			wantErrMsg: "usage consumer - missing attribute workflow",
+		},
+		{
+			name:       "ShouldErrorOnMalformedTenant",
+			attributes: legacy(map[string]string{"tenant_id": "foo"}),
+			wantErrMsg: "usage consumer - malformed attribute tenant_id: invalid UUID length: 3",
+		},
+		{
+			name:       "ShouldErrorOnMalformedMemory",
+			attributes: legacy(map[string]string{"memory_mb": "1GB"}),
+			wantErrMsg: `usage consumer - malformed attribute memory_mb: strconv.Atoi: parsing "1GB": invalid syntax`,
+		},
+		{
+			name:       "ShouldErrorOnMalformedTimestamp",
+			attributes: legacy(map[string]string{"start_timestamp": "2024-06-18T12:00:00Z"}),
+			wantErrMsg: `usage consumer - malformed attribute start_timestamp: parsing time "2024-06-18T12:00:00Z" as "2006-01-02 15:04:05.999999999 -0700 MST": cannot parse "T12:00:00Z" as " "`,
+		},
+		{
+			name:       "ShouldErrorOnMalformedUnits",
+			attributes: legacy(map[string]string{"units": "rows=1"}),
+			wantErrMsg: "usage consumer - malformed attribute units: invalid character 'r' looking for beginning of value",
+		},
+		{
+			name:       "ShouldErrorOnMalformedEvent",
+			body:       "usage",
+			attributes: versioned,
+			wantErrMsg: "usage consumer - malformed usage event: invalid character 'u' looking for beginning of value",
+		},
+		{
+			name:       "ShouldErrorOnUnsupportedVersion",
+			body:       `{"version":2}`,
+			attributes: versioned,
+			wantErrMsg: "usage consumer - unsupported usage event version 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.body, tt.attributes)
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package usageconsumer_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/grasp-labs/go-middleware/usageconsumer"
+)
+
+func ExampleNewConsumer() {
+	aggregates := usageconsumer.NewMemoryAggregates()
+	aggregator, err := usageconsumer.NewAggregator(aggregates, time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	consumer, err := usageconsumer.NewConsumer(awssqs.New(awssqs.Options{Region: "eu-north-1"}), usageconsumer.ConsumerConfig{
+		QueueURL:   "https://sqs.eu-north-1.amazonaws.com/123456789012/usage",
+		Aggregator: aggregator,
+		// Stop after a minute of failing receives, e.g. to let the orchestrator restart the task
+		MaxReceiveErrors: 60,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Consume until the context is cancelled, aggregates.List returns the hourly usage of a tenant
+	if err := consumer.Run(context.Background()); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
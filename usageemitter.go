@@ -0,0 +1,360 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/labstack/gommon/log"
+)
+
+// ErrUsageBufferFull is returned by UsageEmitter.Emit when the buffer is full.
+var ErrUsageBufferFull = errors.New("usage buffer is full")
+
+// ErrUsageEmitterClosed is returned by UsageEmitter.Emit after the emitter has been closed.
+var ErrUsageEmitterClosed = errors.New("usage emitter is closed")
+
+// maxSendMessageBatchEntries is the number of messages SQS accepts in a single SendMessageBatch call.
+const maxSendMessageBatchEntries = 10
+
+// legacyUsageMessageBody is the body of usage messages carrying usage in attributes only. SQS requires a body.
+const legacyUsageMessageBody = "usage"
+
+// SQSSendMessageBatchAPI is the part of the SQS client used by UsageEmitter.
+type SQSSendMessageBatchAPI interface {
+	SendMessageBatch(ctx context.Context, params *awssqs.SendMessageBatchInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error)
+}
+
+// UsageMessage is a message sent to the usage queue.
+type UsageMessage struct {
+	Body       string // UsageEvent as JSON
+	Attributes map[string]types.MessageAttributeValue
+}
+
+// UsageEmitterConfig defines the config for NewUsageEmitter.
+type UsageEmitterConfig struct {
+	QueueURL      string
+	BufferSize    int                                      // Optional, defaults to 1000
+	BatchSize     int                                      // Optional, defaults to 10, the SendMessageBatch limit
+	FlushInterval time.Duration                            // Optional, defaults to 1s
+	MaxRetries    int                                      // Optional, defaults to 3, negative disables retries
+	RetryBackoff  time.Duration                            // Optional, defaults to 100ms, doubled after every retry
+	OnError       func(err error, messages []UsageMessage) // Optional, defaults to logging the error
+	// Outbox keeps messages which could not be sent after retries and replays them in the background.
+	// Optional, such messages are reported to OnError and lost when nil.
+	Outbox *UsageOutbox
+}
+
+// UsageEmitterStats are counters of a UsageEmitter.
+type UsageEmitterStats struct {
+	Buffered int    // messages waiting to be sent
+	Sent     uint64 // messages accepted by SQS
+	Failed   uint64 // messages given up after retries
+	Dropped  uint64 // messages dropped because of a full buffer
+	Outboxed uint64 // messages stored in the outbox after retries
+	Replayed uint64 // messages sent from the outbox, also counted as sent
+}
+
+// UsageEmitter sends usage messages to SQS in the background. Messages are buffered, grouped
+// into batches of up to 10 and sent with SendMessageBatch on batch size or flush interval,
+// so usage tracking neither adds latency to requests nor surfaces SQS failures to callers.
+// Close must be called on shutdown to not lose buffered messages.
+type UsageEmitter struct {
+	client SQSSendMessageBatchAPI
+	cfg    UsageEmitterConfig
+	buffer chan UsageMessage
+	flush  chan chan struct{}
+	done   chan struct{}
+	stop   chan struct{}
+	// replayDone is closed when the outbox replay stops, it is closed right away without outbox
+	replayDone chan struct{}
+
+	mu       sync.RWMutex
+	closed   bool
+	sent     atomic.Uint64
+	failed   atomic.Uint64
+	dropped  atomic.Uint64
+	outboxed atomic.Uint64
+	replayed atomic.Uint64
+}
+
+// NewUsageEmitter starts a background emitter sending to the queue.
+func NewUsageEmitter(client SQSSendMessageBatchAPI, cfg UsageEmitterConfig) (*UsageEmitter, error) {
+	if cfg.QueueURL == "" {
+		return nil, fmt.Errorf("usage emitter - queue URL is empty")
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1000
+	}
+	if cfg.BatchSize <= 0 || cfg.BatchSize > maxSendMessageBatchEntries {
+		cfg.BatchSize = maxSendMessageBatchEntries
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(err error, messages []UsageMessage) {
+			log.Errorf("usage emitter - failed to send %d messages: %v", len(messages), err)
+		}
+	}
+
+	e := &UsageEmitter{
+		client: client,
+		cfg:    cfg,
+		buffer: make(chan UsageMessage, cfg.BufferSize),
+		flush:  make(chan chan struct{}),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+
+		replayDone: make(chan struct{}),
+	}
+	go e.run()
+	if cfg.Outbox != nil {
+		go e.replay()
+	} else {
+		close(e.replayDone)
+	}
+
+	return e, nil
+}
+
+// Emit buffers the message without waiting for it to be sent. It never blocks,
+// messages emitted to a full buffer are dropped.
+func (e *UsageEmitter) Emit(msg UsageMessage) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrUsageEmitterClosed
+	}
+
+	select {
+	case e.buffer <- msg:
+		return nil
+	default:
+		e.dropped.Add(1)
+		return ErrUsageBufferFull
+	}
+}
+
+// Stats returns the counters of the emitter.
+func (e *UsageEmitter) Stats() UsageEmitterStats {
+	return UsageEmitterStats{
+		Buffered: len(e.buffer),
+		Sent:     e.sent.Load(),
+		Failed:   e.failed.Load(),
+		Dropped:  e.dropped.Load(),
+		Outboxed: e.outboxed.Load(),
+		Replayed: e.replayed.Load(),
+	}
+}
+
+// Flush sends all messages buffered so far and waits until they are sent or ctx is done.
+func (e *UsageEmitter) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case e.flush <- ack:
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting messages, sends the buffered ones and waits until they are sent or ctx is done.
+// Outbox replay is stopped, messages left in the outbox are replayed by the next emitter using it.
+func (e *UsageEmitter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.buffer)
+		close(e.stop)
+	}
+	e.mu.Unlock()
+
+	for _, done := range []chan struct{}{e.done, e.replayDone} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (e *UsageEmitter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]UsageMessage, 0, e.cfg.BatchSize)
+	add := func(msg UsageMessage) {
+		batch = append(batch, msg)
+		if len(batch) >= e.cfg.BatchSize {
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case msg, ok := <-e.buffer:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			add(msg)
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		case ack := <-e.flush:
+		drain:
+			for {
+				select {
+				case msg, ok := <-e.buffer:
+					if !ok {
+						break drain
+					}
+					add(msg)
+				default:
+					break drain
+				}
+			}
+			e.send(batch)
+			batch = batch[:0]
+			close(ack)
+		}
+	}
+}
+
+// send sends the batch, resending messages SQS failed to accept until retries are exhausted.
+func (e *UsageEmitter) send(batch []UsageMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// messages are sent detached from any request, the request context is long gone by now
+	ctx := context.Background()
+
+	pending := append([]UsageMessage(nil), batch...)
+	backoff := e.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		failed, err := e.sendBatch(ctx, pending)
+		e.sent.Add(uint64(len(pending) - len(failed)))
+		if len(failed) == 0 {
+			return
+		}
+		if attempt == e.cfg.MaxRetries {
+			if e.cfg.Outbox != nil {
+				storeErr := e.cfg.Outbox.Store(failed)
+				if storeErr == nil {
+					e.outboxed.Add(uint64(len(failed)))
+					return
+				}
+				err = errors.Join(err, storeErr)
+			}
+			e.failed.Add(uint64(len(failed)))
+			e.cfg.OnError(err, failed)
+			return
+		}
+
+		pending = failed
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// replay sends messages of the outbox every ReplayInterval until Close. The interval is doubled
+// up to MaxBackoff while the queue keeps failing and reset once a replay succeeds.
+func (e *UsageEmitter) replay() {
+	defer close(e.replayDone)
+
+	outbox := e.cfg.Outbox
+	interval := outbox.cfg.ReplayInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-timer.C:
+		}
+
+		replayed, err := outbox.replay(func(messages []UsageMessage) ([]UsageMessage, error) {
+			return e.sendBatch(context.Background(), messages)
+		})
+		e.sent.Add(uint64(replayed))
+		e.replayed.Add(uint64(replayed))
+		if err != nil {
+			log.Errorf("usage emitter - failed to replay outbox: %v", err)
+			interval = min(interval*2, outbox.cfg.MaxBackoff)
+		} else {
+			interval = outbox.cfg.ReplayInterval
+		}
+		timer.Reset(interval)
+	}
+}
+
+// sendBatch sends messages with one SendMessageBatch call and returns the ones which were not accepted.
+func (e *UsageEmitter) sendBatch(ctx context.Context, messages []UsageMessage) ([]UsageMessage, error) {
+	entries := make([]types.SendMessageBatchRequestEntry, len(messages))
+	for i, msg := range messages {
+		body := msg.Body
+		if body == "" {
+			body = legacyUsageMessageBody
+		}
+		entries[i] = types.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       aws.String(body),
+			MessageAttributes: msg.Attributes,
+		}
+	}
+
+	out, err := e.client.SendMessageBatch(ctx, &awssqs.SendMessageBatchInput{
+		QueueUrl: aws.String(e.cfg.QueueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return messages, err
+	}
+	if len(out.Failed) == 0 {
+		return nil, nil
+	}
+
+	failed := make([]UsageMessage, 0, len(out.Failed))
+	for _, f := range out.Failed {
+		i, convErr := strconv.Atoi(aws.ToString(f.Id))
+		if convErr != nil || i < 0 || i >= len(messages) {
+			continue
+		}
+		failed = append(failed, messages[i])
+		err = fmt.Errorf("usage emitter - %s: %s", aws.ToString(f.Code), aws.ToString(f.Message))
+	}
+
+	return failed, err
+}
@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingBatchQueue records SendMessageBatch calls, failing the first fails entries of every call
+// or the whole call while callErrors is positive.
+type recordingBatchQueue struct {
+	mu         sync.Mutex
+	batches    [][]types.SendMessageBatchRequestEntry
+	fails      int
+	callErrors int
+}
+
+func (q *recordingBatchQueue) SendMessageBatch(_ context.Context, params *awssqs.SendMessageBatchInput, _ ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if aws.ToString(params.QueueUrl) != "foo_queue" {
+		return nil, fmt.Errorf("unexpected queue %s", aws.ToString(params.QueueUrl))
+	}
+	if q.callErrors > 0 {
+		q.callErrors--
+		return nil, fmt.Errorf("foo sqs")
+	}
+
+	out := &awssqs.SendMessageBatchOutput{}
+	var accepted []types.SendMessageBatchRequestEntry
+	for i, entry := range params.Entries {
+		if i < q.fails {
+			out.Failed = append(out.Failed, types.BatchResultErrorEntry{Id: entry.Id, Code: aws.String("foo_code"), Message: aws.String("foo message")})
+			continue
+		}
+		accepted = append(accepted, entry)
+	}
+	q.batches = append(q.batches, accepted)
+
+	return out, nil
+}
+
+func (q *recordingBatchQueue) sizes() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var sizes []int
+	for _, b := range q.batches {
+		sizes = append(sizes, len(b))
+	}
+
+	return sizes
+}
+
+func usageMessage(i int) UsageMessage {
+	return UsageMessage{Attributes: map[string]types.MessageAttributeValue{
+		"tenant_id": {DataType: aws.String("String"), StringValue: aws.String(fmt.Sprint(i))},
+	}}
+}
+
+func TestNewUsageEmitter(t *testing.T) {
+	_, err := NewUsageEmitter(&recordingBatchQueue{}, UsageEmitterConfig{})
+	assert.EqualError(t, err, "usage emitter - queue URL is empty")
+}
+
+func TestUsageEmitter(t *testing.T) {
+	tests := []struct {
+		name       string
+		queue      *recordingBatchQueue
+		cfg        UsageEmitterConfig
+		emits      int
+		flush      bool
+		wantSizes  []int
+		wantStats  UsageEmitterStats
+		wantFailed int
+	}{
+		{
+			name:      "ShouldSendInBatchesOnClose",
+			queue:     &recordingBatchQueue{},
+			cfg:       UsageEmitterConfig{FlushInterval: time.Hour},
+			emits:     23,
+			wantSizes: []int{10, 10, 3},
+			wantStats: UsageEmitterStats{Sent: 23},
+		},
+		{
+			name:      "ShouldLimitBatchSize",
+			queue:     &recordingBatchQueue{},
+			cfg:       UsageEmitterConfig{FlushInterval: time.Hour, BatchSize: 50},
+			emits:     12,
+			wantSizes: []int{10, 2},
+			wantStats: UsageEmitterStats{Sent: 12},
+		},
+		{
+			name:      "ShouldSendOnFlush",
+			queue:     &recordingBatchQueue{},
+			cfg:       UsageEmitterConfig{FlushInterval: time.Hour},
+			emits:     3,
+			flush:     true,
+			wantSizes: []int{3},
+			wantStats: UsageEmitterStats{Sent: 3},
+		},
+		{
+			name:      "ShouldSendOnInterval",
+			queue:     &recordingBatchQueue{},
+			cfg:       UsageEmitterConfig{FlushInterval: time.Millisecond},
+			emits:     1,
+			wantSizes: []int{1},
+			wantStats: UsageEmitterStats{Sent: 1},
+		},
+		{
+			name:       "ShouldResendFailedEntries",
+			queue:      &recordingBatchQueue{fails: 1},
+			cfg:        UsageEmitterConfig{FlushInterval: time.Hour, RetryBackoff: time.Millisecond, MaxRetries: 1},
+			emits:      3,
+			wantSizes:  []int{2, 0},
+			wantStats:  UsageEmitterStats{Sent: 2, Failed: 1},
+			wantFailed: 1,
+		},
+		{
+			name:      "ShouldRetryFailedCall",
+			queue:     &recordingBatchQueue{callErrors: 2},
+			cfg:       UsageEmitterConfig{FlushInterval: time.Hour, RetryBackoff: time.Millisecond},
+			emits:     2,
+			wantSizes: []int{2},
+			wantStats: UsageEmitterStats{Sent: 2},
+		},
+		{
+			name:       "ShouldReportErrorAfterRetries",
+			queue:      &recordingBatchQueue{callErrors: 3},
+			cfg:        UsageEmitterConfig{FlushInterval: time.Hour, RetryBackoff: time.Millisecond, MaxRetries: 2},
+			emits:      2,
+			wantStats:  UsageEmitterStats{Failed: 2},
+			wantFailed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failed := 0
+			tt.cfg.QueueURL = "foo_queue"
+			tt.cfg.OnError = func(err error, messages []UsageMessage) {
+				assert.Error(t, err)
+				failed += len(messages)
+			}
+
+			e, err := NewUsageEmitter(tt.queue, tt.cfg)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for i := 0; i < tt.emits; i++ {
+				assert.NoError(t, e.Emit(usageMessage(i)))
+			}
+
+			if tt.flush {
+				assert.NoError(t, e.Flush(context.Background()))
+				assert.Equal(t, tt.wantSizes, tt.queue.sizes())
+			}
+			if tt.cfg.FlushInterval == time.Millisecond {
+				time.Sleep(50 * time.Millisecond)
+				assert.Equal(t, tt.wantSizes, tt.queue.sizes())
+			}
+
+			assert.NoError(t, e.Close(context.Background()))
+			assert.Equal(t, tt.wantSizes, tt.queue.sizes())
+			assert.Equal(t, tt.wantStats, e.Stats())
+			assert.Equal(t, tt.wantFailed, failed)
+			assert.ErrorIs(t, e.Emit(usageMessage(0)), ErrUsageEmitterClosed)
+		})
+	}
+}
+
+func TestUsageEmitter_overflow(t *testing.T) {
+	e := &UsageEmitter{buffer: make(chan UsageMessage, 1)}
+
+	assert.NoError(t, e.Emit(usageMessage(0)))
+	assert.ErrorIs(t, e.Emit(usageMessage(1)), ErrUsageBufferFull)
+	assert.Equal(t, UsageEmitterStats{Buffered: 1, Dropped: 1}, e.Stats())
+}
+
+func TestUsageConfig_emitter(t *testing.T) {
+	queue := &recordingBatchQueue{}
+	emitter, err := NewUsageEmitter(queue, UsageEmitterConfig{QueueURL: "foo_queue", FlushInterval: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cfg := &UsageConfig{ProductID: productID, MemoryMB: 1234, Emitter: emitter}
+	h, err := cfg.toMiddleware(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	e := echo.New()
+	cc := &Context{
+		Context:  e.NewContext(httptest.NewRequest(http.MethodGet, "/workflows/42", nil), httptest.NewRecorder()),
+		TenantID: tenantID,
+	}
+	cc.SetPath("/workflows/:id")
+	assert.NoError(t, h(func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})(cc))
+
+	assert.NoError(t, emitter.Close(context.Background()))
+	if !assert.Equal(t, []int{1}, queue.sizes()) {
+		return
+	}
+	entry := queue.batches[0][0]
+	assert.Equal(t, tenantID.String(), aws.ToString(entry.MessageAttributes["tenant_id"].StringValue))
+
+	var event UsageEvent
+	assert.NoError(t, json.Unmarshal([]byte(aws.ToString(entry.MessageBody)), &event))
+	assert.Equal(t, tenantID, event.TenantID)
+	assert.Equal(t, "/workflows/:id", event.Workflow)
+	assert.Equal(t, http.StatusNoContent, event.StatusCode)
+}
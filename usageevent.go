@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+// UsageEventVersion is the schema version of UsageEvent written by this package.
+const UsageEventVersion = 1
+
+// UsageEvent is the usage of a service by a tenant, sent as JSON body of usage messages.
+type UsageEvent struct {
+	Version    int              `json:"version"`
+	ProductID  uuid.UUID        `json:"product_id"`
+	TenantID   uuid.UUID        `json:"tenant_id"`
+	RequestID  uuid.UUID        `json:"request_id"`
+	Subject    string           `json:"subject,omitempty"` // `sub` claim of the token, pseudonymized if UsageConfig.Pseudonymizer is set
+	Workflow   string           `json:"workflow"`
+	Method     string           `json:"method,omitempty"`
+	StatusCode int              `json:"status_code,omitempty"`
+	MemoryMB   int              `json:"memory_mb"`
+	Units      map[string]int64 `json:"units,omitempty"` // recorded by handlers with Context.RecordUsage
+	StartTime  time.Time        `json:"start_timestamp"` // RFC 3339 with nanoseconds in UTC
+	EndTime    time.Time        `json:"end_timestamp"`
+	DurationMS float64          `json:"duration_ms"`
+	Billing    string           `json:"billing,omitempty"` // UsageBilled or UsageNotBilled, usage without is billed
+	// BillingPolicy names the policy deciding Billing, "custom" for a BillingFunc
+	BillingPolicy string `json:"billing_policy,omitempty"`
+}
+
+// newUsageEvent returns the event with version, UTC timestamps and duration set.
+func newUsageEvent(event UsageEvent) UsageEvent {
+	event.Version = UsageEventVersion
+	event.StartTime, event.EndTime = event.StartTime.UTC(), event.EndTime.UTC()
+	event.DurationMS = float64(event.EndTime.Sub(event.StartTime).Microseconds()) / 1000
+
+	return event
+}
+
+// newUsageMessage encodes the event as message body. Attributes carry only what queues
+// and consumers need to route the message without decoding the body.
+func newUsageMessage(event UsageEvent) (UsageMessage, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return UsageMessage{}, err
+	}
+
+	return UsageMessage{
+		Body: string(body),
+		Attributes: map[string]types.MessageAttributeValue{
+			"version":    stringAttribute(strconv.Itoa(event.Version)),
+			"product_id": stringAttribute(event.ProductID.String()),
+			"tenant_id":  stringAttribute(event.TenantID.String()),
+		},
+	}, nil
+}
+
+func stringAttribute(v string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(v),
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUsageMessage(t *testing.T) {
+	start := time.Date(2024, 6, 18, 14, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	full := newUsageEvent(UsageEvent{
+		ProductID:     productID,
+		TenantID:      tenantID,
+		RequestID:     requestID,
+		Subject:       userID,
+		Workflow:      "/workflows/:id",
+		Method:        "POST",
+		StatusCode:    201,
+		MemoryMB:      1024,
+		Units:         map[string]int64{"rows": 5000, "bytes": 1 << 20},
+		StartTime:     start,
+		EndTime:       start.Add(1500*time.Millisecond + 250*time.Microsecond),
+		Billing:       UsageBilled,
+		BillingPolicy: "successes",
+	})
+	minimal := newUsageEvent(UsageEvent{
+		ProductID: productID,
+		TenantID:  tenantID,
+		Workflow:  "nightly-export",
+		MemoryMB:  512,
+		StartTime: start,
+		EndTime:   start.Add(time.Minute),
+	})
+
+	tests := []struct {
+		name   string
+		event  UsageEvent
+		golden string
+	}{
+		{name: "ShouldEncodeRequestUsage", event: full, golden: "request.golden"},
+		{name: "ShouldOmitEmptyRequestFields", event: minimal, golden: "minimal.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := newUsageMessage(tt.event)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			attributes := map[string]string{}
+			for k, v := range msg.Attributes {
+				assert.Equal(t, "String", *v.DataType)
+				attributes[k] = *v.StringValue
+			}
+			attributesJSON, err := json.Marshal(attributes)
+			if !assert.NoError(t, err) {
+				return
+			}
+			got := msg.Body + "\n" + string(attributesJSON)
+
+			path := filepath.Join("testdata", "usageevent", tt.golden)
+			if *update {
+				assert.NoError(t, os.WriteFile(path, []byte(got+"\n"), 0o644))
+			}
+			want, err := os.ReadFile(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, string(bytes.TrimSuffix(want, []byte("\n"))), got)
+
+			var decoded UsageEvent
+			assert.NoError(t, json.Unmarshal([]byte(msg.Body), &decoded))
+			assert.Equal(t, tt.event, decoded)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// unlimitedCgroupMemory is the limit from which cgroup v1 memory limits mean no limit,
+// unlimited groups report the largest page aligned int64.
+const unlimitedCgroupMemory = 1 << 62
+
+// memoryDetector finds the memory limit of the runtime. Sources are fields so tests can use fixtures.
+type memoryDetector struct {
+	getenv    func(key string) string
+	cgroupDir string
+}
+
+var defaultMemoryDetector = memoryDetector{getenv: os.Getenv, cgroupDir: "/sys/fs/cgroup"}
+
+// DetectMemoryMB returns the memory limit of the runtime in MB, read from AWS_LAMBDA_FUNCTION_MEMORY_SIZE
+// or the cgroup v2 or v1 memory limit, in that order. ECS enforces the memory limits of tasks and
+// containers through cgroups, so their limits are found there.
+func DetectMemoryMB() (int, error) {
+	return defaultMemoryDetector.detect()
+}
+
+// usageMemoryMB returns memoryMB, or the detected memory limit when it is 0.
+func usageMemoryMB(memoryMB int) (int, error) {
+	if memoryMB < 0 {
+		return 0, fmt.Errorf("memory MB %d is negative", memoryMB)
+	}
+	if memoryMB > 0 {
+		return memoryMB, nil
+	}
+
+	detected, err := DetectMemoryMB()
+	if err != nil {
+		return 0, fmt.Errorf("memory MB is not set and cannot be detected: %w", err)
+	}
+
+	return detected, nil
+}
+
+func (d memoryDetector) detect() (int, error) {
+	sources := []struct {
+		name   string
+		detect func() (int, error)
+	}{
+		{name: "lambda", detect: d.lambda},
+		{name: "cgroup v2", detect: d.cgroupV2},
+		{name: "cgroup v1", detect: d.cgroupV1},
+	}
+	for _, source := range sources {
+		memoryMB, err := source.detect()
+		if err != nil {
+			return 0, fmt.Errorf("%s memory: %w", source.name, err)
+		}
+		if memoryMB > 0 {
+			return memoryMB, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no memory limit found")
+}
+
+func (d memoryDetector) lambda() (int, error) {
+	size := d.getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")
+	if size == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(size)
+}
+
+func (d memoryDetector) cgroupV2() (int, error) {
+	limit, err := readCgroupLimit(filepath.Join(d.cgroupDir, "memory.max"))
+	if err != nil || limit == "max" {
+		return 0, err
+	}
+
+	return bytesToMB(limit)
+}
+
+func (d memoryDetector) cgroupV1() (int, error) {
+	limit, err := readCgroupLimit(filepath.Join(d.cgroupDir, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return 0, err
+	}
+
+	return bytesToMB(limit)
+}
+
+// readCgroupLimit returns the content of the limit file, empty if the file does not exist.
+func readCgroupLimit(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func bytesToMB(limit string) (int, error) {
+	if limit == "" {
+		return 0, nil
+	}
+	bytes, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if bytes >= unlimitedCgroupMemory {
+		return 0, nil
+	}
+
+	return int(bytes >> 20), nil
+}
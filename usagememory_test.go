@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDetector_detect(t *testing.T) {
+	fixtures := filepath.Join("testdata", "memory")
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		cgroupDir  string
+		want       int
+		wantErrMsg string
+	}{
+		{
+			name:      "ShouldPreferLambda",
+			env:       map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "2048"},
+			cgroupDir: filepath.Join(fixtures, "cgroupv2"),
+			want:      2048,
+		},
+		{
+			name:      "ShouldDetectCgroupV2",
+			cgroupDir: filepath.Join(fixtures, "cgroupv2"),
+			want:      1024,
+		},
+		{
+			name:      "ShouldDetectCgroupV1",
+			cgroupDir: filepath.Join(fixtures, "cgroupv1"),
+			want:      256,
+		},
+		{
+			name:       "ShouldErrorOnUnlimitedCgroupV2",
+			cgroupDir:  filepath.Join(fixtures, "cgroupv2_unlimited"),
+			wantErrMsg: "no memory limit found",
+		},
+		{
+			name:       "ShouldErrorOnUnlimitedCgroupV1",
+			cgroupDir:  filepath.Join(fixtures, "cgroupv1_unlimited"),
+			wantErrMsg: "no memory limit found",
+		},
+		{
+			name:       "ShouldErrorWithoutSources",
+			cgroupDir:  filepath.Join(fixtures, "missing"),
+			wantErrMsg: "no memory limit found",
+		},
+		{
+			name:       "ShouldErrorOnMalformedLambda",
+			env:        map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "2GB"},
+			wantErrMsg: `lambda memory: strconv.Atoi: parsing "2GB": invalid syntax`,
+		},
+		{
+			name:       "ShouldErrorOnMalformedCgroup",
+			cgroupDir:  filepath.Join(fixtures, "cgroup_malformed"),
+			wantErrMsg: `cgroup v2 memory: strconv.ParseInt: parsing "1G": invalid syntax`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := memoryDetector{
+				getenv:    func(key string) string { return tt.env[key] },
+				cgroupDir: tt.cgroupDir,
+			}
+
+			got, err := d.detect()
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// ErrUsageOutboxFull is returned by UsageOutbox.Store when storing messages would exceed MaxBytes.
+var ErrUsageOutboxFull = errors.New("usage outbox is full")
+
+// UsageOutboxConfig defines the config for NewUsageOutbox.
+type UsageOutboxConfig struct {
+	Path           string
+	MaxBytes       int64         // Optional, defaults to 64 MB, messages are dropped once reached
+	ReplayInterval time.Duration // Optional, defaults to 30s, doubled after every failed replay
+	MaxBackoff     time.Duration // Optional, defaults to 10m
+}
+
+// UsageOutboxStats are counters of a UsageOutbox.
+type UsageOutboxStats struct {
+	Depth     int    // messages waiting for replay
+	Bytes     int64  // size of the outbox file
+	Dropped   uint64 // messages dropped because the outbox was full
+	Corrupted uint64 // unreadable lines skipped, e.g. partially written before a crash
+}
+
+// UsageOutbox is an append-only local file keeping usage messages UsageEmitter failed to send,
+// so they are replayed once the queue recovers instead of being lost. Every line holds one message
+// prefixed with its CRC-32, corrupted lines are skipped when the outbox is read.
+type UsageOutbox struct {
+	cfg UsageOutboxConfig
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	depth     int
+	dropped   atomic.Uint64
+	corrupted atomic.Uint64
+}
+
+// outboxMessage is the stored form of a UsageMessage.
+type outboxMessage struct {
+	Body       string                     `json:"body"`
+	Attributes map[string]outboxAttribute `json:"attributes,omitempty"`
+}
+
+type outboxAttribute struct {
+	DataType string  `json:"type"`
+	String   *string `json:"string,omitempty"`
+	Binary   []byte  `json:"binary,omitempty"`
+}
+
+// NewUsageOutbox opens the outbox file, creating it if needed, and counts the messages it holds.
+func NewUsageOutbox(cfg UsageOutboxConfig) (*UsageOutbox, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("usage outbox - path is empty")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 64 << 20
+	}
+	if cfg.ReplayInterval <= 0 {
+		cfg.ReplayInterval = 30 * time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Minute
+	}
+
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// persist the directory entry of a created outbox
+	if err := syncDir(filepath.Dir(cfg.Path)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// corrupted lines are counted when the first replay removes them
+	o := &UsageOutbox{cfg: cfg, file: file}
+	messages, size, _, err := o.read(0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	o.depth, o.size = len(messages), size
+
+	return o, nil
+}
+
+// Store appends the messages to the outbox. Nothing is stored if they do not fit within MaxBytes.
+func (o *UsageOutbox) Store(messages []UsageMessage) error {
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		if err := writeOutboxLine(&buf, msg); err != nil {
+			return err
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.size+int64(buf.Len()) > o.cfg.MaxBytes {
+		o.dropped.Add(uint64(len(messages)))
+		return ErrUsageOutboxFull
+	}
+	n, err := o.file.Write(buf.Bytes())
+	o.size += int64(n)
+	if err != nil {
+		return err
+	}
+	o.depth += len(messages)
+
+	// the messages are only kept once they reach the disk, not the page cache
+	return o.file.Sync()
+}
+
+// Stats returns the counters of the outbox.
+func (o *UsageOutbox) Stats() UsageOutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return UsageOutboxStats{
+		Depth:     o.depth,
+		Bytes:     o.size,
+		Dropped:   o.dropped.Load(),
+		Corrupted: o.corrupted.Load(),
+	}
+}
+
+// Close closes the outbox file, stored messages are replayed by the next outbox opened on the path.
+func (o *UsageOutbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.file.Close()
+}
+
+// replay sends stored messages with send, which returns the messages it failed to send, and keeps
+// the unsent ones together with messages stored in the meantime. The file is not locked while sending.
+func (o *UsageOutbox) replay(send func(messages []UsageMessage) ([]UsageMessage, error)) (int, error) {
+	o.mu.Lock()
+	messages, offset, corrupted, err := o.read(0)
+	o.mu.Unlock()
+	if err != nil || len(messages) == 0 && corrupted == 0 {
+		return 0, err
+	}
+
+	var unsent []UsageMessage
+	var sendErr error
+	for start := 0; start < len(messages); start += maxSendMessageBatchEntries {
+		batch := messages[start:min(start+maxSendMessageBatchEntries, len(messages))]
+		if sendErr != nil {
+			// the queue is still down, keep the rest for the next replay
+			unsent = append(unsent, batch...)
+			continue
+		}
+
+		failed, err := send(batch)
+		unsent = append(unsent, failed...)
+		if err != nil && len(failed) == len(batch) {
+			sendErr = err
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stored, _, storedCorrupted, err := o.read(offset)
+	if err != nil {
+		return 0, err
+	}
+	if err := o.rewrite(append(unsent, stored...)); err != nil {
+		return 0, err
+	}
+	o.corrupted.Add(uint64(corrupted + storedCorrupted))
+
+	return len(messages) - len(unsent), sendErr
+}
+
+// read returns the messages stored from offset on, the size of the file and the number of skipped corrupted lines.
+func (o *UsageOutbox) read(offset int64) ([]UsageMessage, int64, int, error) {
+	info, err := o.file.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size := info.Size()
+
+	var messages []UsageMessage
+	corrupted := 0
+	r := bufio.NewReader(io.NewSectionReader(o.file, offset, size-offset))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if msg, ok := parseOutboxLine(line); ok {
+				messages = append(messages, msg)
+			} else {
+				corrupted++
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return messages, size, corrupted, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+}
+
+// rewrite replaces the content of the outbox with the messages. The new content is written and synced
+// to a temporary file first, renamed over the outbox and the rename synced, so a crash leaves either
+// the old or the new outbox behind.
+func (o *UsageOutbox) rewrite(messages []UsageMessage) error {
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		if err := writeOutboxLine(&buf, msg); err != nil {
+			return err
+		}
+	}
+
+	tmp := o.cfg.Path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.cfg.Path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(o.cfg.Path)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(o.cfg.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	o.file.Close()
+	o.file, o.size, o.depth = file, int64(buf.Len()), len(messages)
+
+	return nil
+}
+
+// writeFileSync writes data to the file at path and syncs it to disk.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir syncs the directory, persisting renames of its entries.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// writeOutboxLine writes the message as a line of CRC-32 in hex, a space and the message as JSON.
+func writeOutboxLine(w *bytes.Buffer, msg UsageMessage) error {
+	stored := outboxMessage{Body: msg.Body}
+	for k, v := range msg.Attributes {
+		if stored.Attributes == nil {
+			stored.Attributes = make(map[string]outboxAttribute, len(msg.Attributes))
+		}
+		stored.Attributes[k] = outboxAttribute{DataType: aws.ToString(v.DataType), String: v.StringValue, Binary: v.BinaryValue}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%08x %s\n", crc32.ChecksumIEEE(data), data)
+
+	return nil
+}
+
+func parseOutboxLine(line []byte) (UsageMessage, bool) {
+	line, ok := bytes.CutSuffix(line, []byte("\n"))
+	if !ok {
+		return UsageMessage{}, false
+	}
+	sum, data, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return UsageMessage{}, false
+	}
+	if want, err := strconv.ParseUint(string(sum), 16, 32); err != nil || uint32(want) != crc32.ChecksumIEEE(data) {
+		return UsageMessage{}, false
+	}
+
+	var stored outboxMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return UsageMessage{}, false
+	}
+
+	msg := UsageMessage{Body: stored.Body}
+	for k, v := range stored.Attributes {
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]types.MessageAttributeValue, len(stored.Attributes))
+		}
+		msg.Attributes[k] = types.MessageAttributeValue{DataType: aws.String(v.DataType), StringValue: v.String, BinaryValue: v.Binary}
+	}
+
+	return msg, true
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUsageOutbox(t *testing.T, cfg UsageOutboxConfig) *UsageOutbox {
+	t.Helper()
+
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join(t.TempDir(), "usage.outbox")
+	}
+	o, err := NewUsageOutbox(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+
+	return o
+}
+
+func usageMessages(n int) []UsageMessage {
+	messages := make([]UsageMessage, n)
+	for i := range messages {
+		messages[i] = usageMessage(i)
+	}
+
+	return messages
+}
+
+func TestNewUsageOutbox(t *testing.T) {
+	_, err := NewUsageOutbox(UsageOutboxConfig{})
+	assert.EqualError(t, err, "usage outbox - path is empty")
+}
+
+func TestUsageOutbox_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.outbox")
+	o, err := NewUsageOutbox(UsageOutboxConfig{Path: path})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	messages := []UsageMessage{
+		{Body: `{"version":1}`, Attributes: map[string]types.MessageAttributeValue{
+			"version":   stringAttribute("1"),
+			"signature": {DataType: aws.String("Binary"), BinaryValue: []byte{0x00, 0xff}},
+		}},
+		usageMessage(1),
+	}
+	assert.NoError(t, o.Store(messages))
+	stats := o.Stats()
+	assert.NoError(t, o.Close())
+
+	o = newTestUsageOutbox(t, UsageOutboxConfig{Path: path})
+	assert.Equal(t, stats, o.Stats())
+	assert.Equal(t, 2, stats.Depth)
+
+	var replayed []UsageMessage
+	n, err := o.replay(func(messages []UsageMessage) ([]UsageMessage, error) {
+		replayed = append(replayed, messages...)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, messages, replayed)
+	assert.Equal(t, UsageOutboxStats{}, o.Stats())
+}
+
+func TestUsageOutbox_corrupted(t *testing.T) {
+	var valid bytes.Buffer
+	assert.NoError(t, writeOutboxLine(&valid, usageMessage(1)))
+	line := valid.String()
+
+	path := filepath.Join(t.TempDir(), "usage.outbox")
+	content := line +
+		"not a line\n" +
+		"00000000" + line[8:] + // checksum mismatch
+		line[:len(line)/2] // truncated by a crash
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	o := newTestUsageOutbox(t, UsageOutboxConfig{Path: path})
+	assert.Equal(t, UsageOutboxStats{Depth: 1, Bytes: int64(len(content))}, o.Stats())
+
+	var replayed []UsageMessage
+	n, err := o.replay(func(messages []UsageMessage) ([]UsageMessage, error) {
+		replayed = append(replayed, messages...)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []UsageMessage{usageMessage(1)}, replayed)
+	assert.Equal(t, UsageOutboxStats{Corrupted: 3}, o.Stats())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestUsageOutbox_full(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeOutboxLine(&buf, usageMessage(0)))
+	lineSize := int64(buf.Len())
+
+	o := newTestUsageOutbox(t, UsageOutboxConfig{MaxBytes: 3 * lineSize})
+
+	assert.NoError(t, o.Store(usageMessages(2)))
+	assert.ErrorIs(t, o.Store(usageMessages(2)), ErrUsageOutboxFull)
+	assert.NoError(t, o.Store(usageMessages(1)))
+	assert.Equal(t, UsageOutboxStats{Depth: 3, Bytes: 3 * lineSize, Dropped: 2}, o.Stats())
+}
+
+func TestUsageOutbox_replay(t *testing.T) {
+	tests := []struct {
+		name         string
+		stored       int
+		send         func(messages []UsageMessage) ([]UsageMessage, error)
+		wantErr      bool
+		wantReplayed int
+		wantDepth    int
+		wantCalls    int
+	}{
+		{
+			name:   "ShouldReplayInBatches",
+			stored: 23,
+			send: func([]UsageMessage) ([]UsageMessage, error) {
+				return nil, nil
+			},
+			wantReplayed: 23,
+			wantCalls:    3,
+		},
+		{
+			name:   "ShouldKeepFailedEntries",
+			stored: 23,
+			send: func(messages []UsageMessage) ([]UsageMessage, error) {
+				return messages[:1], fmt.Errorf("foo_code: foo message")
+			},
+			wantReplayed: 20,
+			wantDepth:    3,
+			wantCalls:    3,
+		},
+		{
+			name:   "ShouldStopWhileQueueIsDown",
+			stored: 23,
+			send: func(messages []UsageMessage) ([]UsageMessage, error) {
+				return messages, fmt.Errorf("foo sqs")
+			},
+			wantErr:   true,
+			wantDepth: 23,
+			wantCalls: 1,
+		},
+		{
+			name: "ShouldSkipEmptyOutbox",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestUsageOutbox(t, UsageOutboxConfig{})
+			if tt.stored > 0 {
+				assert.NoError(t, o.Store(usageMessages(tt.stored)))
+			}
+
+			calls := 0
+			n, err := o.replay(func(messages []UsageMessage) ([]UsageMessage, error) {
+				calls++
+				return tt.send(messages)
+			})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantReplayed, n)
+			assert.Equal(t, tt.wantDepth, o.Stats().Depth)
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestUsageOutbox_replayKeepsStoredMessages(t *testing.T) {
+	o := newTestUsageOutbox(t, UsageOutboxConfig{})
+	assert.NoError(t, o.Store(usageMessages(2)))
+
+	n, err := o.replay(func(messages []UsageMessage) ([]UsageMessage, error) {
+		// the emitter keeps storing failed messages while the outbox is replayed
+		assert.NoError(t, o.Store([]UsageMessage{usageMessage(2)}))
+		return messages[1:], nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, o.Stats().Depth)
+
+	var replayed []UsageMessage
+	_, err = o.replay(func(messages []UsageMessage) ([]UsageMessage, error) {
+		replayed = append(replayed, messages...)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []UsageMessage{usageMessage(1), usageMessage(2)}, replayed)
+}
+
+func TestUsageEmitter_outbox(t *testing.T) {
+	queue := &recordingBatchQueue{callErrors: 1}
+	outbox := newTestUsageOutbox(t, UsageOutboxConfig{ReplayInterval: time.Millisecond})
+	e, err := NewUsageEmitter(queue, UsageEmitterConfig{
+		QueueURL:      "foo_queue",
+		FlushInterval: time.Hour,
+		MaxRetries:    -1,
+		OnError: func(err error, messages []UsageMessage) {
+			t.Errorf("unexpected error %v for %d messages", err, len(messages))
+		},
+		Outbox: outbox,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, e.Emit(usageMessage(0)))
+	assert.NoError(t, e.Emit(usageMessage(1)))
+	assert.NoError(t, e.Flush(context.Background()))
+	assert.Eventually(t, func() bool {
+		return e.Stats().Replayed == 2
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, []int{2}, queue.sizes())
+	assert.Equal(t, UsageEmitterStats{Sent: 2, Outboxed: 2, Replayed: 2}, e.Stats())
+	assert.Equal(t, 0, outbox.Stats().Depth)
+}
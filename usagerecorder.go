@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	"github.com/grasp-labs/go-libs/aws/sqs"
+	"github.com/labstack/gommon/log"
+)
+
+// UsageRecorderConfig defines the config for NewUsageRecorder.
+type UsageRecorderConfig struct {
+	ProductID     uuid.UUID
+	MemoryMB      int            // Optional, detected with DetectMemoryMB when 0
+	Pseudonymizer *Pseudonymizer // Optional, see UsageConfig.Pseudonymizer
+	Emitter       *UsageEmitter  // Optional, see UsageConfig.Emitter
+	BillingPolicy BillingPolicy  // Optional, see UsageConfig.BillingPolicy
+	BillingFunc   BillingFunc    // Optional, see UsageConfig.BillingFunc
+}
+
+// UsageRecorder records usage of work done outside of requests, e.g. by queue consumers and cron jobs.
+// It sends the same UsageEvent to the same queue as UsageWithConfig.
+type UsageRecorder struct {
+	productID     uuid.UUID
+	memoryMB      int
+	pseudonymizer *Pseudonymizer
+	emitter       *UsageEmitter
+	sqsClient     sqs.ClientSqs
+	billing       usageBilling
+}
+
+// NewUsageRecorder returns a recorder sending usage to the queue of the building mode, or of queueName
+// if given, unless cfg.Emitter is set.
+func NewUsageRecorder(ctx context.Context, cfg UsageRecorderConfig, queueName ...string) (*UsageRecorder, error) {
+	if cfg.Emitter != nil {
+		return newUsageRecorder(cfg, nil)
+	}
+
+	name, err := usageQueueName(queueName...)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sqs.NewClient(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUsageRecorder(cfg, client)
+}
+
+func newUsageRecorder(cfg UsageRecorderConfig, sqsClient sqs.ClientSqs) (*UsageRecorder, error) {
+	if cfg.ProductID == uuid.Nil {
+		return nil, fmt.Errorf("usage recorder - product id is nil")
+	}
+	memoryMB, err := usageMemoryMB(cfg.MemoryMB)
+	if err != nil {
+		return nil, fmt.Errorf("usage recorder - %w", err)
+	}
+	if err := cfg.BillingPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("usage recorder - %w", err)
+	}
+
+	return &UsageRecorder{
+		productID:     cfg.ProductID,
+		memoryMB:      memoryMB,
+		pseudonymizer: cfg.Pseudonymizer,
+		emitter:       cfg.Emitter,
+		sqsClient:     sqsClient,
+		billing:       usageBilling{policy: cfg.BillingPolicy, billingFunc: cfg.BillingFunc},
+	}, nil
+}
+
+// usageQueueName returns queueName if given, the usage queue of the building mode otherwise.
+func usageQueueName(queueName ...string) (string, error) {
+	if len(queueName) != 0 {
+		return queueName[0], nil
+	}
+
+	switch os.Getenv("BUILDING_MODE") {
+	case "test":
+		return "daas-service-cost-handler-usage-queue-test", nil
+	case "dev":
+		return "daas-service-cost-handler-usage-queue-dev", nil
+	case "prod":
+		return "daas-service-cost-handler-usage-queue-prod", nil
+	default:
+		return "", fmt.Errorf("unknown building mode!")
+	}
+}
+
+// Record sends the usage of the event. ProductID and MemoryMB default to the ones of the recorder,
+// the schema version, duration and billing decision are set by the recorder.
+func (r *UsageRecorder) Record(ctx context.Context, event UsageEvent) error {
+	return r.record(ctx, event, nil)
+}
+
+// record sends the usage of the event, billed by the billing policy for its status and err.
+func (r *UsageRecorder) record(ctx context.Context, event UsageEvent, err error) error {
+	if event.TenantID == uuid.Nil {
+		return fmt.Errorf("usage recorder - tenant id is nil")
+	}
+	if event.ProductID == uuid.Nil {
+		event.ProductID = r.productID
+	}
+	if event.MemoryMB == 0 {
+		event.MemoryMB = r.memoryMB
+	}
+
+	// the legacy format keeps timestamps in the zone they were taken in
+	startTime, endTime := event.StartTime, event.EndTime
+	event = newUsageEvent(event)
+	billed := r.billing.decide(&event, err)
+	if r.pseudonymizer != nil && event.Subject != "" {
+		// usage is billed without the subject rather than lost
+		subject, err := r.pseudonymizer.UserID(ctx, event.TenantID, event.Subject)
+		if err != nil {
+			log.Errorf("usage recorder - failed to pseudonymize user: %v", err)
+		}
+		event.Subject = subject
+	}
+
+	if r.emitter == nil {
+		if !billed {
+			// consumers of the legacy format bill every message, usage not billed is dropped
+			return nil
+		}
+		return r.sqsClient.SendMsg(ctx, r.legacyAttributes(event, startTime, endTime))
+	}
+	msg, err := newUsageMessage(event)
+	if err != nil {
+		return fmt.Errorf("usage recorder - failed to encode usage: %w", err)
+	}
+
+	return r.emitter.Emit(msg)
+}
+
+// Track runs fn and records its usage for the tenant under a new request ID. The error of fn is
+// returned, failing to record usage does not fail the work and is logged.
+func (r *UsageRecorder) Track(ctx context.Context, tenantID uuid.UUID, workflow string, fn func() error) error {
+	startTime := time.Now()
+	err := fn()
+	endTime := time.Now()
+
+	if recordErr := r.record(ctx, UsageEvent{
+		TenantID:  tenantID,
+		RequestID: uuid.New(),
+		Workflow:  workflow,
+		StartTime: startTime,
+		EndTime:   endTime,
+	}, err); recordErr != nil {
+		log.Errorf("usage recorder - failed to record usage of %s: %v", workflow, recordErr)
+	}
+
+	return err
+}
+
+// legacyAttributes returns the usage as message attributes, as sent before UsageEvent was introduced.
+// The go-libs SQS client sends attributes only, consumers of its queues still decode this format.
+// The billing decision is added for reconciliation, SQS allows at most 10 attributes per message.
+func (r *UsageRecorder) legacyAttributes(event UsageEvent, startTime, endTime time.Time) map[string]types.MessageAttributeValue {
+	attributes := map[string]types.MessageAttributeValue{
+		"product_id":      stringAttribute(event.ProductID.String()),
+		"tenant_id":       stringAttribute(event.TenantID.String()),
+		"memory_mb":       stringAttribute(strconv.Itoa(event.MemoryMB)),
+		"start_timestamp": stringAttribute(startTime.String()),
+		"end_timestamp":   stringAttribute(endTime.String()),
+		"workflow":        stringAttribute(event.Workflow),
+		"billing":         stringAttribute(event.Billing),
+		"billing_policy":  stringAttribute(event.BillingPolicy),
+	}
+	if r.pseudonymizer != nil && event.Subject != "" {
+		attributes["user_id"] = stringAttribute(event.Subject)
+	}
+	if len(event.Units) > 0 {
+		units, _ := json.Marshal(event.Units)
+		attributes["units"] = stringAttribute(string(units))
+	}
+
+	return attributes
+}
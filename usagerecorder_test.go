@@ -0,0 +1,296 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	"github.com/grasp-labs/go-libs/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newTestUsageRecorder returns a recorder emitting to queue, events are sent once the returned func is called.
+func newTestUsageRecorder(t *testing.T, queue *recordingBatchQueue) (*UsageRecorder, func() []UsageEvent) {
+	t.Helper()
+
+	emitter, err := NewUsageEmitter(queue, UsageEmitterConfig{QueueURL: "foo_queue", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := NewUsageRecorder(context.Background(), UsageRecorderConfig{ProductID: productID, MemoryMB: 512, Emitter: emitter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return recorder, func() []UsageEvent {
+		assert.NoError(t, emitter.Close(context.Background()))
+
+		var events []UsageEvent
+		for _, batch := range queue.batches {
+			for _, entry := range batch {
+				var event UsageEvent
+				assert.NoError(t, json.Unmarshal([]byte(aws.ToString(entry.MessageBody)), &event))
+				events = append(events, event)
+			}
+		}
+
+		return events
+	}
+}
+
+func TestNewUsageRecorder(t *testing.T) {
+	emitter := &UsageEmitter{}
+
+	tests := []struct {
+		name       string
+		cfg        UsageRecorderConfig
+		env        map[string]string
+		wantErrMsg string
+	}{
+		{
+			name:       "ShouldErrorOnNilProduct",
+			cfg:        UsageRecorderConfig{MemoryMB: 512, Emitter: emitter},
+			wantErrMsg: "usage recorder - product id is nil",
+		},
+		{
+			name:       "ShouldErrorOnNegativeMemoryMB",
+			cfg:        UsageRecorderConfig{ProductID: productID, MemoryMB: -1, Emitter: emitter},
+			wantErrMsg: "usage recorder - memory MB -1 is negative",
+		},
+		{
+			name:       "ShouldErrorOnUnknownBuildingMode",
+			cfg:        UsageRecorderConfig{ProductID: productID, MemoryMB: 512},
+			env:        map[string]string{"BUILDING_MODE": "foo_mode"},
+			wantErrMsg: "unknown building mode!",
+		},
+		{
+			name: "ShouldDetectMemoryMB",
+			cfg:  UsageRecorderConfig{ProductID: productID, Emitter: emitter},
+			env:  map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "2048"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			r, err := NewUsageRecorder(context.Background(), tt.cfg)
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, 2048, r.memoryMB)
+		})
+	}
+}
+
+func TestUsageRecorder_Record(t *testing.T) {
+	otherProductID := uuid.MustParse("b0f1b7a4-3c55-4b9e-9d0c-4f5b8e0e7f11")
+	start := time.Date(2024, 6, 18, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	tests := []struct {
+		name       string
+		event      UsageEvent
+		want       UsageEvent
+		wantErrMsg string
+	}{
+		{
+			name:  "ShouldSetDefaults",
+			event: UsageEvent{TenantID: tenantID, Workflow: "nightly-export", StartTime: start, EndTime: start.Add(time.Minute)},
+			want: UsageEvent{
+				Version:       UsageEventVersion,
+				ProductID:     productID,
+				TenantID:      tenantID,
+				Workflow:      "nightly-export",
+				MemoryMB:      512,
+				StartTime:     start.UTC(),
+				EndTime:       start.Add(time.Minute).UTC(),
+				DurationMS:    60000,
+				Billing:       UsageBilled,
+				BillingPolicy: "all",
+			},
+		},
+		{
+			name: "ShouldKeepEventProductAndMemory",
+			event: UsageEvent{
+				ProductID: otherProductID,
+				TenantID:  tenantID,
+				Workflow:  "nightly-export",
+				MemoryMB:  4096,
+				Units:     map[string]int64{"rows": 5000},
+				StartTime: start,
+				EndTime:   start.Add(time.Second),
+			},
+			want: UsageEvent{
+				Version:       UsageEventVersion,
+				ProductID:     otherProductID,
+				TenantID:      tenantID,
+				Workflow:      "nightly-export",
+				MemoryMB:      4096,
+				Units:         map[string]int64{"rows": 5000},
+				StartTime:     start.UTC(),
+				EndTime:       start.Add(time.Second).UTC(),
+				DurationMS:    1000,
+				Billing:       UsageBilled,
+				BillingPolicy: "all",
+			},
+		},
+		{
+			name:       "ShouldErrorOnNilTenant",
+			event:      UsageEvent{Workflow: "nightly-export"},
+			wantErrMsg: "usage recorder - tenant id is nil",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, sent := newTestUsageRecorder(t, &recordingBatchQueue{})
+
+			err := r.Record(context.Background(), tt.event)
+			events := sent()
+			if tt.wantErrMsg != "" {
+				assert.EqualError(t, err, tt.wantErrMsg)
+				assert.Empty(t, events)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []UsageEvent{tt.want}, events)
+		})
+	}
+}
+
+func TestUsageRecorder_RecordLegacy(t *testing.T) {
+	m := mocks.NewClientSqs(t)
+	m.EXPECT().
+		SendMsg(context.Background(), mock.MatchedBy(func(attrs map[string]types.MessageAttributeValue) bool {
+			return aws.ToString(attrs["workflow"].StringValue) == "nightly-export" &&
+				aws.ToString(attrs["memory_mb"].StringValue) == "512" &&
+				aws.ToString(attrs["product_id"].StringValue) == productID.String()
+		})).
+		Return(fmt.Errorf("foo sqs")).
+		Once()
+
+	r, err := newUsageRecorder(UsageRecorderConfig{ProductID: productID, MemoryMB: 512}, m)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = r.Record(context.Background(), UsageEvent{TenantID: tenantID, Workflow: "nightly-export", StartTime: time.Now(), EndTime: time.Now()})
+	assert.EqualError(t, err, "foo sqs")
+}
+
+// TestUsageRecorder_RecordLegacyGolden pins the legacy attribute format, the usageconsumer package decodes the golden file.
+func TestUsageRecorder_RecordLegacyGolden(t *testing.T) {
+	var got map[string]string
+	m := mocks.NewClientSqs(t)
+	m.EXPECT().
+		SendMsg(context.Background(), mock.MatchedBy(func(attrs map[string]types.MessageAttributeValue) bool {
+			got = make(map[string]string, len(attrs))
+			for k, v := range attrs {
+				got[k] = aws.ToString(v.StringValue)
+			}
+			return true
+		})).
+		Return(nil).
+		Once()
+
+	r, err := newUsageRecorder(UsageRecorderConfig{ProductID: productID, MemoryMB: 1024, BillingPolicy: BillSuccesses}, m)
+	if !assert.NoError(t, err) {
+		return
+	}
+	start := time.Date(2024, 6, 18, 14, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	assert.NoError(t, r.Record(context.Background(), UsageEvent{
+		TenantID:   tenantID,
+		Workflow:   "/workflows/:id",
+		StatusCode: http.StatusCreated,
+		Units:      map[string]int64{"rows": 5000},
+		StartTime:  start,
+		EndTime:    start.Add(1500 * time.Millisecond),
+	}))
+
+	data, err := json.MarshalIndent(got, "", "  ")
+	if !assert.NoError(t, err) {
+		return
+	}
+	path := filepath.Join("testdata", "usageevent", "legacy.golden")
+	if *update {
+		assert.NoError(t, os.WriteFile(path, append(data, '\n'), 0o644))
+	}
+	want, err := os.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, string(want), string(data)+"\n")
+}
+
+func TestUsageRecorder_RecordLegacyNotBilled(t *testing.T) {
+	r, err := newUsageRecorder(UsageRecorderConfig{ProductID: productID, MemoryMB: 512, BillingPolicy: BillSuccesses}, mocks.NewClientSqs(t))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the mock fails the test on any SendMsg call
+	err = r.Record(context.Background(), UsageEvent{TenantID: tenantID, StatusCode: http.StatusInternalServerError})
+	assert.NoError(t, err)
+}
+
+func TestUsageRecorder_Track(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenant  uuid.UUID
+		err     error
+		wantErr error
+		want    int
+	}{
+		{
+			name:   "ShouldRecordWork",
+			tenant: tenantID,
+			want:   1,
+		},
+		{
+			name:    "ShouldRecordFailedWork",
+			tenant:  tenantID,
+			err:     fmt.Errorf("foo job"),
+			wantErr: fmt.Errorf("foo job"),
+			want:    1,
+		},
+		{
+			name:   "ShouldNotFailWorkOnRecordError",
+			tenant: uuid.Nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, sent := newTestUsageRecorder(t, &recordingBatchQueue{})
+
+			ran := false
+			err := r.Track(context.Background(), tt.tenant, "nightly-export", func() error {
+				ran = true
+				time.Sleep(time.Millisecond)
+				return tt.err
+			})
+			assert.True(t, ran)
+			assert.Equal(t, tt.wantErr, err)
+
+			events := sent()
+			if !assert.Len(t, events, tt.want) || tt.want == 0 {
+				return
+			}
+			assert.Equal(t, tenantID, events[0].TenantID)
+			assert.Equal(t, productID, events[0].ProductID)
+			assert.Equal(t, "nightly-export", events[0].Workflow)
+			assert.NotEqual(t, uuid.Nil, events[0].RequestID)
+			assert.GreaterOrEqual(t, events[0].DurationMS, 1.0)
+		})
+	}
+}